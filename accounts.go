@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"dre/db"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// accountsCommand lists accounts, shows one, or changes its quota:
+//
+//	dre accounts list
+//	dre accounts show <id>
+//	dre accounts quota [-monthly-minutes n] [-concurrent-sessions n] [-reset] <id>
+//
+// A quota of 0 is unlimited. -reset clears the account's overrides so the
+// configured limits apply again.
+func accountsCommand(database *db.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: dre accounts list|show|quota")
+	}
+
+	switch args[0] {
+	case "list":
+		return listAccounts(database)
+	case "show":
+		if len(args) != 2 {
+			return errors.New("usage: dre accounts show <id>")
+		}
+
+		return showAccount(database, args[1])
+	case "quota":
+		return setAccountQuota(database, args[1:])
+	}
+
+	return fmt.Errorf("accounts: unknown command %q", args[0])
+}
+
+func listAccounts(database *db.DB) error {
+	var (
+		err      error
+		accounts []db.Account
+		members  []db.Membership
+		quota    db.Quota
+	)
+
+	if accounts, err = database.FindAccounts(); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tOWNER\tMEMBERS\tREQUIRE 2FA\tMONTHLY MINUTES\tSESSIONS\tCREATED")
+	for _, acct := range accounts {
+		if members, err = database.FindMemberships(acct.ID); err != nil {
+			return err
+		}
+
+		if quota, err = database.FindQuota(acct.ID); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%d\t%t\t%s\t%s\t%s\n", acct.ID, owner(members), len(members), acct.Require2FA,
+			limit(quota.MonthlyMinutes, acct.QuotaMonthlyMinutes), limit(quota.ConcurrentSessions, acct.QuotaConcurrentSessions), acct.CreatedAt)
+	}
+
+	return w.Flush()
+}
+
+func showAccount(database *db.DB, arg string) error {
+	var (
+		err      error
+		id       int
+		acct     db.Account
+		members  []db.Membership
+		quota    db.Quota
+		minutes  float64
+		sessions int
+	)
+
+	if id, err = strconv.Atoi(arg); err != nil {
+		return fmt.Errorf("accounts: invalid id %q", arg)
+	}
+
+	if acct, err = database.FindAccount(id); err != nil {
+		return err
+	}
+
+	if members, err = database.FindMemberships(id); err != nil {
+		return err
+	}
+
+	if quota, err = database.FindQuota(id); err != nil {
+		return err
+	}
+
+	if minutes, err = database.MonthlyMinutes(id); err != nil {
+		return err
+	}
+
+	if sessions, err = database.ActiveSessions(id); err != nil {
+		return err
+	}
+
+	fmt.Printf("Account %d, created %s\n", acct.ID, acct.CreatedAt)
+	fmt.Printf("Require 2FA:      %t\n", acct.Require2FA)
+	fmt.Printf("Monthly minutes:  %.0f of %s\n", minutes, limit(quota.MonthlyMinutes, acct.QuotaMonthlyMinutes))
+	fmt.Printf("Active sessions:  %d of %s\n\n", sessions, limit(quota.ConcurrentSessions, acct.QuotaConcurrentSessions))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tUSERNAME\tROLE\tJOINED")
+	for _, m := range members {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", m.UserID, m.Username, m.Role, m.CreatedAt)
+	}
+
+	return w.Flush()
+}
+
+func setAccountQuota(database *db.DB, args []string) error {
+	var (
+		err      error
+		id       int
+		acct     db.Account
+		flags    = flag.NewFlagSet("accounts quota", flag.ContinueOnError)
+		minutes  = flags.Int("monthly-minutes", 0, "container minutes the account can use a month, 0 for unlimited")
+		sessions = flags.Int("concurrent-sessions", 0, "containers the account can run at once, 0 for unlimited")
+		reset    = flags.Bool("reset", false, "clear the account's overrides so the configured limits apply")
+		quota    = db.Quota{MonthlyMinutes: -1, ConcurrentSessions: -1}
+	)
+
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: dre accounts quota [flags] <id>")
+	}
+
+	if id, err = strconv.Atoi(flags.Arg(0)); err != nil {
+		return fmt.Errorf("accounts: invalid id %q", flags.Arg(0))
+	}
+
+	if acct, err = database.FindAccount(id); err != nil {
+		return err
+	}
+
+	// limits that aren't given keep their override unless -reset is
+	if !*reset {
+		if acct.QuotaMonthlyMinutes.Valid {
+			quota.MonthlyMinutes = int(acct.QuotaMonthlyMinutes.Int64)
+		}
+
+		if acct.QuotaConcurrentSessions.Valid {
+			quota.ConcurrentSessions = int(acct.QuotaConcurrentSessions.Int64)
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "monthly-minutes":
+			quota.MonthlyMinutes = *minutes
+		case "concurrent-sessions":
+			quota.ConcurrentSessions = *sessions
+		}
+	})
+
+	if *minutes < 0 || *sessions < 0 {
+		return errors.New("accounts: quotas can't be negative")
+	}
+
+	if err = database.SetQuota(id, quota); err != nil {
+		return err
+	}
+
+	auditCommand(database, id, db.AuditAccountUpdated, strconv.Itoa(id), map[string]interface{}{
+		"quota_monthly_minutes":     quota.MonthlyMinutes,
+		"quota_concurrent_sessions": quota.ConcurrentSessions,
+	})
+
+	return showAccount(database, flags.Arg(0))
+}
+
+// owner returns the username of an account's first owner
+func owner(members []db.Membership) string {
+	for _, m := range members {
+		if m.Role == db.RoleOwner {
+			return m.Username
+		}
+	}
+
+	return "-"
+}
+
+// limit describes a quota limit and whether the account overrides it
+func limit(value int, override sql.NullInt64) string {
+	s := "unlimited"
+	if value > 0 {
+		s = strconv.Itoa(value)
+	}
+
+	if !override.Valid {
+		s += " (default)"
+	}
+
+	return s
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"dre/config"
+	"dre/ws"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// attachCommand opens a terminal to a container on a server, like the
+// browser does:
+//
+//	dre attach [-url u] [-token t] [-account id] [-detach-keys keys] <container-id>
+//
+// The token is an access token or an API key, and defaults to DRE_TOKEN.
+// The url defaults to DRE_URL, or else the address the server listens on.
+// The local terminal is put in raw mode and its size follows the window.
+// Typing the detach keys, ctrl-p ctrl-q by default, leaves the session.
+func attachCommand(cfg config.Config, args []string) error {
+	var (
+		err        error
+		conn       *websocket.Conn
+		resp       *http.Response
+		detachKeys []byte
+		flags      = flag.NewFlagSet("attach", flag.ContinueOnError)
+		address    = flags.String("url", os.Getenv("DRE_URL"), "URL of the server")
+		token      = flags.String("token", os.Getenv("DRE_TOKEN"), "access token or API key to attach with")
+		account    = flags.String("account", "", "id of the account the container belongs to, if not the user's own")
+		keys       = flags.String("detach-keys", "ctrl-p,ctrl-q", "keys that detach from the container")
+	)
+
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: dre attach [flags] <container-id>")
+	}
+
+	if *token == "" {
+		return errors.New("attach: -token or DRE_TOKEN is required")
+	}
+
+	if detachKeys, err = parseDetachKeys(*keys); err != nil {
+		return err
+	}
+
+	if *address == "" {
+		*address = "http://" + cfg.Listen
+		if cfg.TLS.Cert != "" {
+			*address = "https://" + cfg.Listen
+		}
+	}
+
+	header := http.Header{"Authorization": {"Bearer " + *token}}
+	if *account != "" {
+		header.Set("X-Account-ID", *account)
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{ws.Protocol}}
+	target := "ws" + strings.TrimPrefix(strings.TrimSuffix(*address, "/"), "http") +
+		"/v1/pty?container_id=" + url.QueryEscape(flags.Arg(0))
+
+	if conn, resp, err = dialer.Dial(target, header); err != nil {
+		if resp != nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("attach: %s %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+
+		return fmt.Errorf("attach: %s", err)
+	}
+	defer conn.Close()
+
+	return session(conn, detachKeys, *keys)
+}
+
+// session connects the local terminal to a pty websocket until either side
+// closes or the user detaches
+func session(conn *websocket.Conn, detachKeys []byte, keys string) error {
+	var (
+		mutex   sync.Mutex
+		done    = make(chan error, 2)
+		winches = make(chan os.Signal, 1)
+		stdin   = int(os.Stdin.Fd())
+	)
+
+	send := func(data []byte) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	resize := func() {
+		cols, rows, err := terminal.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			return
+		}
+
+		data, _ := json.Marshal(ws.Resize{Type: "resize", Cols: cols, Rows: rows})
+		send(data)
+	}
+
+	if terminal.IsTerminal(stdin) {
+		state, err := terminal.MakeRaw(stdin)
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(stdin, state)
+	}
+
+	fmt.Fprintf(os.Stderr, "Attached, detach with %s\r\n", keys)
+
+	resize()
+	signal.Notify(winches, syscall.SIGWINCH)
+	defer signal.Stop(winches)
+	go func() {
+		for range winches {
+			resize()
+		}
+	}()
+
+	// output of the container
+	go func() {
+		for {
+			_, payload, err := conn.ReadMessage()
+			if err != nil {
+				done <- nil
+				return
+			}
+
+			buf, err := base64.StdEncoding.DecodeString(string(payload))
+			if err != nil {
+				done <- err
+				return
+			}
+
+			os.Stdout.Write(buf)
+		}
+	}()
+
+	// input of the user, held back while it could be the detach keys
+	go func() {
+		var (
+			buf     = make([]byte, 1024)
+			pending []byte
+		)
+
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				done <- nil
+				return
+			}
+
+			var out []byte
+			for _, b := range buf[:n] {
+				if b == detachKeys[len(pending)] {
+					pending = append(pending, b)
+				} else {
+					out = append(out, pending...)
+					pending = nil
+					if b == detachKeys[0] {
+						pending = append(pending, b)
+					} else {
+						out = append(out, b)
+					}
+				}
+
+				if len(pending) == len(detachKeys) {
+					if len(out) > 0 {
+						send([]byte(base64.StdEncoding.EncodeToString(out)))
+					}
+					done <- nil
+					return
+				}
+			}
+
+			if len(out) > 0 {
+				if err = send([]byte(base64.StdEncoding.EncodeToString(out))); err != nil {
+					done <- nil
+					return
+				}
+			}
+		}
+	}()
+
+	err := <-done
+
+	mutex.Lock()
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	mutex.Unlock()
+
+	fmt.Fprint(os.Stderr, "\r\nDetached\r\n")
+
+	return err
+}
+
+// parseDetachKeys parses a comma separated list of keys like ctrl-p or q
+func parseDetachKeys(keys string) ([]byte, error) {
+	var sequence []byte
+
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if len(key) == 1 {
+			sequence = append(sequence, key[0])
+			continue
+		}
+
+		switch key = strings.ToLower(key); {
+		case len(key) == 6 && strings.HasPrefix(key, "ctrl-") && key[5] >= 'a' && key[5] <= 'z':
+			sequence = append(sequence, key[5]-'a'+1)
+		case key == "ctrl-@", key == "ctrl-[", key == "ctrl-\\", key == "ctrl-]", key == "ctrl-^", key == "ctrl-_":
+			sequence = append(sequence, key[5]&0x1f)
+		default:
+			return nil, fmt.Errorf("attach: invalid detach key %q", key)
+		}
+	}
+
+	return sequence, nil
+}
@@ -0,0 +1,179 @@
+package builds
+
+import (
+	"context"
+	"dre/db"
+	"dre/docker"
+	"dre/logging"
+	"dre/metrics"
+	"dre/tracing"
+	"errors"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrQueueFull is returned when there is no room left in the queue
+var ErrQueueFull = errors.New("builds: queue is full")
+
+// queueSize is the number of builds that can wait for a worker
+const queueSize = 256
+
+// Queue runs image builds on a fixed number of workers. Identical builds
+// that are queued or running at the same time share a single build.
+type Queue struct {
+	database db.Builds
+	workers  int
+	jobs     chan *job
+	mutex    sync.Mutex
+	inflight map[string]*job
+}
+
+type job struct {
+	build db.Build
+	done  chan struct{}
+	// links are the spans of the requests that asked for the build
+	links []trace.Link
+}
+
+// New returns a Queue that builds with the given number of workers
+func New(database db.Builds, workers int) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &Queue{
+		database: database,
+		workers:  workers,
+		jobs:     make(chan *job, queueSize),
+		inflight: make(map[string]*job),
+	}
+}
+
+// Start fails builds interrupted by a previous process and starts the workers
+func (q *Queue) Start() error {
+	if err := q.database.FailInterruptedBuilds(); err != nil {
+		return err
+	}
+
+	for i := 0; i < q.workers; i++ {
+		go q.work()
+	}
+
+	return nil
+}
+
+// Enqueue queues a build for a source URL. If a build for the same source
+// URL is already queued or running, that build is returned instead. The
+// build's span is linked to the span in ctx.
+func (q *Queue) Enqueue(ctx context.Context, sourceURL string) (db.Build, error) {
+	var (
+		j   *job
+		ok  bool
+		err error
+	)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if j, ok = q.inflight[sourceURL]; ok {
+		j.links = append(j.links, tracing.Link(ctx))
+		return j.build, nil
+	}
+
+	j = &job{done: make(chan struct{}), links: []trace.Link{tracing.Link(ctx)}}
+	if j.build, err = q.database.CreateBuild(sourceURL); err != nil {
+		return db.Build{}, err
+	}
+
+	select {
+	case q.jobs <- j:
+	default:
+		q.database.FinishBuild(&j.build, "", ErrQueueFull)
+		return db.Build{}, ErrQueueFull
+	}
+
+	q.inflight[sourceURL] = j
+
+	return j.build, nil
+}
+
+// Depth returns the number of builds waiting for a worker
+func (q *Queue) Depth() int {
+	return len(q.jobs)
+}
+
+// Wait blocks until the build with the given UUID is done or ctx is done,
+// and returns the latest state of the build
+func (q *Queue) Wait(ctx context.Context, id string) (db.Build, error) {
+	var done chan struct{}
+
+	q.mutex.Lock()
+	for _, j := range q.inflight {
+		if j.build.UUID == id {
+			done = j.done
+		}
+	}
+	q.mutex.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+
+	return q.database.FindBuild(id)
+}
+
+func (q *Queue) work() {
+	for j := range q.jobs {
+		q.mutex.Lock()
+		links := j.links
+		q.mutex.Unlock()
+
+		q.run(j.build, links)
+
+		q.mutex.Lock()
+		delete(q.inflight, j.build.SourceURL)
+		q.mutex.Unlock()
+
+		close(j.done)
+	}
+}
+
+func (q *Queue) run(build db.Build, links []trace.Link) {
+	var (
+		logs     string
+		err      error
+		buildErr error
+		start    = time.Now()
+	)
+
+	ctx, span := tracing.StartLinked("build", links,
+		attribute.String("build.id", build.UUID), attribute.String("build.source_url", build.SourceURL))
+
+	log := logging.Default().With("build_id", build.UUID)
+
+	if err = q.database.StartBuild(&build); err != nil {
+		log.Error("build not started", "error", err)
+	}
+
+	log.Info("building image", "source_url", build.SourceURL)
+	logs, buildErr = docker.BuildImage(ctx, build.UUID, build.SourceURL)
+	tracing.End(span, buildErr)
+
+	status := db.BuildSucceeded
+	if buildErr != nil {
+		status = db.BuildFailed
+		metrics.BuildFailures.Inc()
+	}
+	metrics.BuildDuration.WithLabelValues(status).Observe(time.Since(start).Seconds())
+	log.Info("build finished", "status", status, "duration_ms", time.Since(start).Milliseconds(), "error", buildErr)
+
+	if err = q.database.FinishBuild(&build, logs, buildErr); err != nil {
+		log.Error("build not saved", "error", err)
+	}
+}
@@ -0,0 +1,547 @@
+// Package config loads the server's settings. Settings come from defaults,
+// then the profile for the environment in a YAML file, then DRE_*
+// environment variables, then flags, each overriding the last.
+package config
+
+import (
+	"dre/logging"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is every setting of the server
+type Config struct {
+	Environment string `yaml:"-"`
+	// Args are the arguments left after flags, like a subcommand's
+	Args []string `yaml:"-"`
+	// Listen is the host:port to serve on
+	Listen string `yaml:"listen"`
+	// StaticDir is served at /, defaulting to the working directory
+	StaticDir string   `yaml:"static_dir"`
+	TLS       TLS      `yaml:"tls"`
+	Database  Database `yaml:"database"`
+	Builds    Builds   `yaml:"builds"`
+	Limits    Limits   `yaml:"limits"`
+	Shutdown  Shutdown `yaml:"shutdown"`
+	Log       Log      `yaml:"log"`
+	Tracing   Tracing  `yaml:"tracing"`
+	Secrets   Secrets  `yaml:"secrets"`
+	// OIDCProviders is a JSON file of identity providers
+	OIDCProviders string `yaml:"oidc_providers"`
+	// Notifier delivers password resets: log or file:<path>
+	Notifier string `yaml:"notifier"`
+	// PreviewURL is where previews of container ports are served, each on a
+	// subdomain of its host. Previews are off without it.
+	PreviewURL string `yaml:"preview_url"`
+}
+
+// TLS serves HTTPS when both files are set
+type TLS struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// Enabled reports whether the server should serve HTTPS
+func (t TLS) Enabled() bool {
+	return t.Cert != "" || t.Key != ""
+}
+
+// Database uses the keys of dbconfig.yml so profiles can be shared with
+// sql-migrate
+type Database struct {
+	Dialect    string `yaml:"dialect"`
+	Datasource string `yaml:"datasource"`
+	// DBConfig is the sql-migrate config the datasource is read from when
+	// it isn't set
+	DBConfig     string `yaml:"dbconfig"`
+	MaxOpenConns int    `yaml:"max_open_conns"`
+	// AutoMigrate applies pending migrations on startup. Without it the
+	// server refuses to start until they are applied.
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+// Builds configures the image build queue
+type Builds struct {
+	Workers int `yaml:"workers"`
+	// MinFreeDiskMB is the free disk the build directory needs for the
+	// server to be ready
+	MinFreeDiskMB int `yaml:"min_free_disk_mb"`
+}
+
+// Limits are the limits applied to users and accounts
+type Limits struct {
+	PasswordMinLength  int `yaml:"password_min_length"`
+	PasswordMinClasses int `yaml:"password_min_classes"`
+	// LockoutAttempts failed sign ins of a username within LockoutDuration
+	// lock it out for LockoutDuration. LockoutAddressAttempts do the same
+	// to a client address, which users may share.
+	LockoutAttempts         int           `yaml:"lockout_attempts"`
+	LockoutAddressAttempts  int           `yaml:"lockout_address_attempts"`
+	LockoutDuration         time.Duration `yaml:"lockout_duration"`
+	QuotaMonthlyMinutes     int           `yaml:"quota_monthly_minutes"`
+	QuotaConcurrentSessions int           `yaml:"quota_concurrent_sessions"`
+	// MaxSessions is how many sessions the server runs at once, across
+	// accounts, 0 for no limit
+	MaxSessions int `yaml:"max_sessions"`
+	// MaxVolumeQuotaMB is the largest workspace quota a persistent
+	// container can be created with
+	MaxVolumeQuotaMB int `yaml:"max_volume_quota_mb"`
+}
+
+// Shutdown configures what happens to sessions when the server is stopped
+type Shutdown struct {
+	// GracePeriod is how long attached sessions may carry on before their
+	// containers are stopped
+	GracePeriod time.Duration `yaml:"grace_period"`
+	// KeepContainers leaves containers running instead, so that the next
+	// server can attach to them again
+	KeepContainers bool `yaml:"keep_containers"`
+}
+
+// Log configures the server's log lines
+type Log struct {
+	// Level is the least severe level logged: debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is logfmt or json
+	Format string `yaml:"format"`
+}
+
+// Tracing exports OpenTelemetry spans when an endpoint is set
+type Tracing struct {
+	// Endpoint is the URL of an OTLP/HTTP collector, like
+	// http://localhost:4318
+	Endpoint string `yaml:"endpoint"`
+}
+
+// Secrets shouldn't be committed with the config file; set them with
+// environment variables instead
+type Secrets struct {
+	// SigningKeys are "kid:secret" pairs, the first of which signs new
+	// tokens
+	SigningKeys string `yaml:"signing_keys"`
+}
+
+// Development is the environment that may run without secrets
+const Development = "development"
+
+// Default returns the settings used when nothing overrides them
+func Default() Config {
+	return Config{
+		Environment: Development,
+		Listen:      "localhost:3000",
+		Database: Database{
+			Dialect:  "postgres",
+			DBConfig: "dbconfig.yml",
+		},
+		Builds: Builds{Workers: 2, MinFreeDiskMB: 1024},
+		Limits: Limits{
+			PasswordMinLength:      10,
+			PasswordMinClasses:     2,
+			LockoutAttempts:        5,
+			LockoutAddressAttempts: 50,
+			LockoutDuration:        15 * time.Minute,
+			MaxVolumeQuotaMB:       10240,
+		},
+		Shutdown: Shutdown{GracePeriod: 30 * time.Second},
+		Log:      Log{Level: "info", Format: logging.Logfmt},
+		Notifier: "log",
+	}
+}
+
+// Load reads the config selected by args and the environment. It isn't
+// validated, since commands that don't run the server need little of it.
+func Load(args []string) (Config, error) {
+	var (
+		cfg   = Default()
+		over  Config
+		port  int
+		flags = flag.NewFlagSet("dre", flag.ContinueOnError)
+		err   error
+	)
+
+	path := flags.String("config", orDefault(os.Getenv("DRE_CONFIG"), "config.yml"), "YAML file of settings per environment")
+	env := flags.String("env", orDefault(os.Getenv("DRE_ENV"), Development), "environment whose settings to use")
+	flags.StringVar(&over.Listen, "listen", "", "host:port to listen on")
+	flags.IntVar(&port, "port", 0, "port to listen on, keeping the host of -listen")
+	flags.BoolVar(&over.Database.AutoMigrate, "auto-migrate", false, "apply pending migrations on startup")
+	flags.IntVar(&over.Builds.Workers, "build-workers", 0, "number of images to build concurrently")
+	flags.IntVar(&over.Builds.MinFreeDiskMB, "build-min-free-disk-mb", 0, "free disk in MB builds need for the server to be ready")
+	flags.StringVar(&over.OIDCProviders, "oidc-providers", "", "JSON file of identity providers to sign in with")
+	flags.StringVar(&over.Notifier, "notifier", "", "where to send password resets: log or file:<path>")
+	flags.StringVar(&over.PreviewURL, "preview-url", "", "URL below which previews are served on subdomains, like https://preview.example.com")
+	flags.IntVar(&over.Limits.PasswordMinLength, "password-min-length", 0, "minimum length of new passwords")
+	flags.IntVar(&over.Limits.PasswordMinClasses, "password-min-classes", 0, "how many of lowercase, uppercase, digits and symbols new passwords must mix")
+	flags.IntVar(&over.Limits.LockoutAttempts, "lockout-attempts", 0, "failed sign ins that lock a username out")
+	flags.IntVar(&over.Limits.LockoutAddressAttempts, "lockout-address-attempts", 0, "failed sign ins that lock a client address out")
+	flags.DurationVar(&over.Limits.LockoutDuration, "lockout-duration", 0, "how long failed sign ins count and lock out for")
+	flags.IntVar(&over.Limits.QuotaMonthlyMinutes, "quota-monthly-minutes", 0, "container minutes each account can use a month, 0 for unlimited")
+	flags.IntVar(&over.Limits.QuotaConcurrentSessions, "quota-concurrent-sessions", 0, "containers each account can run at once, 0 for unlimited")
+	flags.IntVar(&over.Limits.MaxSessions, "max-sessions", 0, "containers the server runs at once, 0 for unlimited")
+	flags.IntVar(&over.Limits.MaxVolumeQuotaMB, "max-volume-quota-mb", 0, "largest workspace quota in MB a container can be created with")
+	flags.DurationVar(&over.Shutdown.GracePeriod, "shutdown-grace-period", 0, "how long sessions may carry on once the server is stopping")
+	flags.BoolVar(&over.Shutdown.KeepContainers, "keep-containers", false, "leave containers running on shutdown to attach to them again on the next start")
+	flags.StringVar(&over.Log.Level, "log-level", "", "least severe level to log: debug, info, warn or error")
+	flags.StringVar(&over.Log.Format, "log-format", "", "format of log lines: logfmt or json")
+	flags.StringVar(&over.Tracing.Endpoint, "tracing-endpoint", "", "URL of an OTLP/HTTP collector to export spans to")
+
+	if err = flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	cfg.Environment = *env
+	cfg.Args = flags.Args()
+
+	if err = cfg.loadFile(*path, set["config"] || os.Getenv("DRE_CONFIG") != ""); err != nil {
+		return Config{}, err
+	}
+
+	if err = cfg.loadDBConfig(); err != nil {
+		return Config{}, err
+	}
+
+	if err = cfg.loadEnv(); err != nil {
+		return Config{}, err
+	}
+
+	if set["listen"] {
+		cfg.Listen = over.Listen
+	}
+
+	if set["port"] {
+		host, _, _ := net.SplitHostPort(cfg.Listen)
+		cfg.Listen = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	if set["auto-migrate"] {
+		cfg.Database.AutoMigrate = over.Database.AutoMigrate
+	}
+
+	if set["build-workers"] {
+		cfg.Builds.Workers = over.Builds.Workers
+	}
+
+	if set["build-min-free-disk-mb"] {
+		cfg.Builds.MinFreeDiskMB = over.Builds.MinFreeDiskMB
+	}
+
+	if set["oidc-providers"] {
+		cfg.OIDCProviders = over.OIDCProviders
+	}
+
+	if set["notifier"] {
+		cfg.Notifier = over.Notifier
+	}
+
+	if set["preview-url"] {
+		cfg.PreviewURL = over.PreviewURL
+	}
+
+	if set["password-min-length"] {
+		cfg.Limits.PasswordMinLength = over.Limits.PasswordMinLength
+	}
+
+	if set["password-min-classes"] {
+		cfg.Limits.PasswordMinClasses = over.Limits.PasswordMinClasses
+	}
+
+	if set["lockout-attempts"] {
+		cfg.Limits.LockoutAttempts = over.Limits.LockoutAttempts
+	}
+
+	if set["lockout-address-attempts"] {
+		cfg.Limits.LockoutAddressAttempts = over.Limits.LockoutAddressAttempts
+	}
+
+	if set["lockout-duration"] {
+		cfg.Limits.LockoutDuration = over.Limits.LockoutDuration
+	}
+
+	if set["quota-monthly-minutes"] {
+		cfg.Limits.QuotaMonthlyMinutes = over.Limits.QuotaMonthlyMinutes
+	}
+
+	if set["quota-concurrent-sessions"] {
+		cfg.Limits.QuotaConcurrentSessions = over.Limits.QuotaConcurrentSessions
+	}
+
+	if set["max-sessions"] {
+		cfg.Limits.MaxSessions = over.Limits.MaxSessions
+	}
+
+	if set["max-volume-quota-mb"] {
+		cfg.Limits.MaxVolumeQuotaMB = over.Limits.MaxVolumeQuotaMB
+	}
+
+	if set["shutdown-grace-period"] {
+		cfg.Shutdown.GracePeriod = over.Shutdown.GracePeriod
+	}
+
+	if set["keep-containers"] {
+		cfg.Shutdown.KeepContainers = over.Shutdown.KeepContainers
+	}
+
+	if set["log-level"] {
+		cfg.Log.Level = over.Log.Level
+	}
+
+	if set["log-format"] {
+		cfg.Log.Format = over.Log.Format
+	}
+
+	if set["tracing-endpoint"] {
+		cfg.Tracing.Endpoint = over.Tracing.Endpoint
+	}
+
+	if cfg.StaticDir == "" {
+		if cfg.StaticDir, err = os.Getwd(); err != nil {
+			return Config{}, fmt.Errorf("config: could not get working directory: %s", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// loadFile applies the profile for the config's environment from a YAML
+// file mapping environments to settings. A missing file is only an error if
+// it was asked for.
+func (c *Config) loadFile(path string, required bool) error {
+	var (
+		data     []byte
+		err      error
+		profiles map[string]yaml.MapSlice
+	)
+
+	if data, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+
+		return fmt.Errorf("config: %s not read: %s", path, err)
+	}
+
+	if err = yaml.UnmarshalStrict(data, &profiles); err != nil {
+		return fmt.Errorf("config: %s not parsed: %s", path, err)
+	}
+
+	profile, ok := profiles[c.Environment]
+	if !ok {
+		return fmt.Errorf("config: %s has no %q environment", path, c.Environment)
+	}
+
+	// round trip the profile so unknown keys are caught and unset keys keep
+	// their defaults
+	if data, err = yaml.Marshal(profile); err != nil {
+		return fmt.Errorf("config: %s not parsed: %s", path, err)
+	}
+
+	if err = yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("config: %s environment %q: %s", path, c.Environment, err)
+	}
+
+	return nil
+}
+
+// loadDBConfig reads the datasource for the environment from sql-migrate's
+// config when none is set
+func (c *Config) loadDBConfig() error {
+	var (
+		data     []byte
+		err      error
+		profiles map[string]Database
+	)
+
+	if c.Database.Datasource != "" || c.Database.DBConfig == "" {
+		return nil
+	}
+
+	if data, err = ioutil.ReadFile(c.Database.DBConfig); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("config: %s not read: %s", c.Database.DBConfig, err)
+	}
+
+	if err = yaml.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("config: %s not parsed: %s", c.Database.DBConfig, err)
+	}
+
+	if profile, ok := profiles[c.Environment]; ok {
+		c.Database.Dialect = orDefault(profile.Dialect, c.Database.Dialect)
+		c.Database.Datasource = profile.Datasource
+	}
+
+	return nil
+}
+
+// loadEnv applies DRE_* environment variables
+func (c *Config) loadEnv() error {
+	strs := map[string]*string{
+		"DRE_LISTEN":           &c.Listen,
+		"DRE_STATIC_DIR":       &c.StaticDir,
+		"DRE_TLS_CERT":         &c.TLS.Cert,
+		"DRE_TLS_KEY":          &c.TLS.Key,
+		"DRE_DATABASE":         &c.Database.Dialect,
+		"DRE_DATABASE_URL":     &c.Database.Datasource,
+		"DRE_SIGNING_KEYS":     &c.Secrets.SigningKeys,
+		"DRE_OIDC_PROVIDERS":   &c.OIDCProviders,
+		"DRE_NOTIFIER":         &c.Notifier,
+		"DRE_PREVIEW_URL":      &c.PreviewURL,
+		"DRE_LOG_LEVEL":        &c.Log.Level,
+		"DRE_LOG_FORMAT":       &c.Log.Format,
+		"DRE_TRACING_ENDPOINT": &c.Tracing.Endpoint,
+	}
+	ints := map[string]*int{
+		"DRE_BUILD_WORKERS":             &c.Builds.Workers,
+		"DRE_BUILD_MIN_FREE_DISK_MB":    &c.Builds.MinFreeDiskMB,
+		"DRE_LOCKOUT_ATTEMPTS":          &c.Limits.LockoutAttempts,
+		"DRE_LOCKOUT_ADDRESS_ATTEMPTS":  &c.Limits.LockoutAddressAttempts,
+		"DRE_QUOTA_MONTHLY_MINUTES":     &c.Limits.QuotaMonthlyMinutes,
+		"DRE_QUOTA_CONCURRENT_SESSIONS": &c.Limits.QuotaConcurrentSessions,
+		"DRE_MAX_SESSIONS":              &c.Limits.MaxSessions,
+		"DRE_MAX_VOLUME_QUOTA_MB":       &c.Limits.MaxVolumeQuotaMB,
+	}
+	bools := map[string]*bool{
+		"DRE_AUTO_MIGRATE":             &c.Database.AutoMigrate,
+		"DRE_SHUTDOWN_KEEP_CONTAINERS": &c.Shutdown.KeepContainers,
+	}
+
+	for name, value := range strs {
+		if v, ok := os.LookupEnv(name); ok {
+			*value = v
+		}
+	}
+
+	for name, value := range bools {
+		if v, ok := os.LookupEnv(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("config: %s must be true or false, got %q", name, v)
+			}
+
+			*value = b
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"DRE_SHUTDOWN_GRACE_PERIOD": &c.Shutdown.GracePeriod,
+		"DRE_LOCKOUT_DURATION":      &c.Limits.LockoutDuration,
+	}
+
+	for name, value := range durations {
+		if v, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("config: %s must be a duration like 30s, got %q", name, v)
+			}
+
+			*value = d
+		}
+	}
+
+	for name, value := range ints {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("config: %s must be a number, got %q", name, v)
+			}
+
+			*value = n
+		}
+	}
+
+	return nil
+}
+
+// Validate returns an error listing every invalid setting
+func (c *Config) Validate() error {
+	var problems []string
+
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil || port == "" {
+		check(false, "listen must be host:port, got %q", c.Listen)
+	}
+
+	check(c.TLS.Cert == "" || c.TLS.Key != "", "tls.key is required with tls.cert")
+	check(c.TLS.Key == "" || c.TLS.Cert != "", "tls.cert is required with tls.key")
+
+	for _, file := range []string{c.TLS.Cert, c.TLS.Key, c.OIDCProviders} {
+		if file != "" {
+			_, err := os.Stat(file)
+			check(err == nil, "%s does not exist", file)
+		}
+	}
+
+	if info, err := os.Stat(c.StaticDir); err != nil || !info.IsDir() {
+		check(false, "static_dir %q is not a directory", c.StaticDir)
+	}
+
+	check(c.Database.Dialect == "postgres" || c.Database.Dialect == "sqlite3",
+		"database.dialect must be postgres or sqlite3, got %q", c.Database.Dialect)
+	check(c.Database.Datasource != "", "database.datasource is required (or DRE_DATABASE_URL)")
+	check(c.Database.MaxOpenConns >= 0, "database.max_open_conns can't be negative")
+	check(c.Builds.Workers > 0, "builds.workers must be at least 1")
+	check(c.Builds.MinFreeDiskMB >= 0, "builds.min_free_disk_mb can't be negative")
+	check(c.Limits.PasswordMinLength > 0, "limits.password_min_length must be at least 1")
+	check(c.Limits.PasswordMinClasses >= 0 && c.Limits.PasswordMinClasses <= 4, "limits.password_min_classes must be between 0 and 4")
+	check(c.Limits.LockoutAttempts > 0, "limits.lockout_attempts must be at least 1")
+	check(c.Limits.LockoutAddressAttempts > 0, "limits.lockout_address_attempts must be at least 1")
+	check(c.Limits.LockoutDuration > 0, "limits.lockout_duration must be positive")
+	check(c.Limits.QuotaMonthlyMinutes >= 0, "limits.quota_monthly_minutes can't be negative")
+	check(c.Limits.QuotaConcurrentSessions >= 0, "limits.quota_concurrent_sessions can't be negative")
+	check(c.Limits.MaxSessions >= 0, "limits.max_sessions can't be negative")
+	check(c.Limits.MaxVolumeQuotaMB > 0, "limits.max_volume_quota_mb must be at least 1")
+	check(c.Shutdown.GracePeriod >= 0, "shutdown.grace_period can't be negative")
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		check(false, "log.level must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+
+	check(c.Log.Format == logging.Logfmt || c.Log.Format == logging.JSON, "log.format must be logfmt or json, got %q", c.Log.Format)
+	if c.Tracing.Endpoint != "" {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"tracing.endpoint must be a URL like http://localhost:4318, got %q", c.Tracing.Endpoint)
+	}
+
+	if c.PreviewURL != "" {
+		u, err := url.Parse(c.PreviewURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && strings.Trim(u.Path, "/") == "",
+			"preview_url must be a URL like https://preview.example.com, got %q", c.PreviewURL)
+	}
+
+	check(c.Notifier == "log" || strings.HasPrefix(c.Notifier, "file:"), "notifier must be log or file:<path>, got %q", c.Notifier)
+	check(c.Secrets.SigningKeys != "" || c.Environment == Development,
+		"secrets.signing_keys is required outside development (or DRE_SIGNING_KEYS)")
+
+	if len(problems) > 0 {
+		return errors.New("config: invalid settings for " + c.Environment + ":\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
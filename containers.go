@@ -0,0 +1,109 @@
+package main
+
+import (
+	"dre/db"
+	"dre/docker"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// containersCommand lists containers or kills a running one:
+//
+//	dre containers list [-running]
+//	dre containers kill <id>
+//
+// Killing a container ends its session for everyone attached to it. Its
+// workspace volume, if it has one, is kept.
+func containersCommand(database *db.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: dre containers list|kill")
+	}
+
+	switch args[0] {
+	case "list":
+		return listContainers(database, args[1:])
+	case "kill":
+		if len(args) != 2 {
+			return errors.New("usage: dre containers kill <id>")
+		}
+
+		return killContainer(database, args[1])
+	}
+
+	return fmt.Errorf("containers: unknown command %q", args[0])
+}
+
+func listContainers(database *db.DB, args []string) error {
+	var (
+		err        error
+		containers []db.ContainerSummary
+		flags      = flag.NewFlagSet("containers list", flag.ContinueOnError)
+		running    = flags.Bool("running", false, "only list running containers")
+	)
+
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+
+	if containers, err = database.FindContainers(); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tACCOUNT\tIMAGE\tWORKSPACE\tRUNNING\tCREATED")
+	for _, c := range containers {
+		if *running && !c.Running {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%t\t%t\t%s\n", c.UUID, c.AccountID, c.ImageID, c.Persistent(), c.Running, c.CreatedAt)
+	}
+
+	return w.Flush()
+}
+
+func killContainer(database *db.DB, id string) error {
+	var (
+		err     error
+		ctr     db.Container
+		image   db.Image
+		uid     uuid.UUID
+		stopErr error
+	)
+
+	if ctr, err = database.FindContainer(id); err != nil {
+		return fmt.Errorf("containers: no container %q", id)
+	}
+
+	if image, err = database.FindImage(ctr.ImageID); err != nil {
+		return err
+	}
+
+	if uid, err = uuid.FromString(ctr.UUID); err != nil {
+		return err
+	}
+
+	// the server notices the session ended when its pty closes. Its runs are
+	// ended here since the server can't stop a container that's gone.
+	dctr := docker.NewContainer(uid, "")
+	stopErr = dctr.Stop()
+
+	if err = ctr.EndRuns(); err != nil {
+		return err
+	}
+
+	if stopErr != nil {
+		return fmt.Errorf("containers: %s wasn't running: %s", id, stopErr)
+	}
+
+	auditCommand(database, image.AccountID, db.AuditContainerKilled, ctr.UUID, nil)
+
+	fmt.Printf("Killed container %s\n", ctr.UUID)
+
+	return nil
+}
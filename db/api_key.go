@@ -0,0 +1,170 @@
+package db
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"dre/utils"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// API key scopes
+const (
+	ScopeContainersCreate = "containers:create"
+	ScopeContainersDelete = "containers:delete"
+	ScopeSessionsAttach   = "sessions:attach"
+	ScopeRead             = "read"
+)
+
+// Scopes are all the scopes an API key can have
+var Scopes = []string{ScopeContainersCreate, ScopeContainersDelete, ScopeSessionsAttach, ScopeRead}
+
+// APIKeyPrefix starts every API key, which tells them apart from access tokens
+const APIKeyPrefix = "dre_"
+
+var errInvalidAPIKey = errors.New("db: invalid api key")
+
+// APIKey authenticates programmatic access to an account. The secret is only
+// known when the key is created.
+type APIKey struct {
+	ID         int            `db:"id" json:"-"`
+	UUID       string         `db:"uuid" json:"uuid"`
+	AccountID  int            `db:"account_id" json:"account_id"`
+	UserID     int            `db:"user_id" json:"user_id"`
+	Name       string         `db:"name" json:"name"`
+	Prefix     string         `db:"prefix" json:"prefix"`
+	SecretHash string         `db:"secret_hash" json:"-"`
+	Scopes     string         `db:"scopes" json:"scopes"`
+	ExpiresAt  sql.NullString `db:"expires_at" json:"expires_at"`
+	LastUsedAt sql.NullString `db:"last_used_at" json:"last_used_at"`
+	RevokedAt  sql.NullString `db:"revoked_at" json:"-"`
+	UpdatedAt  string         `db:"updated_at" json:"updated_at"`
+	CreatedAt  string         `db:"created_at" json:"created_at"`
+	Key        string         `db:"-" json:"key,omitempty"`
+}
+
+// HasScope reports whether the key was granted scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range strings.Split(k.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidScope reports whether scope is one of Scopes
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CreateAPIKey creates a key for the user's account. expiresIn is in
+// seconds and zero means the key doesn't expire. The returned key is the
+// only copy of its secret.
+func (d *DB) CreateAPIKey(user *User, name string, scopes []string, expiresIn int) (APIKey, error) {
+	var (
+		key    APIKey
+		err    error
+		prefix = hex.EncodeToString(randomBytes(4))
+		secret = newRefreshToken()
+		uid    = uuid.NewV4().String()
+		query  = `INSERT INTO api_keys (uuid, account_id, user_id, name, prefix, secret_hash, scopes, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, ` + d.connection.dialect.secondsFromNow("$8") + ")"
+		expires = sql.NullFloat64{Float64: float64(expiresIn), Valid: expiresIn > 0}
+	)
+
+	_, err = d.connection.Exec(query, uid, user.AccountID, user.ID, name, prefix, hashToken(secret), strings.Join(scopes, ","), expires)
+	if err != nil {
+		return APIKey{}, utils.Error(err, "db: api key not created")
+	}
+
+	if err = d.connection.Get(&key, "SELECT * FROM api_keys WHERE uuid=$1", uid); err != nil {
+		return APIKey{}, utils.Error(err, "db: api key not found")
+	}
+
+	key.Key = APIKeyPrefix + prefix + "_" + secret
+
+	return key, nil
+}
+
+// FindAPIKeys returns the unrevoked keys of an account
+func (d *DB) FindAPIKeys(accountID int) ([]APIKey, error) {
+	var (
+		keys = []APIKey{}
+		err  error
+	)
+
+	if err = d.connection.Select(&keys, "SELECT * FROM api_keys WHERE account_id=$1 AND revoked_at IS NULL ORDER BY id", accountID); err != nil {
+		return nil, utils.Error(err, "db: api keys not found")
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of an account's keys
+func (d *DB) RevokeAPIKey(accountID int, id string) error {
+	var (
+		err    error
+		result sql.Result
+		n      int64
+	)
+
+	result, err = d.connection.Exec("UPDATE api_keys SET revoked_at=now() WHERE uuid=$1 AND account_id=$2 AND revoked_at IS NULL", id, accountID)
+	if err != nil {
+		return utils.Error(err, "db: api key not revoked")
+	}
+
+	if n, err = result.RowsAffected(); err == nil && n == 0 {
+		return utils.Error(sql.ErrNoRows, "db: api key not found")
+	}
+
+	return err
+}
+
+// AuthenticateAPIKey returns an unexpired, unrevoked key along with the user
+// that created it, and records that the key was used
+func (d *DB) AuthenticateAPIKey(token string) (APIKey, User, error) {
+	var (
+		key   APIKey
+		user  User
+		err   error
+		parts = strings.SplitN(strings.TrimPrefix(token, APIKeyPrefix), "_", 2)
+		query = "SELECT * FROM api_keys WHERE prefix=$1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())"
+	)
+
+	if !strings.HasPrefix(token, APIKeyPrefix) || len(parts) != 2 {
+		return APIKey{}, User{}, errInvalidAPIKey
+	}
+
+	if err = d.connection.Get(&key, query, parts[0]); err != nil {
+		return APIKey{}, User{}, utils.Error(err, "db: api key not found")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.SecretHash), []byte(hashToken(parts[1]))) != 1 {
+		return APIKey{}, User{}, errInvalidAPIKey
+	}
+
+	if err = d.connection.Get(&user, "SELECT * FROM users WHERE id=$1", key.UserID); err != nil {
+		return APIKey{}, User{}, utils.Error(err, "db: user not found")
+	}
+
+	if user.Disabled() {
+		return APIKey{}, User{}, ErrUserDisabled
+	}
+
+	if _, err = d.connection.Exec("UPDATE api_keys SET last_used_at=now() WHERE id=$1", key.ID); err != nil {
+		return APIKey{}, User{}, utils.Error(err, "db: api key not updated")
+	}
+
+	return key, user, nil
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"dre/utils"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+// Audit actions
+const (
+	AuditSignIn               = "auth.signin"
+	AuditSignInFailed         = "auth.signin_failed"
+	AuditSignOut              = "auth.signout"
+	AuditPasswordChanged      = "auth.password_changed"
+	AuditPasswordResetRequest = "auth.password_reset_requested"
+	AuditPasswordReset        = "auth.password_reset"
+	AuditTwoFactorEnabled     = "auth.2fa_enabled"
+	AuditTwoFactorDisabled    = "auth.2fa_disabled"
+	AuditTwoFactorFailed      = "auth.2fa_failed"
+	AuditRecoveryCodesCreated = "auth.recovery_codes_created"
+	AuditAPIKeyCreated        = "api_key.created"
+	AuditAPIKeyRevoked        = "api_key.revoked"
+	AuditAPIKeyUsed           = "api_key.used"
+	AuditAccountUpdated       = "account.updated"
+	AuditMemberInvited        = "member.invited"
+	AuditInvitationRevoked    = "member.invitation_revoked"
+	AuditInvitationAccepted   = "member.invitation_accepted"
+	AuditMemberRoleChanged    = "member.role_changed"
+	AuditMemberRemoved        = "member.removed"
+	AuditContainerCreated     = "container.created"
+	AuditContainerDeleted     = "container.deleted"
+	AuditSnapshotCreated      = "container.snapshot_created"
+	AuditFilesUploaded        = "container.files_uploaded"
+	AuditFilesDownloaded      = "container.files_downloaded"
+	AuditSessionAttached      = "session.attached"
+	AuditSessionDetached      = "session.detached"
+	AuditSessionResumed       = "session.resumed"
+	AuditUserDisabled         = "user.disabled"
+	AuditUserEnabled          = "user.enabled"
+	AuditContainerKilled      = "container.killed"
+)
+
+// MaxAuditEvents is the most events FindAuditEvents returns at once
+const MaxAuditEvents = 200
+
+// AuditEvent records who did what to what, and from where. Actor and
+// account are missing for failed sign ins of unknown users.
+type AuditEvent struct {
+	ID        int            `db:"id" json:"id"`
+	AccountID *int           `db:"account_id" json:"account_id,omitempty"`
+	ActorID   *int           `db:"actor_id" json:"actor_id,omitempty"`
+	Actor     string         `db:"actor" json:"actor"`
+	APIKey    *string        `db:"api_key" json:"api_key,omitempty"`
+	Action    string         `db:"action" json:"action"`
+	Target    string         `db:"target" json:"target,omitempty"`
+	IP        string         `db:"ip" json:"ip"`
+	UserAgent string         `db:"user_agent" json:"user_agent"`
+	Details   types.JSONText `db:"details" json:"details"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+}
+
+// AuditFilter narrows the events FindAuditEvents returns. Zero fields
+// don't filter.
+type AuditFilter struct {
+	// Action matches an action exactly, or every action in a group when it
+	// ends in a dot, like "auth."
+	Action  string
+	ActorID int
+	Target  string
+	Since   time.Time
+	Until   time.Time
+	// Before pages through events by returning those older than the event
+	// with this id
+	Before int
+	Limit  int
+}
+
+// CreateAuditEvent stores an event. details is encoded as JSON and may be
+// nil.
+func (d *DB) CreateAuditEvent(event *AuditEvent, details map[string]interface{}) error {
+	var (
+		err   error
+		data  = []byte("{}")
+		query = `INSERT INTO audit_events (account_id, actor_id, actor, api_key, action, target, ip, user_agent, details)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at`
+	)
+
+	if details != nil {
+		if data, err = json.Marshal(details); err != nil {
+			return utils.Error(err, "db: audit details not encoded")
+		}
+	}
+	event.Details = types.JSONText(data)
+
+	row := d.connection.QueryRowx(query, event.AccountID, event.ActorID, event.Actor, event.APIKey,
+		event.Action, event.Target, event.IP, event.UserAgent, event.Details)
+	if err = row.Scan(&event.ID, &event.CreatedAt); err != nil {
+		return utils.Error(err, "db: audit event not created")
+	}
+
+	return nil
+}
+
+// FindAuditEvents returns an account's events matching filter, newest first
+func (d *DB) FindAuditEvents(accountID int, filter AuditFilter) ([]AuditEvent, error) {
+	var (
+		events     []AuditEvent
+		err        error
+		conditions = []string{"account_id=$1"}
+		args       = []interface{}{accountID}
+	)
+
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if strings.HasSuffix(filter.Action, ".") {
+		where("action LIKE $%d", filter.Action+"%")
+	} else if filter.Action != "" {
+		where("action=$%d", filter.Action)
+	}
+
+	if filter.ActorID != 0 {
+		where("actor_id=$%d", filter.ActorID)
+	}
+
+	if filter.Target != "" {
+		where("target=$%d", filter.Target)
+	}
+
+	if !filter.Since.IsZero() {
+		where("created_at >= $%d", filter.Since)
+	}
+
+	if !filter.Until.IsZero() {
+		where("created_at < $%d", filter.Until)
+	}
+
+	if filter.Before != 0 {
+		where("id < $%d", filter.Before)
+	}
+
+	if filter.Limit <= 0 || filter.Limit > MaxAuditEvents {
+		filter.Limit = MaxAuditEvents
+	}
+
+	query := fmt.Sprintf("SELECT * FROM audit_events WHERE %s ORDER BY id DESC LIMIT %d", strings.Join(conditions, " AND "), filter.Limit)
+	if err = d.connection.Select(&events, query, args...); err != nil {
+		return nil, utils.Error(err, "db: audit events not found")
+	}
+
+	return events, nil
+}
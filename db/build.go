@@ -0,0 +1,174 @@
+package db
+
+import (
+	"database/sql"
+	"dre/utils"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Build statuses
+const (
+	BuildQueued    = "queued"
+	BuildRunning   = "running"
+	BuildSucceeded = "succeeded"
+	BuildFailed    = "failed"
+)
+
+// Build is a docker image build for a source URL. Its UUID doubles as the
+// docker image tag.
+type Build struct {
+	ID         int            `db:"id" json:"-"`
+	UUID       string         `db:"uuid" json:"uuid"`
+	SourceURL  string         `db:"source_url" json:"source_url"`
+	Status     string         `db:"status" json:"status"`
+	Logs       string         `db:"logs" json:"logs"`
+	Error      string         `db:"error" json:"error,omitempty"`
+	StartedAt  sql.NullString `db:"started_at" json:"-"`
+	FinishedAt sql.NullString `db:"finished_at" json:"-"`
+	UpdatedAt  string         `db:"updated_at" json:"updated_at"`
+	CreatedAt  string         `db:"created_at" json:"created_at"`
+}
+
+// Done reports whether the build has stopped running
+func (b *Build) Done() bool {
+	return b.Status == BuildSucceeded || b.Status == BuildFailed
+}
+
+func (d *DB) CreateBuild(sourceURL string) (Build, error) {
+	var (
+		build Build
+		query = "INSERT INTO builds (uuid, source_url, status) VALUES ($1, $2, $3)"
+		uid   = uuid.NewV4()
+		err   error
+	)
+
+	if _, err = d.connection.Exec(query, uid.String(), sourceURL, BuildQueued); err != nil {
+		return Build{}, utils.Error(err, "db: build not created")
+	}
+
+	if build, err = d.FindBuild(uid.String()); err != nil {
+		return Build{}, err
+	}
+
+	return build, nil
+}
+
+func (d *DB) FindBuild(id string) (Build, error) {
+	var (
+		build Build
+		err   error
+	)
+
+	if err = d.connection.Get(&build, "SELECT * FROM builds WHERE uuid=$1", id); err != nil {
+		return Build{}, utils.Error(err, "db: build not found")
+	}
+
+	return build, nil
+}
+
+// FindAccountBuild finds a build that produced one of an account's images.
+// Builds are shared between accounts that build the same source.
+func (d *DB) FindAccountBuild(accountID int, id string) (Build, error) {
+	var (
+		build Build
+		err   error
+		query = `SELECT * FROM builds WHERE uuid=$2 AND EXISTS (
+			SELECT 1 FROM images WHERE images.build_id = builds.id AND images.account_id=$1
+		)`
+	)
+
+	if err = d.connection.Get(&build, query, accountID, id); err != nil {
+		return Build{}, utils.Error(err, "db: build not found")
+	}
+
+	return build, nil
+}
+
+// FindImageBuild returns the build that produced an image
+func (d *DB) FindImageBuild(image *Image) (Build, error) {
+	var (
+		build Build
+		err   error
+	)
+
+	if !image.BuildID.Valid {
+		return Build{}, utils.Error(sql.ErrNoRows, "db: image has no build")
+	}
+
+	if err = d.connection.Get(&build, "SELECT * FROM builds WHERE id=$1", image.BuildID.Int64); err != nil {
+		return Build{}, utils.Error(err, "db: build not found")
+	}
+
+	return build, nil
+}
+
+// SetImageBuild records the build that produces an image
+func (d *DB) SetImageBuild(image *Image, build *Build) error {
+	var err error
+
+	if _, err = d.connection.Exec("UPDATE images SET build_id=$1 WHERE id=$2", build.ID, image.ID); err != nil {
+		return utils.Error(err, "db: image not updated")
+	}
+
+	image.BuildID = sql.NullInt64{Int64: int64(build.ID), Valid: true}
+
+	return nil
+}
+
+// StartBuild marks a build as running
+func (d *DB) StartBuild(build *Build) error {
+	var (
+		err   error
+		query = "UPDATE builds SET status=$1, started_at=now() WHERE id=$2"
+	)
+
+	if _, err = d.connection.Exec(query, BuildRunning, build.ID); err != nil {
+		return utils.Error(err, "db: build not started")
+	}
+
+	build.Status = BuildRunning
+
+	return nil
+}
+
+// FinishBuild stores a build's logs and marks it succeeded, or failed if
+// buildErr is not nil
+func (d *DB) FinishBuild(build *Build, logs string, buildErr error) error {
+	var (
+		err     error
+		status  = BuildSucceeded
+		message string
+		query   = "UPDATE builds SET status=$1, logs=$2, error=$3, finished_at=now() WHERE id=$4"
+	)
+
+	if buildErr != nil {
+		status = BuildFailed
+		message = buildErr.Error()
+	}
+
+	if _, err = d.connection.Exec(query, status, logs, message, build.ID); err != nil {
+		return utils.Error(err, "db: build not finished")
+	}
+
+	build.Status = status
+	build.Logs = logs
+	build.Error = message
+
+	return nil
+}
+
+// FailInterruptedBuilds fails builds that were left queued or running by a
+// previous process
+func (d *DB) FailInterruptedBuilds() error {
+	var (
+		err   error
+		query = "UPDATE builds SET status=$1, error=$2, finished_at=now() WHERE status IN ($3, $4)"
+	)
+
+	if _, err = d.connection.Exec(query, BuildFailed, "build interrupted", BuildQueued, BuildRunning); err != nil {
+		return utils.Error(err, "db: builds not updated")
+	}
+
+	return nil
+}
@@ -9,22 +9,35 @@ import (
 )
 
 type Container struct {
-	ID        int    `db:"id" json:"id"`
-	UUID      string `db:"uuid" json:"uuid"`
-	ImageID   int    `db:"image_id" json:"image_id"`
-	UpdatedAt string `db:"updated_at" json:"updated_at"`
-	CreatedAt string `db:"created_at" json:"created_at"`
-	database  *DB
-	run       run
+	ID            int            `db:"id" json:"id"`
+	UUID          string         `db:"uuid" json:"uuid"`
+	ImageID       int            `db:"image_id" json:"image_id"`
+	Volume        string         `db:"volume" json:"volume,omitempty"`
+	VolumeQuotaMB int            `db:"volume_quota_mb" json:"volume_quota_mb"`
+	DeletedAt     sql.NullString `db:"deleted_at" json:"-"`
+	UpdatedAt     string         `db:"updated_at" json:"updated_at"`
+	CreatedAt     string         `db:"created_at" json:"created_at"`
+	Running       bool           `db:"-" json:"running"`
+	database      *DB
+	run           run
+}
+
+// Persistent reports whether the container keeps a workspace volume
+// between runs
+func (c *Container) Persistent() bool {
+	return c.Volume != ""
 }
 
 type run struct {
-	ID          int            `db:"id" json:"id"`
-	StartedAt   string         `db:"started_at" json:"started_at"`
-	EndedAt     sql.NullString `db:"ended_at" json:"ended_at"`
-	UpdatedAt   string         `db:"updated_at" json:"updated_at"`
-	CreatedAt   string         `db:"created_at" json:"created_at"`
-	ContainerID int            `db:"container_id" json:"container_id"`
+	ID              int            `db:"id" json:"id"`
+	StartedAt       string         `db:"started_at" json:"started_at"`
+	EndedAt         sql.NullString `db:"ended_at" json:"ended_at"`
+	UpdatedAt       string         `db:"updated_at" json:"updated_at"`
+	CreatedAt       string         `db:"created_at" json:"created_at"`
+	ContainerID     int            `db:"container_id" json:"container_id"`
+	AccountID       sql.NullInt64  `db:"account_id" json:"account_id"`
+	CPUSeconds      float64        `db:"cpu_seconds" json:"cpu_seconds"`
+	MemoryGBSeconds float64        `db:"memory_gb_seconds" json:"memory_gb_seconds"`
 }
 
 func (d *DB) FindContainer(id string) (Container, error) {
@@ -33,13 +46,76 @@ func (d *DB) FindContainer(id string) (Container, error) {
 		err       error
 	)
 
-	if err = d.connection.Get(&container, "SELECT * FROM containers WHERE uuid=$1", id); err != nil {
+	if err = d.connection.Get(&container, "SELECT * FROM containers WHERE uuid=$1 AND deleted_at IS NULL", id); err != nil {
 		return Container{}, err
 	}
 
 	return container, nil
 }
 
+// FindAccountContainer finds a container whose image belongs to an account
+func (d *DB) FindAccountContainer(accountID int, id string) (Container, error) {
+	var (
+		container = Container{database: d}
+		err       error
+		query     = `SELECT containers.* FROM containers JOIN images ON images.id = containers.image_id
+			WHERE images.account_id=$1 AND containers.uuid=$2 AND containers.deleted_at IS NULL`
+	)
+
+	if err = d.connection.Get(&container, query, accountID, id); err != nil {
+		return Container{}, err
+	}
+
+	return container, nil
+}
+
+// FindAccountContainers returns the containers whose images belong to an
+// account
+func (d *DB) FindAccountContainers(accountID int) ([]Container, error) {
+	var (
+		containers = []Container{}
+		err        error
+		query      = `SELECT containers.* FROM containers JOIN images ON images.id = containers.image_id
+			WHERE images.account_id=$1 AND containers.deleted_at IS NULL ORDER BY containers.id`
+	)
+
+	if err = d.connection.Select(&containers, query, accountID); err != nil {
+		return nil, utils.Error(err, "db: containers not found")
+	}
+
+	return containers, nil
+}
+
+// ContainerSummary is a container along with its account and whether it
+// has an open run
+type ContainerSummary struct {
+	Container
+	AccountID int  `db:"account_id" json:"account_id"`
+	Running   bool `db:"running" json:"running"`
+}
+
+// FindContainers returns every container that hasn't been deleted
+func (d *DB) FindContainers() ([]ContainerSummary, error) {
+	var (
+		containers = []ContainerSummary{}
+		err        error
+		query      = `SELECT containers.*, images.account_id,
+				EXISTS (SELECT 1 FROM runs WHERE runs.container_id = containers.id AND runs.ended_at IS NULL) AS running
+			FROM containers JOIN images ON images.id = containers.image_id
+			WHERE containers.deleted_at IS NULL ORDER BY containers.id`
+	)
+
+	if err = d.connection.Select(&containers, query); err != nil {
+		return nil, utils.Error(err, "db: containers not found")
+	}
+
+	for i := range containers {
+		containers[i].database = d
+	}
+
+	return containers, nil
+}
+
 func (d *DB) CreateContainer(image *Image) (Container, error) {
 	var (
 		container = Container{database: d}
@@ -67,16 +143,48 @@ func (d *DB) CreateContainer(image *Image) (Container, error) {
 	return container, nil
 }
 
+// SetContainerVolume records the workspace volume of a container and its
+// quota. A quota of 0 keeps the default.
+func (d *DB) SetContainerVolume(c *Container, volume string, quotaMB int) error {
+	var (
+		err   error
+		query = "UPDATE containers SET volume=$1, volume_quota_mb=COALESCE(NULLIF($2, 0), volume_quota_mb) WHERE id=$3"
+	)
+
+	if _, err = d.connection.Exec(query, volume, quotaMB, c.ID); err != nil {
+		return utils.Error(err, "db: container not updated")
+	}
+
+	c.Volume = volume
+	if quotaMB > 0 {
+		c.VolumeQuotaMB = quotaMB
+	}
+
+	return nil
+}
+
+// DeleteContainer marks a container as deleted
+func (d *DB) DeleteContainer(c *Container) error {
+	var err error
+
+	if _, err = d.connection.Exec("UPDATE containers SET deleted_at=now() WHERE id=$1", c.ID); err != nil {
+		return utils.Error(err, "db: container not deleted")
+	}
+
+	return nil
+}
+
 func (c *Container) Start() error {
 	var (
 		err   error
 		id    int
-		query = "INSERT INTO runs (container_id, started_at) VALUES ($1, now()) RETURNING id"
-		r     run
-		row   *sql.Row
+		query = `INSERT INTO runs (container_id, account_id, started_at)
+			VALUES ($1, (SELECT account_id FROM images WHERE id=$2), now()) RETURNING id`
+		r   run
+		row *sql.Row
 	)
 
-	row = c.database.connection.QueryRow(query, c.ID)
+	row = c.database.connection.QueryRow(query, c.ID, c.ImageID)
 	if err = row.Scan(&id); err != nil {
 		return utils.Error(err, "db: run not created")
 	}
@@ -96,9 +204,66 @@ func (c *Container) End() error {
 		query = "UPDATE runs SET ended_at=now() WHERE ID=$1"
 	)
 
-	if _, err = c.database.connection.Query(query, c.run.ID); err != nil {
+	if _, err = c.database.connection.Exec(query, c.run.ID); err != nil {
 		return utils.Error(err, "db: run not updated")
 	}
 
 	return nil
 }
+
+// RunID returns the ID of the container's current run, or 0 before it has
+// started
+func (c *Container) RunID() int {
+	return c.run.ID
+}
+
+// Resume continues the container's open run, or starts a run if it has
+// none, for a container that was left running by a previous process
+func (c *Container) Resume() error {
+	var (
+		err   error
+		r     run
+		query = "SELECT * FROM runs WHERE container_id=$1 AND ended_at IS NULL ORDER BY id DESC LIMIT 1"
+	)
+
+	if err = c.database.connection.Get(&r, query, c.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Start()
+		}
+
+		return utils.Error(err, "db: run not found")
+	}
+
+	c.run = r
+
+	return nil
+}
+
+// EndRuns ends every run of the container that is still open, for when the
+// container was stopped by something other than the session that ran it
+func (c *Container) EndRuns() error {
+	var (
+		err   error
+		query = "UPDATE runs SET ended_at=now() WHERE container_id=$1 AND ended_at IS NULL"
+	)
+
+	if _, err = c.database.connection.Exec(query, c.ID); err != nil {
+		return utils.Error(err, "db: runs not ended")
+	}
+
+	return nil
+}
+
+// RecordUsage adds resources used by the container to its current run
+func (c *Container) RecordUsage(cpuSeconds float64, memoryGBSeconds float64) error {
+	var (
+		err   error
+		query = "UPDATE runs SET cpu_seconds = cpu_seconds + $1, memory_gb_seconds = memory_gb_seconds + $2 WHERE id=$3"
+	)
+
+	if _, err = c.database.connection.Exec(query, cpuSeconds, memoryGBSeconds, c.run.ID); err != nil {
+		return utils.Error(err, "db: run usage not recorded")
+	}
+
+	return nil
+}
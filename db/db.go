@@ -1,66 +1,118 @@
 package db
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"database/sql"
+	"dre/utils"
+	"errors"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	uuid "github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Credentials struct {
-	Password string `json:"password", db:"password"`
-	Username string `json:"username", db:"username"`
+	Password string `json:"password" db:"password"`
+	Username string `json:"username" db:"username"`
+	Email    string `json:"email" db:"email"`
 }
 
-type account struct {
-	ID        int    `db:"id" json:"id"`
-	UpdatedAt string `db:"updated_at" json:"updated_at"`
-	CreatedAt string `db:"created_at" json:"created_at"`
+// Account owns images and containers, and is shared by its members
+type Account struct {
+	ID                      int           `db:"id" json:"id"`
+	Require2FA              bool          `db:"require_2fa" json:"require_2fa"`
+	QuotaMonthlyMinutes     sql.NullInt64 `db:"quota_monthly_minutes" json:"-"`
+	QuotaConcurrentSessions sql.NullInt64 `db:"quota_concurrent_sessions" json:"-"`
+	UpdatedAt               string        `db:"updated_at" json:"updated_at"`
+	CreatedAt               string        `db:"created_at" json:"created_at"`
 }
 
 type User struct {
-	ID        int    `db:"id" json:"id"`
-	AccountID int    `db:"account_id" json:"account_id"`
-	Username  string `db:"username" json:"username"`
-	Password  string `db:"password" json:"-"`
-	UpdatedAt string `db:"updated_at" json:"updated_at"`
-	CreatedAt string `db:"created_at" json:"created_at"`
+	ID           int            `db:"id" json:"id"`
+	AccountID    int            `db:"account_id" json:"account_id"`
+	Username     string         `db:"username" json:"username"`
+	Email        *string        `db:"email" json:"email,omitempty"`
+	Password     string         `db:"password" json:"-"`
+	TOTPSecret   sql.NullString `db:"totp_secret" json:"-"`
+	TOTPEnabled  bool           `db:"totp_enabled" json:"totp_enabled"`
+	TOTPLastStep int64          `db:"totp_last_step" json:"-"`
+	DisabledAt   sql.NullString `db:"disabled_at" json:"-"`
+	UpdatedAt    string         `db:"updated_at" json:"updated_at"`
+	CreatedAt    string         `db:"created_at" json:"created_at"`
+}
+
+// ErrUserTaken is returned when a user is created with the username or email
+// of another
+var ErrUserTaken = errors.New("db: username or email is taken")
+
+// ErrUserDisabled is returned when a disabled user authenticates
+var ErrUserDisabled = errors.New("db: user is disabled")
+
+// Disabled reports whether the user has been disabled and can't sign in
+func (u *User) Disabled() bool {
+	return u.DisabledAt.Valid
 }
 
 type Image struct {
-	ID        int    `db:"id" json:"id"`
-	UUID      string `db:"uuid" json:"uuid"`
-	AccountID int    `db:"account_id" json:"account_id"`
-	SourceURL string `db:"source_url" json:"source_url"`
-	UpdatedAt string `db:"updated_at" json:"updated_at"`
-	CreatedAt string `db:"created_at" json:"created_at"`
+	ID         int           `db:"id" json:"id"`
+	UUID       string        `db:"uuid" json:"uuid"`
+	AccountID  int           `db:"account_id" json:"account_id"`
+	SourceURL  string        `db:"source_url" json:"source_url"`
+	BuildID    sql.NullInt64 `db:"build_id" json:"-"`
+	SnapshotOf sql.NullInt64 `db:"snapshot_of" json:"-"`
+	UpdatedAt  string        `db:"updated_at" json:"updated_at"`
+	CreatedAt  string        `db:"created_at" json:"created_at"`
 }
 
 type DB struct {
-	connection *sqlx.DB
+	connection *conn
 }
 
 type queryParams map[string]interface{}
 
-func Connect() DB {
+// Connect opens a connection pool to the database at datasource, which is
+// a postgres or sqlite3 database depending on dialectName. maxOpenConns of 0
+// leaves the pool unbounded. SQLite databases, including ":memory:", use a
+// single connection.
+func Connect(dialectName string, datasource string, maxOpenConns int) (DB, error) {
 	var (
-		dbname     string
-		params     string
 		connection *sqlx.DB
+		d          dialect
 		err        error
 	)
 
-	dbname = "dre_development"
-	params = fmt.Sprintf("user=choxi password=password dbname=%s sslmode=disable", dbname)
-	if connection, err = sqlx.Connect("postgres", params); err != nil {
-		log.Fatalln(err)
+	if d, err = dialectFor(dialectName); err != nil {
+		return DB{}, err
+	}
+
+	if connection, err = sqlx.Connect(d.name(), datasource); err != nil {
+		return DB{}, utils.Error(err, "db: could not connect")
+	}
+
+	if d.name() == DialectSQLite {
+		maxOpenConns = 1
+	}
+
+	connection.SetMaxOpenConns(maxOpenConns)
+
+	return DB{&conn{connection, d, context.Background()}}, nil
+}
+
+// WithContext returns a store whose queries are traced as part of the span
+// in ctx
+func (d *DB) WithContext(ctx context.Context) Store {
+	return &DB{&conn{d.connection.DB, d.connection.dialect, ctx}}
+}
+
+// Ping checks that the database can be reached
+func (d *DB) Ping() error {
+	if err := d.connection.Ping(); err != nil {
+		return utils.Error(err, "db: not reachable")
 	}
 
-	return DB{connection}
+	return nil
 }
 
 func (d *DB) CreateImage(user User, sourceURL string) (Image, error) {
@@ -103,6 +155,60 @@ func (d *DB) FindImage(id int) (Image, error) {
 	return image, nil
 }
 
+func (d *DB) FindImageByUUID(id string) (Image, error) {
+	var (
+		image Image
+		err   error
+	)
+
+	if err = d.connection.Get(&image, "SELECT * FROM images WHERE uuid=$1", id); err != nil {
+		return image, err
+	}
+
+	return image, nil
+}
+
+// FindAccountImage finds an image that belongs to an account
+func (d *DB) FindAccountImage(accountID int, id string) (Image, error) {
+	var (
+		image Image
+		err   error
+	)
+
+	if err = d.connection.Get(&image, "SELECT * FROM images WHERE account_id=$1 AND uuid=$2", accountID, id); err != nil {
+		return image, err
+	}
+
+	return image, nil
+}
+
+// CreateSnapshotImage creates an image owned by user's account for a
+// snapshot of container. The snapshot is tagged with the image's UUID.
+func (d *DB) CreateSnapshotImage(user User, container *Container) (Image, error) {
+	var (
+		image Image
+		query = "INSERT INTO images (uuid, source_url, account_id, snapshot_of) VALUES ($1, '', $2, $3)"
+		err   error
+		uid   = uuid.NewV4()
+	)
+
+	if _, err = d.connection.Exec(query, uid.String(), user.AccountID, container.ID); err != nil {
+		return Image{}, err
+	}
+
+	if image, err = d.FindImageByUUID(uid.String()); err != nil {
+		return Image{}, err
+	}
+
+	return image, nil
+}
+
+// DeleteImage removes an image
+func (d *DB) DeleteImage(image *Image) error {
+	_, err := d.connection.Exec("DELETE FROM images WHERE id=$1", image.ID)
+	return err
+}
+
 func (d *DB) FindUser(username string) (User, error) {
 	var (
 		user User
@@ -116,48 +222,98 @@ func (d *DB) FindUser(username string) (User, error) {
 	return user, nil
 }
 
-func (d *DB) CreateUser(username string, password string) (User, error) {
+func (d *DB) FindUserByID(id int) (User, error) {
+	var (
+		user User
+		err  error
+	)
+
+	if err = d.connection.Get(&user, "SELECT * FROM users WHERE id=$1", id); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// CreateUser creates a user along with an account they own. Nothing is
+// created if the username or email is taken, which returns ErrUserTaken.
+func (d *DB) CreateUser(username string, password string, email string) (User, error) {
 	var (
 		err    error
+		t      *tx
 		user   User
-		acct   account
-		query  = "INSERT INTO users (username, password, account_id) VALUES ($1, $2, $3)"
-		hashed []byte
+		userID int
 	)
 
-	if acct, err = d.CreateAccount(); err != nil {
-		return User{}, err
+	if t, err = d.connection.begin(); err != nil {
+		return User{}, utils.Error(err, "db: transaction not begun")
 	}
+	defer t.Rollback()
 
-	if hashed, err = bcrypt.GenerateFromPassword([]byte(password), 8); err != nil {
+	if userID, err = createUser(t, username, password, email); err != nil {
 		return User{}, err
 	}
 
-	if _, err = d.connection.Query(query, username, string(hashed), acct.ID); err != nil {
-		return User{}, err
+	if err = t.Commit(); err != nil {
+		return User{}, utils.Error(err, "db: user not created")
 	}
 
-	if err = d.connection.Get(&user, "SELECT * FROM users WHERE username=$1", username); err != nil {
+	if err = d.connection.Get(&user, "SELECT * FROM users WHERE id=$1", userID); err != nil {
 		return User{}, err
 	}
 
 	return user, nil
 }
 
-func (d *DB) CreateAccount() (account, error) {
+// createUser inserts a user, an account and their ownership of it in t, and
+// returns the user's ID
+func createUser(t *tx, username string, password string, email string) (int, error) {
+	var (
+		err       error
+		accountID int
+		userID    int
+		query     = "INSERT INTO users (username, password, account_id, email) VALUES ($1, $2, $3, NULLIF($4, '')) RETURNING id"
+		hashed    []byte
+	)
+
+	if hashed, err = bcrypt.GenerateFromPassword([]byte(password), 8); err != nil {
+		return 0, err
+	}
+
+	if err = t.QueryRow("INSERT INTO accounts DEFAULT VALUES RETURNING id").Scan(&accountID); err != nil {
+		return 0, utils.Error(err, "db: account not created")
+	}
+
+	if err = t.QueryRow(query, username, string(hashed), accountID, email).Scan(&userID); err != nil {
+		if t.conn.dialect.uniqueViolation(err) {
+			return 0, ErrUserTaken
+		}
+
+		return 0, utils.Error(err, "db: user not created")
+	}
+
+	query = "INSERT INTO memberships (account_id, user_id, role) VALUES ($1, $2, $3)"
+	if _, err = t.Exec(query, accountID, userID, RoleOwner); err != nil {
+		return 0, utils.Error(err, "db: membership not created")
+	}
+
+	return userID, nil
+}
+
+func (d *DB) CreateAccount() (Account, error) {
 	var (
 		err  error
-		acct account
+		acct Account
 		id   int
 	)
 
 	r := d.connection.QueryRow("INSERT INTO accounts DEFAULT VALUES RETURNING id")
 	if err = r.Scan(&id); err != nil {
-		return account{}, err
+		return Account{}, err
 	}
 
 	if err = d.connection.Get(&acct, "SELECT * FROM accounts WHERE id=$1", id); err != nil {
-		return account{}, err
+		return Account{}, err
 	}
 
 	return acct, nil
@@ -177,62 +333,94 @@ func (d *DB) SignInUser(username string, password string) (User, error) {
 		return User{}, err
 	}
 
+	if user.Disabled() {
+		return User{}, ErrUserDisabled
+	}
+
 	return user, nil
 }
 
-var secret = []byte("PANCAKES")
+// FindUsers returns every user
+func (d *DB) FindUsers() ([]User, error) {
+	var (
+		users = []User{}
+		err   error
+	)
+
+	if err = d.connection.Select(&users, "SELECT * FROM users ORDER BY id"); err != nil {
+		return nil, utils.Error(err, "db: users not found")
+	}
+
+	return users, nil
+}
 
-func CreateToken(user *User) (string, error) {
+// SetUserDisabled disables or re-enables a user. Disabling a user signs
+// them out everywhere; their API keys stop working until they're enabled.
+func (d *DB) SetUserDisabled(user *User, disabled bool) error {
 	var (
-		token       *jwt.Token
-		tokenString string
-		err         error
+		err   error
+		query = "UPDATE users SET disabled_at=now() WHERE id=$1 AND disabled_at IS NULL"
 	)
 
-	token = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": user.Username,
-	})
+	if !disabled {
+		query = "UPDATE users SET disabled_at=NULL WHERE id=$1"
+	}
 
-	if tokenString, err = token.SignedString(secret); err != nil {
-		return "", err
+	if _, err = d.connection.Exec(query, user.ID); err != nil {
+		return utils.Error(err, "db: user not updated")
 	}
 
-	return tokenString, nil
+	if disabled {
+		if err = d.RevokeUserTokens(user); err != nil {
+			return err
+		}
+	}
+
+	return d.connection.Get(user, "SELECT * FROM users WHERE id=$1", user.ID)
 }
 
-func (d *DB) AuthenticateToken(tokenString string) (User, error) {
+// FindAccounts returns every account
+func (d *DB) FindAccounts() ([]Account, error) {
 	var (
-		token    *jwt.Token
+		accounts = []Account{}
 		err      error
-		ok       bool
-		claims   jwt.MapClaims
-		username string
-		user     User
 	)
 
-	token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok = token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
+	if err = d.connection.Select(&accounts, "SELECT * FROM accounts ORDER BY id"); err != nil {
+		return nil, utils.Error(err, "db: accounts not found")
+	}
 
-		return secret, nil
-	})
+	return accounts, nil
+}
 
-	if err != nil {
-		return User{}, err
-	}
+// FindAccount returns an account
+func (d *DB) FindAccount(id int) (Account, error) {
+	var (
+		acct Account
+		err  error
+	)
 
-	if claims, ok = token.Claims.(jwt.MapClaims); !ok || !token.Valid {
-		return User{}, fmt.Errorf("Invalid authentication token")
+	if err = d.connection.Get(&acct, "SELECT * FROM accounts WHERE id=$1", id); err != nil {
+		return Account{}, utils.Error(err, "db: account not found")
 	}
 
-	if username, ok = claims["username"].(string); !ok {
-		return User{}, err
-	}
+	return acct, nil
+}
 
-	if user, err = d.FindUser(username); err != nil {
-		return User{}, err
+// FindImageTags returns the docker tags of images that are still in use:
+// the builds of images, snapshots and builds that haven't finished
+func (d *DB) FindImageTags() ([]string, error) {
+	var (
+		tags  = []string{}
+		err   error
+		query = `SELECT builds.uuid FROM images JOIN builds ON builds.id = images.build_id
+			UNION SELECT uuid FROM images WHERE snapshot_of IS NOT NULL
+			UNION SELECT uuid FROM builds WHERE status IN ($1, $2)`
+	)
+
+	if err = d.connection.Select(&tags, query, BuildQueued, BuildRunning); err != nil {
+		return nil, utils.Error(err, "db: image tags not found")
 	}
 
-	return user, nil
+	return tags, nil
 }
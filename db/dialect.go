@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"dre/metrics"
+	"dre/tracing"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Dialects Connect supports, named after their database/sql drivers
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite3"
+)
+
+// dialect writes the SQL that differs between databases. Queries are
+// written for postgres and rebound for other databases.
+type dialect interface {
+	name() string
+	rebind(query string) string
+	// secondsFromNow is the time param seconds from now, or NULL if param is
+	// NULL
+	secondsFromNow(param string) string
+	// seconds is the number of seconds between two timestamps
+	seconds(end string, start string) string
+	// period formats a timestamp as the day or month it is in
+	period(period string, column string) string
+	monthStart() string
+	// uniqueViolation reports whether err is a unique constraint violation
+	uniqueViolation(err error) bool
+	// timestamp is t as a param that compares with the database's own
+	// timestamps
+	timestamp(t time.Time) interface{}
+}
+
+func dialectFor(name string) (dialect, error) {
+	switch name {
+	case DialectPostgres, "":
+		return postgres{}, nil
+	case DialectSQLite:
+		return sqlite{}, nil
+	}
+
+	return nil, fmt.Errorf("db: unknown dialect %q", name)
+}
+
+type postgres struct{}
+
+func (postgres) name() string { return DialectPostgres }
+
+func (postgres) rebind(query string) string { return query }
+
+func (postgres) secondsFromNow(param string) string {
+	return "now() + " + param + "::float8 * interval '1 second'"
+}
+
+func (postgres) seconds(end string, start string) string {
+	return "extract(epoch FROM " + end + " - " + start + ")"
+}
+
+func (postgres) period(period string, column string) string {
+	if period == PeriodMonth {
+		return "to_char(" + column + ", 'YYYY-MM')"
+	}
+
+	return "to_char(" + column + ", 'YYYY-MM-DD')"
+}
+
+func (postgres) monthStart() string { return "date_trunc('month', now())" }
+
+func (postgres) timestamp(t time.Time) interface{} { return t.UTC() }
+
+func (postgres) uniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+type sqlite struct{}
+
+var (
+	sqliteParam = regexp.MustCompile(`\$(\d+)`)
+	sqliteNow   = regexp.MustCompile(`\bnow\(\)`)
+)
+
+func (sqlite) name() string { return DialectSQLite }
+
+// rebind numbers params like ?1, since queries don't always use them in
+// order, and replaces now()
+func (sqlite) rebind(query string) string {
+	query = sqliteParam.ReplaceAllString(query, "?$1")
+	return sqliteNow.ReplaceAllString(query, "CURRENT_TIMESTAMP")
+}
+
+func (sqlite) secondsFromNow(param string) string {
+	return "datetime('now', " + param + " || ' seconds')"
+}
+
+func (sqlite) seconds(end string, start string) string {
+	return "((julianday(" + end + ") - julianday(" + start + ")) * 86400)"
+}
+
+func (sqlite) period(period string, column string) string {
+	if period == PeriodMonth {
+		return "strftime('%Y-%m', " + column + ")"
+	}
+
+	return "strftime('%Y-%m-%d', " + column + ")"
+}
+
+func (sqlite) monthStart() string { return "strftime('%Y-%m-01 00:00:00', 'now')" }
+
+// timestamp formats t like CURRENT_TIMESTAMP. The driver would add a zone,
+// which sorts after a CURRENT_TIMESTAMP of the same second.
+func (sqlite) timestamp(t time.Time) interface{} {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func (sqlite) uniqueViolation(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// conn is a connection pool that rebinds queries for its dialect. Queries
+// are traced as part of the span in ctx.
+type conn struct {
+	*sqlx.DB
+	dialect dialect
+	ctx     context.Context
+}
+
+// args stores times in UTC, in the form the database stores its own
+// timestamps in
+func (c *conn) args(args []interface{}) []interface{} {
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			args[i] = c.dialect.timestamp(t)
+		}
+	}
+
+	return args
+}
+
+// observe traces a query made with method and records how long it takes.
+// The returned function ends the query.
+func (c *conn) observe(method string, query string) func() {
+	start := time.Now()
+	span := tracing.StartChild(c.ctx, "db "+method,
+		attribute.String("db.system", c.dialect.name()), attribute.String("db.statement", query))
+
+	return func() {
+		metrics.DBQueryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		span.End()
+	}
+}
+
+func (c *conn) Get(dest interface{}, query string, args ...interface{}) error {
+	defer c.observe("get", query)()
+	return c.DB.Get(dest, c.dialect.rebind(query), c.args(args)...)
+}
+
+func (c *conn) Select(dest interface{}, query string, args ...interface{}) error {
+	defer c.observe("select", query)()
+	return c.DB.Select(dest, c.dialect.rebind(query), c.args(args)...)
+}
+
+func (c *conn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer c.observe("exec", query)()
+	return c.DB.Exec(c.dialect.rebind(query), c.args(args)...)
+}
+
+func (c *conn) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer c.observe("query", query)()
+	return c.DB.QueryRow(c.dialect.rebind(query), c.args(args)...)
+}
+
+func (c *conn) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	defer c.observe("query", query)()
+	return c.DB.QueryRowx(c.dialect.rebind(query), c.args(args)...)
+}
+
+func (c *conn) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	defer c.observe("exec", query)()
+	return c.DB.NamedExec(c.dialect.rebind(query), arg)
+}
+
+// tx is a transaction that rebinds and observes queries like conn. With
+// sqlite's single connection, nothing but the transaction may query until it
+// is committed or rolled back.
+type tx struct {
+	*sqlx.Tx
+	conn *conn
+}
+
+func (c *conn) begin() (*tx, error) {
+	t, err := c.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx{t, c}, nil
+}
+
+func (t *tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer t.conn.observe("exec", query)()
+	return t.Tx.Exec(t.conn.dialect.rebind(query), t.conn.args(args)...)
+}
+
+func (t *tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer t.conn.observe("query", query)()
+	return t.Tx.QueryRow(t.conn.dialect.rebind(query), t.conn.args(args)...)
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"dre/utils"
+	"errors"
+	"fmt"
+)
+
+// ErrIdentityTaken is returned when a provider's subject is already linked to
+// a user, like when it signs in for the first time twice at once
+var ErrIdentityTaken = errors.New("db: identity is taken")
+
+// maxUsernameSuffix bounds the search for a free username
+const maxUsernameSuffix = 100
+
+// FindIdentityUser returns the user linked to a provider's subject
+func (d *DB) FindIdentityUser(provider string, subject string) (User, error) {
+	var (
+		user  User
+		err   error
+		query = "SELECT users.* FROM users JOIN identities ON identities.user_id = users.id WHERE identities.provider=$1 AND identities.subject=$2"
+	)
+
+	if err = d.connection.Get(&user, query, provider, subject); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// CreateIdentityUser creates a user linked to a provider's subject. The user
+// gets the first free username starting with username and a random password,
+// so they can only sign in through the provider. If accountID isn't zero the
+// user joins that account as a member and acts on it by default. Nothing is
+// created if the identity is taken, which returns ErrIdentityTaken.
+func (d *DB) CreateIdentityUser(provider string, subject string, username string, email string, accountID int) (User, error) {
+	var (
+		user      User
+		err       error
+		t         *tx
+		userID    int
+		candidate = username
+		taken     int
+		query     = "INSERT INTO identities (provider, subject, user_id, email) VALUES ($1, $2, $3, $4)"
+	)
+
+	for i := 2; ; i++ {
+		if err = d.connection.Get(&taken, "SELECT count(*) FROM users WHERE username=$1", candidate); err != nil {
+			return User{}, utils.Error(err, "db: username not checked")
+		}
+
+		if taken == 0 {
+			break
+		}
+
+		if i > maxUsernameSuffix {
+			return User{}, fmt.Errorf("db: no free username for %s", username)
+		}
+
+		candidate = fmt.Sprintf("%s-%d", username, i)
+	}
+
+	if email != "" {
+		if err = d.connection.Get(&taken, "SELECT count(*) FROM users WHERE email=$1", email); err != nil || taken > 0 {
+			email = ""
+		}
+	}
+
+	if t, err = d.connection.begin(); err != nil {
+		return User{}, utils.Error(err, "db: transaction not begun")
+	}
+	defer t.Rollback()
+
+	if userID, err = createUser(t, candidate, newRefreshToken(), email); err != nil {
+		return User{}, err
+	}
+
+	if _, err = t.Exec(query, provider, subject, userID, email); err != nil {
+		if d.connection.dialect.uniqueViolation(err) {
+			return User{}, ErrIdentityTaken
+		}
+
+		return User{}, utils.Error(err, "db: identity not created")
+	}
+
+	if accountID != 0 {
+		query = "INSERT INTO memberships (account_id, user_id, role) VALUES ($1, $2, $3)"
+		if _, err = t.Exec(query, accountID, userID, RoleMember); err != nil {
+			return User{}, utils.Error(err, "db: membership not created")
+		}
+
+		if _, err = t.Exec("UPDATE users SET account_id=$1 WHERE id=$2", accountID, userID); err != nil {
+			return User{}, utils.Error(err, "db: user not updated")
+		}
+	}
+
+	if err = t.Commit(); err != nil {
+		return User{}, utils.Error(err, "db: user not created")
+	}
+
+	if err = d.connection.Get(&user, "SELECT * FROM users WHERE id=$1", userID); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,299 @@
+package db
+
+import (
+	"database/sql"
+	"dre/utils"
+	"errors"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Roles of account members, from least to most privileged
+const (
+	RoleViewer = "viewer"
+	RoleMember = "member"
+	RoleAdmin  = "admin"
+	RoleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleMember: 2, RoleAdmin: 3, RoleOwner: 4}
+
+// ErrLastOwner is returned when a change would leave an account without owners
+var ErrLastOwner = errors.New("db: account needs an owner")
+
+// ValidRole reports whether role is a known role
+func ValidRole(role string) bool {
+	return roleRanks[role] > 0
+}
+
+// RoleAtLeast reports whether role is at least as privileged as min
+func RoleAtLeast(role string, min string) bool {
+	return ValidRole(role) && roleRanks[role] >= roleRanks[min]
+}
+
+// Membership gives a user a role in an account
+type Membership struct {
+	ID        int    `db:"id" json:"-"`
+	AccountID int    `db:"account_id" json:"account_id"`
+	UserID    int    `db:"user_id" json:"user_id"`
+	Username  string `db:"username" json:"username"`
+	Role      string `db:"role" json:"role"`
+	// Require2FA is set when the account requires its members to use
+	// two-factor authentication
+	Require2FA bool   `db:"require_2fa" json:"require_2fa"`
+	UpdatedAt  string `db:"updated_at" json:"updated_at"`
+	CreatedAt  string `db:"created_at" json:"created_at"`
+}
+
+// Invitation invites a user, by username or email, to join an account. It is
+// accepted with a token sent to the invitee, since neither the username nor
+// the email of a user proves they are who was invited.
+type Invitation struct {
+	ID         int            `db:"id" json:"-"`
+	UUID       string         `db:"uuid" json:"uuid"`
+	AccountID  int            `db:"account_id" json:"account_id"`
+	InviterID  int            `db:"inviter_id" json:"inviter_id"`
+	Username   string         `db:"username" json:"username,omitempty"`
+	Email      string         `db:"email" json:"email,omitempty"`
+	Role       string         `db:"role" json:"role"`
+	TokenHash  string         `db:"token_hash" json:"-"`
+	AcceptedAt sql.NullString `db:"accepted_at" json:"-"`
+	UpdatedAt  string         `db:"updated_at" json:"updated_at"`
+	CreatedAt  string         `db:"created_at" json:"created_at"`
+}
+
+const membershipColumns = "memberships.id, memberships.account_id, memberships.user_id, users.username, memberships.role, accounts.require_2fa, memberships.updated_at, memberships.created_at"
+
+const membershipJoins = "FROM memberships JOIN users ON users.id = memberships.user_id JOIN accounts ON accounts.id = memberships.account_id"
+
+func (d *DB) CreateMembership(accountID int, userID int, role string) (Membership, error) {
+	var (
+		err   error
+		query = "INSERT INTO memberships (account_id, user_id, role) VALUES ($1, $2, $3)"
+	)
+
+	if _, err = d.connection.Exec(query, accountID, userID, role); err != nil {
+		return Membership{}, utils.Error(err, "db: membership not created")
+	}
+
+	return d.FindMembership(accountID, userID)
+}
+
+// FindMembership returns a user's membership of an account
+func (d *DB) FindMembership(accountID int, userID int) (Membership, error) {
+	var (
+		membership Membership
+		err        error
+		query      = "SELECT " + membershipColumns + " " + membershipJoins + " WHERE memberships.account_id=$1 AND memberships.user_id=$2"
+	)
+
+	if err = d.connection.Get(&membership, query, accountID, userID); err != nil {
+		return Membership{}, utils.Error(err, "db: membership not found")
+	}
+
+	return membership, nil
+}
+
+// FindMemberships returns the members of an account
+func (d *DB) FindMemberships(accountID int) ([]Membership, error) {
+	var (
+		memberships = []Membership{}
+		err         error
+		query       = "SELECT " + membershipColumns + " " + membershipJoins + " WHERE memberships.account_id=$1 ORDER BY memberships.id"
+	)
+
+	if err = d.connection.Select(&memberships, query, accountID); err != nil {
+		return nil, utils.Error(err, "db: memberships not found")
+	}
+
+	return memberships, nil
+}
+
+// FindUserMemberships returns the accounts a user belongs to
+func (d *DB) FindUserMemberships(userID int) ([]Membership, error) {
+	var (
+		memberships = []Membership{}
+		err         error
+		query       = "SELECT " + membershipColumns + " " + membershipJoins + " WHERE memberships.user_id=$1 ORDER BY memberships.id"
+	)
+
+	if err = d.connection.Select(&memberships, query, userID); err != nil {
+		return nil, utils.Error(err, "db: memberships not found")
+	}
+
+	return memberships, nil
+}
+
+// UpdateMembershipRole changes a member's role, keeping at least one owner
+func (d *DB) UpdateMembershipRole(membership *Membership, role string) error {
+	var err error
+
+	if membership.Role == RoleOwner && role != RoleOwner {
+		if err = d.checkOtherOwners(membership); err != nil {
+			return err
+		}
+	}
+
+	if _, err = d.connection.Exec("UPDATE memberships SET role=$1 WHERE id=$2", role, membership.ID); err != nil {
+		return utils.Error(err, "db: membership not updated")
+	}
+
+	membership.Role = role
+
+	return nil
+}
+
+// DeleteMembership removes a member from an account, keeping at least one
+// owner. A user removed from their default account falls back to another
+// account they belong to.
+func (d *DB) DeleteMembership(membership *Membership) error {
+	var (
+		err   error
+		query = `UPDATE users SET account_id=(
+			SELECT account_id FROM memberships WHERE user_id=$1 ORDER BY id LIMIT 1
+		) WHERE id=$1 AND account_id=$2`
+	)
+
+	if membership.Role == RoleOwner {
+		if err = d.checkOtherOwners(membership); err != nil {
+			return err
+		}
+	}
+
+	if _, err = d.connection.Exec("DELETE FROM memberships WHERE id=$1", membership.ID); err != nil {
+		return utils.Error(err, "db: membership not deleted")
+	}
+
+	if _, err = d.connection.Exec(query, membership.UserID, membership.AccountID); err != nil {
+		return utils.Error(err, "db: user not updated")
+	}
+
+	return nil
+}
+
+func (d *DB) checkOtherOwners(membership *Membership) error {
+	var (
+		owners int
+		err    error
+		query  = "SELECT count(*) FROM memberships WHERE account_id=$1 AND role=$2 AND id<>$3"
+	)
+
+	if err = d.connection.Get(&owners, query, membership.AccountID, RoleOwner, membership.ID); err != nil {
+		return utils.Error(err, "db: owners not counted")
+	}
+
+	if owners == 0 {
+		return ErrLastOwner
+	}
+
+	return nil
+}
+
+// CreateInvitation invites a username or an email address to an account. It
+// returns the token that accepts the invitation, which only the invitee
+// should be sent.
+func (d *DB) CreateInvitation(inviter *User, accountID int, username string, email string, role string) (Invitation, string, error) {
+	var (
+		invitation Invitation
+		err        error
+		uid        = uuid.NewV4().String()
+		token      = newRefreshToken()
+		query      = "INSERT INTO invitations (uuid, account_id, inviter_id, username, email, role, token_hash) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	)
+
+	if _, err = d.connection.Exec(query, uid, accountID, inviter.ID, username, email, role, hashToken(token)); err != nil {
+		return Invitation{}, "", utils.Error(err, "db: invitation not created")
+	}
+
+	if err = d.connection.Get(&invitation, "SELECT * FROM invitations WHERE uuid=$1", uid); err != nil {
+		return Invitation{}, "", utils.Error(err, "db: invitation not found")
+	}
+
+	return invitation, token, nil
+}
+
+// FindAccountInvitations returns the pending invitations sent by an account
+func (d *DB) FindAccountInvitations(accountID int) ([]Invitation, error) {
+	var (
+		invitations = []Invitation{}
+		err         error
+		query       = "SELECT * FROM invitations WHERE account_id=$1 AND accepted_at IS NULL ORDER BY id"
+	)
+
+	if err = d.connection.Select(&invitations, query, accountID); err != nil {
+		return nil, utils.Error(err, "db: invitations not found")
+	}
+
+	return invitations, nil
+}
+
+// AcceptInvitation makes the user holding an invitation's token a member of
+// the inviting account, or changes their role if they already are one. It
+// returns the membership and the invitation accepted.
+func (d *DB) AcceptInvitation(user *User, token string) (Membership, Invitation, error) {
+	var (
+		err        error
+		invitation Invitation
+		membership Membership
+		result     sql.Result
+		claimed    int64
+		query      = `INSERT INTO memberships (account_id, user_id, role) VALUES ($1, $2, $3)
+			ON CONFLICT (account_id, user_id) DO UPDATE SET role=EXCLUDED.role`
+	)
+
+	if token == "" {
+		return Membership{}, Invitation{}, utils.Error(sql.ErrNoRows, "db: invitation not found")
+	}
+
+	err = d.connection.Get(&invitation, "SELECT * FROM invitations WHERE token_hash=$1 AND accepted_at IS NULL", hashToken(token))
+	if err != nil {
+		return Membership{}, Invitation{}, utils.Error(err, "db: invitation not found")
+	}
+
+	membership, err = d.FindMembership(invitation.AccountID, user.ID)
+	if err == nil && membership.Role == RoleOwner && invitation.Role != RoleOwner {
+		if err = d.checkOtherOwners(&membership); err != nil {
+			return Membership{}, Invitation{}, err
+		}
+	}
+
+	// the token is used up before the membership is granted, so that it
+	// can only be accepted once
+	result, err = d.connection.Exec("UPDATE invitations SET accepted_at=now() WHERE id=$1 AND accepted_at IS NULL", invitation.ID)
+	if err != nil {
+		return Membership{}, Invitation{}, utils.Error(err, "db: invitation not updated")
+	}
+
+	if claimed, err = result.RowsAffected(); err == nil && claimed == 0 {
+		return Membership{}, Invitation{}, utils.Error(sql.ErrNoRows, "db: invitation not found")
+	}
+
+	if _, err = d.connection.Exec(query, invitation.AccountID, user.ID, invitation.Role); err != nil {
+		return Membership{}, Invitation{}, utils.Error(err, "db: membership not created")
+	}
+
+	if membership, err = d.FindMembership(invitation.AccountID, user.ID); err != nil {
+		return Membership{}, Invitation{}, err
+	}
+
+	return membership, invitation, nil
+}
+
+// DeleteInvitation removes a pending invitation of an account
+func (d *DB) DeleteInvitation(accountID int, id string) error {
+	var (
+		err    error
+		result sql.Result
+		n      int64
+	)
+
+	if result, err = d.connection.Exec("DELETE FROM invitations WHERE uuid=$1 AND account_id=$2 AND accepted_at IS NULL", id, accountID); err != nil {
+		return utils.Error(err, "db: invitation not deleted")
+	}
+
+	if n, err = result.RowsAffected(); err == nil && n == 0 {
+		return utils.Error(sql.ErrNoRows, "db: invitation not found")
+	}
+
+	return err
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"dre/migrations"
+	"dre/utils"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+
+	migrate "github.com/rubenv/sql-migrate"
+)
+
+// migrationSet uses the table that sql-migrate is configured with in
+// dbconfig.yml, so either can migrate the same database
+var migrationSet = migrate.MigrationSet{TableName: "migrations"}
+
+// migrationSource returns the migrations written for the database's dialect
+func (d *DB) migrationSource() migrate.MigrationSource {
+	if d.connection.dialect.name() == DialectSQLite {
+		files, _ := fs.Sub(migrations.SQLiteFiles, "sqlite")
+		return migrate.HttpFileSystemMigrationSource{FileSystem: http.FS(files)}
+	}
+
+	return migrate.HttpFileSystemMigrationSource{FileSystem: http.FS(migrations.Files)}
+}
+
+// Migration is an embedded migration and when it was applied, if it was
+type Migration struct {
+	ID        string
+	AppliedAt *time.Time
+}
+
+// Migrate applies up to max pending migrations, or rolls back up to max
+// applied ones when up is false. max of 0 means all of them.
+func (d *DB) Migrate(up bool, max int) (int, error) {
+	var (
+		err       error
+		n         int
+		direction = migrate.Up
+	)
+
+	if !up {
+		direction = migrate.Down
+	}
+
+	if n, err = migrationSet.ExecMax(d.connection.DB.DB, d.connection.dialect.name(), d.migrationSource(), direction, max); err != nil {
+		return n, utils.Error(err, "db: migrations not applied")
+	}
+
+	return n, nil
+}
+
+// Migrations returns every embedded migration in order, followed by any
+// applied migration that isn't embedded
+func (d *DB) Migrations() ([]Migration, error) {
+	var (
+		err        error
+		embedded   []*migrate.Migration
+		records    []*migrate.MigrationRecord
+		result     []Migration
+		applied    = make(map[string]time.Time)
+		isEmbedded = make(map[string]bool)
+	)
+
+	if embedded, err = d.migrationSource().FindMigrations(); err != nil {
+		return nil, utils.Error(err, "db: migrations not read")
+	}
+
+	if records, err = migrationSet.GetMigrationRecords(d.connection.DB.DB, d.connection.dialect.name()); err != nil {
+		return nil, utils.Error(err, "db: migration records not read")
+	}
+
+	for _, record := range records {
+		applied[record.Id] = record.AppliedAt
+	}
+
+	for _, m := range embedded {
+		isEmbedded[m.Id] = true
+		migration := Migration{ID: m.Id}
+
+		if at, ok := applied[m.Id]; ok {
+			migration.AppliedAt = &at
+		}
+
+		result = append(result, migration)
+	}
+
+	for _, record := range records {
+		if !isEmbedded[record.Id] {
+			at := record.AppliedAt
+			result = append(result, Migration{ID: record.Id, AppliedAt: &at})
+		}
+	}
+
+	return result, nil
+}
+
+// CheckSchema returns an error naming the pending migrations if the
+// database is behind the binary
+func (d *DB) CheckSchema() error {
+	var (
+		err        error
+		migrations []Migration
+		pending    []string
+	)
+
+	if migrations, err = d.Migrations(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.AppliedAt == nil {
+			pending = append(pending, m.ID)
+		}
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("db: schema is %d migrations behind (%s), run `dre migrate up`",
+			len(pending), strings.Join(pending, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"database/sql"
+	"dre/utils"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordResetTTL is how long a password reset token can be used for
+var PasswordResetTTL = time.Hour
+
+// ErrUnknownReset is returned for password reset tokens that don't exist,
+// have expired or were already used
+var ErrUnknownReset = errors.New("db: unknown or expired password reset")
+
+// bcrypt ignores everything past 72 bytes
+const maxPasswordLength = 72
+
+// PasswordPolicy is the strength required of new passwords
+type PasswordPolicy struct {
+	MinLength int
+	// MinClasses is how many of lowercase letters, uppercase letters,
+	// digits and symbols a password must use
+	MinClasses int
+}
+
+// PolicyError describes why a password doesn't meet the policy
+type PolicyError string
+
+func (e PolicyError) Error() string {
+	return string(e)
+}
+
+// Policy is checked by CheckPassword
+var Policy = PasswordPolicy{MinLength: 10, MinClasses: 2}
+
+// CheckPassword returns a PolicyError describing why password is too weak for
+// the user, or nil if it is strong enough
+func CheckPassword(username string, password string) error {
+	var (
+		classes = make(map[string]bool)
+		count   int
+	)
+
+	if utf8.RuneCountInString(password) < Policy.MinLength {
+		return PolicyError(fmt.Sprintf("password must be at least %d characters", Policy.MinLength))
+	}
+
+	if len(password) > maxPasswordLength {
+		return PolicyError(fmt.Sprintf("password must be at most %d bytes", maxPasswordLength))
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return PolicyError("password must not contain the username")
+	}
+
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			classes["lower"] = true
+		case unicode.IsUpper(r):
+			classes["upper"] = true
+		case unicode.IsDigit(r):
+			classes["digit"] = true
+		default:
+			classes["symbol"] = true
+		}
+	}
+	count = len(classes)
+
+	if count < Policy.MinClasses {
+		return PolicyError(fmt.Sprintf("password must mix at least %d of lowercase, uppercase, digits and symbols", Policy.MinClasses))
+	}
+
+	return nil
+}
+
+// UpdatePassword sets a user's password and signs them out everywhere
+func (d *DB) UpdatePassword(user *User, password string) error {
+	var (
+		err    error
+		hashed []byte
+	)
+
+	if hashed, err = bcrypt.GenerateFromPassword([]byte(password), 8); err != nil {
+		return utils.Error(err, "db: password not hashed")
+	}
+
+	if _, err = d.connection.Exec("UPDATE users SET password=$1 WHERE id=$2", string(hashed), user.ID); err != nil {
+		return utils.Error(err, "db: password not updated")
+	}
+
+	user.Password = string(hashed)
+
+	return d.RevokeUserTokens(user)
+}
+
+// CreatePasswordReset returns a one-time token that resets a user's password
+func (d *DB) CreatePasswordReset(user *User) (string, error) {
+	var (
+		err   error
+		token = newRefreshToken()
+		query = "INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, " + d.connection.dialect.secondsFromNow("$3") + ")"
+	)
+
+	if _, err = d.connection.Exec(query, user.ID, hashToken(token), PasswordResetTTL.Seconds()); err != nil {
+		return "", utils.Error(err, "db: password reset not created")
+	}
+
+	return token, nil
+}
+
+// ResetPassword uses a password reset token to set a user's password. The
+// token is only used up if password meets the policy.
+func (d *DB) ResetPassword(token string, password string) (User, error) {
+	var (
+		err    error
+		user   User
+		userID int
+		result sql.Result
+		used   int64
+		hash   = hashToken(token)
+		query  = "SELECT user_id FROM password_resets WHERE token_hash=$1 AND used_at IS NULL AND expires_at > now()"
+	)
+
+	if err = d.connection.Get(&userID, query, hash); err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, ErrUnknownReset
+		}
+
+		return User{}, utils.Error(err, "db: password reset not found")
+	}
+
+	if user, err = d.FindUserByID(userID); err != nil {
+		return User{}, err
+	}
+
+	if err = CheckPassword(user.Username, password); err != nil {
+		return User{}, err
+	}
+
+	if result, err = d.connection.Exec("UPDATE password_resets SET used_at=now() WHERE token_hash=$1 AND used_at IS NULL", hash); err != nil {
+		return User{}, utils.Error(err, "db: password reset not used")
+	}
+
+	if used, err = result.RowsAffected(); err != nil || used == 0 {
+		return User{}, ErrUnknownReset
+	}
+
+	if err = d.UpdatePassword(&user, password); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"database/sql"
+	"dre/utils"
+)
+
+// Session states
+const (
+	// SessionRunning sessions have a server attached to their container
+	SessionRunning = "running"
+	// SessionDetached sessions were left running by a server that shut
+	// down, for the next one to attach to
+	SessionDetached = "detached"
+	SessionEnded    = "ended"
+)
+
+// Session is a terminal on a running container. Sessions are kept in the
+// database so that a restarted server can attach to their containers again.
+type Session struct {
+	ID            int            `db:"id" json:"id"`
+	ContainerID   int            `db:"container_id" json:"container_id"`
+	ContainerUUID string         `db:"container_uuid" json:"container_uuid"`
+	DockerName    string         `db:"docker_name" json:"docker_name"`
+	State         string         `db:"state" json:"state"`
+	UserID        sql.NullInt64  `db:"user_id" json:"-"`
+	AccountID     sql.NullInt64  `db:"account_id" json:"-"`
+	EndedAt       sql.NullString `db:"ended_at" json:"-"`
+	UpdatedAt     string         `db:"updated_at" json:"updated_at"`
+	CreatedAt     string         `db:"created_at" json:"created_at"`
+}
+
+const sessionColumns = "sessions.*, containers.uuid AS container_uuid"
+
+// CreateSession records a session started by user on a container that runs
+// as dockerName
+func (d *DB) CreateSession(c *Container, user User, dockerName string) (Session, error) {
+	var (
+		err     error
+		id      int
+		session Session
+		query   = `INSERT INTO sessions (container_id, docker_name, state, user_id, account_id)
+			VALUES ($1, $2, $3, $4, (SELECT account_id FROM images WHERE id=$5)) RETURNING id`
+	)
+
+	if err = d.connection.QueryRow(query, c.ID, dockerName, SessionRunning, user.ID, c.ImageID).Scan(&id); err != nil {
+		return Session{}, utils.Error(err, "db: session not created")
+	}
+
+	query = "SELECT " + sessionColumns + " FROM sessions JOIN containers ON containers.id = sessions.container_id WHERE sessions.id=$1"
+	if err = d.connection.Get(&session, query, id); err != nil {
+		return Session{}, utils.Error(err, "db: session not found")
+	}
+
+	return session, nil
+}
+
+// FindOpenSessions returns the sessions that haven't ended, oldest first
+func (d *DB) FindOpenSessions() ([]Session, error) {
+	var (
+		err      error
+		sessions = []Session{}
+		query    = "SELECT " + sessionColumns + ` FROM sessions JOIN containers ON containers.id = sessions.container_id
+			WHERE sessions.state <> $1 ORDER BY sessions.id`
+	)
+
+	if err = d.connection.Select(&sessions, query, SessionEnded); err != nil {
+		return nil, utils.Error(err, "db: sessions not found")
+	}
+
+	return sessions, nil
+}
+
+// SetSessionState moves a session to state, recording when it ended
+func (d *DB) SetSessionState(s *Session, state string) error {
+	var (
+		err   error
+		query = "UPDATE sessions SET state=$1 WHERE id=$2"
+	)
+
+	if state == SessionEnded {
+		query = "UPDATE sessions SET state=$1, ended_at=now() WHERE id=$2"
+	}
+
+	if _, err = d.connection.Exec(query, state, s.ID); err != nil {
+		return utils.Error(err, "db: session not updated")
+	}
+
+	s.State = state
+
+	return nil
+}
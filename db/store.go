@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Users stores users, their credentials and second factors
+type Users interface {
+	FindUser(username string) (User, error)
+	FindUserByID(id int) (User, error)
+	CreateUser(username string, password string, email string) (User, error)
+	SignInUser(username string, password string) (User, error)
+	FindIdentityUser(provider string, subject string) (User, error)
+	CreateIdentityUser(provider string, subject string, username string, email string, accountID int) (User, error)
+	UpdatePassword(user *User, password string) error
+	CreatePasswordReset(user *User) (string, error)
+	ResetPassword(token string, password string) (User, error)
+	EnrollTOTP(user *User) (string, error)
+	ConfirmTOTP(user *User, code string) ([]string, error)
+	DisableTOTP(user *User) error
+	CreateRecoveryCodes(user *User) ([]string, error)
+	VerifySecondFactor(user *User, code string) error
+	FindUsers() ([]User, error)
+	SetUserDisabled(user *User, disabled bool) error
+}
+
+// Keys stores the refresh tokens and API keys users authenticate with
+type Keys interface {
+	CreateTokens(user *User) (Tokens, error)
+	RefreshTokens(token string) (Tokens, error)
+	RevokeRefreshToken(user *User, token string) error
+	RevokeUserTokens(user *User) error
+	AuthenticateToken(tokenString string) (User, error)
+	CreateAPIKey(user *User, name string, scopes []string, expiresIn int) (APIKey, error)
+	FindAPIKeys(accountID int) ([]APIKey, error)
+	RevokeAPIKey(accountID int, id string) error
+	AuthenticateAPIKey(token string) (APIKey, User, error)
+}
+
+// Accounts stores accounts, their members and their audit log
+type Accounts interface {
+	FindAccounts() ([]Account, error)
+	FindAccount(id int) (Account, error)
+	SetRequire2FA(accountID int, require bool) error
+	CreateMembership(accountID int, userID int, role string) (Membership, error)
+	FindMembership(accountID int, userID int) (Membership, error)
+	FindMemberships(accountID int) ([]Membership, error)
+	FindUserMemberships(userID int) ([]Membership, error)
+	UpdateMembershipRole(membership *Membership, role string) error
+	DeleteMembership(membership *Membership) error
+	CreateInvitation(inviter *User, accountID int, username string, email string, role string) (Invitation, string, error)
+	FindAccountInvitations(accountID int) ([]Invitation, error)
+	AcceptInvitation(user *User, token string) (Membership, Invitation, error)
+	DeleteInvitation(accountID int, id string) error
+	CreateAuditEvent(event *AuditEvent, details map[string]interface{}) error
+	FindAuditEvents(accountID int, filter AuditFilter) ([]AuditEvent, error)
+	FindQuota(accountID int) (Quota, error)
+	SetQuota(accountID int, quota Quota) error
+}
+
+// Images stores images and the builds that produce them
+type Images interface {
+	CreateImage(user User, sourceURL string) (Image, error)
+	FindImage(id int) (Image, error)
+	FindImageByUUID(id string) (Image, error)
+	FindAccountImage(accountID int, id string) (Image, error)
+	CreateSnapshotImage(user User, container *Container) (Image, error)
+	DeleteImage(image *Image) error
+	FindImageTags() ([]string, error)
+	Builds
+}
+
+// Builds stores image builds
+type Builds interface {
+	CreateBuild(sourceURL string) (Build, error)
+	FindBuild(id string) (Build, error)
+	FindAccountBuild(accountID int, id string) (Build, error)
+	FindImageBuild(image *Image) (Build, error)
+	SetImageBuild(image *Image, build *Build) error
+	StartBuild(build *Build) error
+	FinishBuild(build *Build, logs string, buildErr error) error
+	FailInterruptedBuilds() error
+}
+
+// Containers stores containers. Runs are recorded through the Container
+// methods.
+type Containers interface {
+	FindContainer(id string) (Container, error)
+	FindContainers() ([]ContainerSummary, error)
+	FindAccountContainer(accountID int, id string) (Container, error)
+	FindAccountContainers(accountID int) ([]Container, error)
+	CreateContainer(image *Image) (Container, error)
+	SetContainerVolume(c *Container, volume string, quotaMB int) error
+	DeleteContainer(c *Container) error
+}
+
+// Sessions stores the terminal sessions on running containers
+type Sessions interface {
+	CreateSession(c *Container, user User, dockerName string) (Session, error)
+	FindOpenSessions() ([]Session, error)
+	SetSessionState(s *Session, state string) error
+}
+
+// Runs reports on and cleans up container runs
+type Runs interface {
+	FindUsage(accountID int, period string, since time.Time, until time.Time) ([]Usage, error)
+	MonthlyMinutes(accountID int) (float64, error)
+	ActiveSessions(accountID int) (int, error)
+	CheckQuota(accountID int) error
+	EndInterruptedRuns(running []string) error
+}
+
+// Store is everything the server keeps in a database. DB implements it for
+// both postgres and sqlite.
+type Store interface {
+	Users
+	Keys
+	Accounts
+	Images
+	Containers
+	Sessions
+	Runs
+	Migrate(up bool, max int) (int, error)
+	Migrations() ([]Migration, error)
+	CheckSchema() error
+	Ping() error
+	WithContext(ctx context.Context) Store
+}
+
+var _ Store = (*DB)(nil)
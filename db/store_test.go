@@ -0,0 +1,404 @@
+package db
+
+import (
+	"dre/migrations"
+	"io/fs"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDB returns a migrated in-memory sqlite database
+func newTestDB(t *testing.T) *DB {
+	d, err := Connect(DialectSQLite, ":memory:", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = d.Migrate(true, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	return &d
+}
+
+// newTestContainer creates a user and a container of an image of theirs
+func newTestContainer(t *testing.T, d *DB, username string) (User, Image, Container) {
+	user, err := d.CreateUser(username, "correct-horse-9", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := d.CreateImage(user, "http://example.com/source.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := d.CreateContainer(&image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, image, container
+}
+
+// sqliteTime formats t like sqlite's CURRENT_TIMESTAMP, which now() becomes
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func TestSecondsFromNow(t *testing.T) {
+	d := newTestDB(t)
+
+	for _, seconds := range []interface{}{3600, 3600.0, -60} {
+		var at string
+
+		err := d.connection.Get(&at, "SELECT "+d.connection.dialect.secondsFromNow("$1"), seconds)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := time.Parse("2006-01-02 15:04:05", at)
+		if err != nil {
+			t.Fatalf("%v seconds from now is %q: %s", seconds, at, err)
+		}
+
+		want := time.Now().Add(time.Duration(toFloat(seconds)) * time.Second)
+		if diff := parsed.Sub(want); math.Abs(diff.Seconds()) > 5 {
+			t.Errorf("%v seconds from now is %s, want about %s", seconds, parsed, want.UTC())
+		}
+	}
+}
+
+func toFloat(v interface{}) float64 {
+	if i, ok := v.(int); ok {
+		return float64(i)
+	}
+
+	return v.(float64)
+}
+
+func TestExpiry(t *testing.T) {
+	d := newTestDB(t)
+	user, _, _ := newTestContainer(t, d, "alice")
+
+	// keys expiring in an hour work, which their float expiry must allow
+	key, err := d.CreateAPIKey(&user, "ci", []string{ScopeRead}, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = d.AuthenticateAPIKey(key.Key); err != nil {
+		t.Errorf("unexpired key rejected: %s", err)
+	}
+
+	defer func(ttl time.Duration) { PasswordResetTTL = ttl }(PasswordResetTTL)
+
+	PasswordResetTTL = -time.Minute
+	token, err := d.CreatePasswordReset(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = d.ResetPassword(token, "another-horse-9"); err != ErrUnknownReset {
+		t.Errorf("expired reset gave %v", err)
+	}
+
+	PasswordResetTTL = time.Hour
+	if token, err = d.CreatePasswordReset(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = d.ResetPassword(token, "another-horse-9"); err != nil {
+		t.Errorf("unexpired reset rejected: %s", err)
+	}
+}
+
+func TestReturning(t *testing.T) {
+	d := newTestDB(t)
+	user, image, container := newTestContainer(t, d, "alice")
+	other, _, _ := newTestContainer(t, d, "bob")
+
+	if user.ID == 0 || other.ID == user.ID || user.AccountID == 0 || other.AccountID == user.AccountID {
+		t.Errorf("users got ids %d and %d in accounts %d and %d", user.ID, other.ID, user.AccountID, other.AccountID)
+	}
+
+	account, err := d.CreateAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if account.ID <= other.AccountID {
+		t.Errorf("new account got id %d after %d", account.ID, other.AccountID)
+	}
+
+	if err = container.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if container.run.ID == 0 || container.run.ContainerID != container.ID || int(container.run.AccountID.Int64) != user.AccountID {
+		t.Errorf("run is %+v", container.run)
+	}
+
+	session, err := d.CreateSession(&container, user, container.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.ID == 0 || session.AccountID.Int64 != int64(image.AccountID) {
+		t.Errorf("session is %+v", session)
+	}
+
+	event := AuditEvent{AccountID: &user.AccountID, Action: AuditSignIn, Target: user.Username}
+	if err = d.CreateAuditEvent(&event, map[string]interface{}{"method": "password"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.ID == 0 || time.Since(event.CreatedAt) > time.Minute {
+		t.Errorf("event got id %d created at %s", event.ID, event.CreatedAt)
+	}
+}
+
+func TestCreateIdentityUserIsAtomic(t *testing.T) {
+	d := newTestDB(t)
+	count := func() (users int, accounts int) {
+		d.connection.Get(&users, "SELECT count(*) FROM users")
+		d.connection.Get(&accounts, "SELECT count(*) FROM accounts")
+		return users, accounts
+	}
+
+	owner, err := d.CreateUser("owner", "correct-horse-9", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := d.CreateIdentityUser("mock", "248289761001", "jane", "jane@corp.io", owner.AccountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.AccountID != owner.AccountID {
+		t.Errorf("user acts on account %d, want the domain's %d", user.AccountID, owner.AccountID)
+	}
+
+	if _, err = d.FindMembership(owner.AccountID, user.ID); err != nil {
+		t.Errorf("user didn't join the domain's account: %s", err)
+	}
+
+	wantUsers, wantAccounts := count()
+
+	// a second first sign in of the same identity creates nothing
+	if _, err = d.CreateIdentityUser("mock", "248289761001", "jane", "jane@corp.io", owner.AccountID); err != ErrIdentityTaken {
+		t.Fatalf("got %v, want ErrIdentityTaken", err)
+	}
+
+	if users, accounts := count(); users != wantUsers || accounts != wantAccounts {
+		t.Errorf("%d users and %d accounts left, want %d and %d", users, accounts, wantUsers, wantAccounts)
+	}
+}
+
+func TestUsagePeriods(t *testing.T) {
+	d := newTestDB(t)
+	user, image, container := newTestContainer(t, d, "alice")
+	_, _, other := newTestContainer(t, d, "bob")
+
+	day := time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC)
+	runs := []struct {
+		container Container
+		start     time.Time
+		minutes   int
+	}{
+		{container, day.Add(-30 * time.Minute), 60},
+		{container, day.Add(23 * time.Hour), 10},
+		{container, day.Add(24 * time.Hour), 5},
+		{other, day, 100},
+	}
+
+	for _, r := range runs {
+		if err := r.container.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := d.connection.Exec("UPDATE runs SET started_at=$1, ended_at=$2, cpu_seconds=$3 WHERE id=$4",
+			sqliteTime(r.start), sqliteTime(r.start.Add(time.Duration(r.minutes)*time.Minute)), 1.5, r.container.run.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build, err := d.CreateBuild(image.SourceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = d.SetImageBuild(&image, &build); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.connection.Exec("UPDATE builds SET started_at=$1, finished_at=$2 WHERE id=$3",
+		sqliteTime(day.Add(time.Hour)), sqliteTime(day.Add(time.Hour+90*time.Second)), build.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		period string
+		want   []Usage
+	}{
+		{PeriodDay, []Usage{
+			{Period: "2018-12-30", ContainerSeconds: 3600, CPUSeconds: 1.5},
+			{Period: "2018-12-31", ContainerSeconds: 600, CPUSeconds: 1.5, BuildSeconds: 90},
+			{Period: "2019-01-01", ContainerSeconds: 300, CPUSeconds: 1.5},
+		}},
+		{PeriodMonth, []Usage{
+			{Period: "2018-12", ContainerSeconds: 4200, CPUSeconds: 3, BuildSeconds: 90},
+			{Period: "2019-01", ContainerSeconds: 300, CPUSeconds: 1.5},
+		}},
+	}
+
+	for _, test := range tests {
+		usages, err := d.FindUsage(user.AccountID, test.period, day.AddDate(0, 0, -7), day.AddDate(0, 0, 7))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(usages) != len(test.want) {
+			t.Fatalf("%s usage is %+v, want %+v", test.period, usages, test.want)
+		}
+
+		for i, u := range usages {
+			u.ContainerSeconds = math.Round(u.ContainerSeconds)
+			u.BuildSeconds = math.Round(u.BuildSeconds)
+
+			if u != test.want[i] {
+				t.Errorf("%s usage is %+v, want %+v", test.period, u, test.want[i])
+			}
+		}
+	}
+
+	// since and until bound the runs by when they started
+	usages, err := d.FindUsage(user.AccountID, PeriodDay, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(usages) != 1 || usages[0].Period != "2018-12-31" {
+		t.Errorf("usage of one day is %+v", usages)
+	}
+}
+
+func TestMonthlyMinutes(t *testing.T) {
+	d := newTestDB(t)
+	user, _, container := newTestContainer(t, d, "alice")
+
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	for _, start := range []time.Time{monthStart.Add(-time.Hour), monthStart.Add(time.Minute)} {
+		if err := container.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := d.connection.Exec("UPDATE runs SET started_at=$1, ended_at=$2 WHERE id=$3",
+			sqliteTime(start), sqliteTime(start.Add(10*time.Minute)), container.run.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a run still going counts until now
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := d.connection.Exec("UPDATE runs SET started_at=$1 WHERE id=$2", sqliteTime(now.Add(-5*time.Minute)), container.run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	minutes, err := d.MonthlyMinutes(user.AccountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first run started last month, unless the month started less than
+	// five minutes ago and the last run did too
+	if math.Abs(minutes-15) > 0.1 && now.Sub(monthStart) > 5*time.Minute {
+		t.Errorf("monthly minutes are %.2f, want 15", minutes)
+	}
+
+	if sessions, _ := d.ActiveSessions(user.AccountID); sessions != 1 {
+		t.Errorf("%d active sessions, want 1", sessions)
+	}
+}
+
+var schemaObject = regexp.MustCompile(`(?i)(CREATE TABLE|ADD COLUMN|DROP COLUMN|CREATE (?:UNIQUE )?INDEX|DROP INDEX|CREATE TRIGGER|DROP TRIGGER|DROP TABLE)\s+(\w+)`)
+
+var columnDefinition = regexp.MustCompile(`(?m)^\s+(\w+)\s+\w+`)
+
+var notColumns = map[string]bool{"PRIMARY": true, "UNIQUE": true, "FOREIGN": true, "CONSTRAINT": true, "CHECK": true}
+
+// schemaObjects lists the tables, columns, indexes and triggers a migration
+// creates or drops, in order
+func schemaObjects(migration string) []string {
+	var objects []string
+
+	for _, statement := range strings.Split(migration, ";") {
+		for _, match := range schemaObject.FindAllStringSubmatch(statement, -1) {
+			objects = append(objects, strings.ToUpper(match[1])+" "+match[2])
+		}
+
+		if i := strings.Index(strings.ToUpper(statement), "CREATE TABLE"); i >= 0 && strings.Contains(statement, "(") {
+			body := statement[strings.Index(statement, "(")+1:]
+			for _, match := range columnDefinition.FindAllStringSubmatch(body, -1) {
+				if !notColumns[strings.ToUpper(match[1])] {
+					objects = append(objects, "COLUMN "+match[1])
+				}
+			}
+		}
+	}
+
+	return objects
+}
+
+func TestSQLiteMigrationsMatch(t *testing.T) {
+	postgres, err := fs.Glob(migrations.Files, "*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlite, err := fs.Glob(migrations.SQLiteFiles, "sqlite/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range sqlite {
+		sqlite[i] = strings.TrimPrefix(sqlite[i], "sqlite/")
+	}
+
+	sort.Strings(postgres)
+	sort.Strings(sqlite)
+
+	if strings.Join(postgres, "\n") != strings.Join(sqlite, "\n") {
+		t.Fatalf("migrations differ:\npostgres:\n%s\nsqlite:\n%s", strings.Join(postgres, "\n"), strings.Join(sqlite, "\n"))
+	}
+
+	for _, name := range postgres {
+		p, _ := fs.ReadFile(migrations.Files, name)
+		s, _ := fs.ReadFile(migrations.SQLiteFiles, "sqlite/"+name)
+
+		want, got := schemaObjects(string(p)), schemaObjects(string(s))
+		if strings.Join(want, ", ") != strings.Join(got, ", ") {
+			t.Errorf("%s: sqlite changes\n%s\nbut postgres changes\n%s", name, strings.Join(got, ", "), strings.Join(want, ", "))
+		}
+	}
+
+	// and every migration applies and rolls back on sqlite
+	d := newTestDB(t)
+	if n, err := d.Migrate(false, 0); err != nil || n != len(sqlite) {
+		t.Errorf("rolled back %d of %d migrations: %v", n, len(sqlite), err)
+	}
+}
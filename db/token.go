@@ -0,0 +1,287 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"dre/utils"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Lifetimes of issued tokens
+var (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// ErrTokenRevoked is returned for tokens of a revoked sign in
+var ErrTokenRevoked = errors.New("db: token revoked")
+
+// SigningKeys sign access tokens with the active key and verify them with
+// any key, so keys can be rotated without signing everyone out
+type SigningKeys struct {
+	Active string
+	Keys   map[string][]byte
+}
+
+var signingKeys SigningKeys
+
+// ParseSigningKeys parses keys written as "kid:secret,kid:secret". The
+// first key is the active one.
+func ParseSigningKeys(spec string) (SigningKeys, error) {
+	keys := SigningKeys{Keys: make(map[string][]byte)}
+
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return SigningKeys{}, fmt.Errorf("db: signing key %q is not kid:secret", pair)
+		}
+
+		if keys.Active == "" {
+			keys.Active = parts[0]
+		}
+
+		keys.Keys[parts[0]] = []byte(parts[1])
+	}
+
+	return keys, nil
+}
+
+// RandomSigningKeys returns a single random key. Tokens signed with it
+// don't survive a restart.
+func RandomSigningKeys() SigningKeys {
+	return SigningKeys{Active: "random", Keys: map[string][]byte{"random": randomBytes(32)}}
+}
+
+// SetSigningKeys sets the keys used for access tokens
+func SetSigningKeys(keys SigningKeys) {
+	signingKeys = keys
+}
+
+// Tokens are issued on sign in. The access token authenticates requests
+// until it expires and the refresh token is exchanged for new Tokens.
+type Tokens struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type refreshToken struct {
+	ID           int            `db:"id"`
+	UUID         string         `db:"uuid"`
+	UserID       int            `db:"user_id"`
+	TokenHash    string         `db:"token_hash"`
+	PreviousHash string         `db:"previous_hash"`
+	ExpiresAt    string         `db:"expires_at"`
+	RevokedAt    sql.NullString `db:"revoked_at"`
+	UpdatedAt    string         `db:"updated_at"`
+	CreatedAt    string         `db:"created_at"`
+}
+
+// CreateTokens signs a user in and returns their tokens
+func (d *DB) CreateTokens(user *User) (Tokens, error) {
+	var (
+		err     error
+		secret  = newRefreshToken()
+		sid     = uuid.NewV4().String()
+		query   = "INSERT INTO refresh_tokens (uuid, user_id, token_hash, expires_at) VALUES ($1, $2, $3, " + d.connection.dialect.secondsFromNow("$4") + ")"
+		seconds = int(RefreshTokenTTL.Seconds())
+	)
+
+	if _, err = d.connection.Exec(query, sid, user.ID, hashToken(secret), seconds); err != nil {
+		return Tokens{}, utils.Error(err, "db: refresh token not created")
+	}
+
+	return issueTokens(user, sid, secret)
+}
+
+// RefreshTokens exchanges a refresh token for new tokens. Each refresh token
+// can only be used once; reusing one revokes the sign in it belongs to.
+func (d *DB) RefreshTokens(token string) (Tokens, error) {
+	var (
+		err    error
+		rt     refreshToken
+		user   User
+		secret = newRefreshToken()
+		hash   = hashToken(token)
+		query  = "UPDATE refresh_tokens SET token_hash=$1, previous_hash=$2 WHERE id=$3 AND token_hash=$2"
+		result sql.Result
+		n      int64
+	)
+
+	if err = d.connection.Get(&rt, "SELECT * FROM refresh_tokens WHERE token_hash=$1 AND revoked_at IS NULL AND expires_at > now()", hash); err != nil {
+		if err = d.connection.Get(&rt, "SELECT * FROM refresh_tokens WHERE previous_hash=$1", hash); err == nil {
+			d.revokeRefreshToken(rt.ID)
+			return Tokens{}, ErrTokenRevoked
+		}
+
+		return Tokens{}, utils.Error(sql.ErrNoRows, "db: refresh token not found")
+	}
+
+	if result, err = d.connection.Exec(query, hashToken(secret), hash, rt.ID); err != nil {
+		return Tokens{}, utils.Error(err, "db: refresh token not rotated")
+	}
+
+	if n, err = result.RowsAffected(); err != nil || n != 1 {
+		return Tokens{}, ErrTokenRevoked
+	}
+
+	if err = d.connection.Get(&user, "SELECT * FROM users WHERE id=$1", rt.UserID); err != nil {
+		return Tokens{}, utils.Error(err, "db: user not found")
+	}
+
+	if user.Disabled() {
+		return Tokens{}, ErrUserDisabled
+	}
+
+	return issueTokens(&user, rt.UUID, secret)
+}
+
+// RevokeRefreshToken signs out the sign in a user's refresh token belongs to
+func (d *DB) RevokeRefreshToken(user *User, token string) error {
+	var (
+		err error
+		rt  refreshToken
+	)
+
+	if err = d.connection.Get(&rt, "SELECT * FROM refresh_tokens WHERE token_hash=$1 AND user_id=$2", hashToken(token), user.ID); err != nil {
+		return utils.Error(err, "db: refresh token not found")
+	}
+
+	return d.revokeRefreshToken(rt.ID)
+}
+
+// RevokeUserTokens signs a user out everywhere
+func (d *DB) RevokeUserTokens(user *User) error {
+	var err error
+
+	if _, err = d.connection.Exec("UPDATE refresh_tokens SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL", user.ID); err != nil {
+		return utils.Error(err, "db: refresh tokens not revoked")
+	}
+
+	return nil
+}
+
+func (d *DB) revokeRefreshToken(id int) error {
+	var err error
+
+	if _, err = d.connection.Exec("UPDATE refresh_tokens SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL", id); err != nil {
+		return utils.Error(err, "db: refresh token not revoked")
+	}
+
+	return nil
+}
+
+// AuthenticateToken returns the user of an access token that is unexpired
+// and whose sign in hasn't been revoked
+func (d *DB) AuthenticateToken(tokenString string) (User, error) {
+	var (
+		token    *jwt.Token
+		err      error
+		ok       bool
+		claims   jwt.MapClaims
+		username string
+		sid      string
+		revoked  bool
+		user     User
+	)
+
+	token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok = token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		if key, found := signingKeys.Keys[kid]; found {
+			return key, nil
+		}
+
+		return nil, fmt.Errorf("Unknown signing key: %v", token.Header["kid"])
+	})
+
+	if err != nil {
+		return User{}, err
+	}
+
+	// MapClaims validates exp, which is required here
+	if claims, ok = token.Claims.(jwt.MapClaims); !ok || !token.Valid || claims["exp"] == nil {
+		return User{}, fmt.Errorf("Invalid authentication token")
+	}
+
+	if username, ok = claims["username"].(string); !ok {
+		return User{}, fmt.Errorf("Invalid authentication token")
+	}
+
+	if sid, ok = claims["sid"].(string); !ok {
+		return User{}, fmt.Errorf("Invalid authentication token")
+	}
+
+	if err = d.connection.Get(&revoked, "SELECT revoked_at IS NOT NULL FROM refresh_tokens WHERE uuid=$1", sid); err != nil {
+		return User{}, utils.Error(err, "db: sign in not found")
+	}
+
+	if revoked {
+		return User{}, ErrTokenRevoked
+	}
+
+	if user, err = d.FindUser(username); err != nil {
+		return User{}, err
+	}
+
+	if user.Disabled() {
+		return User{}, ErrUserDisabled
+	}
+
+	return user, nil
+}
+
+func issueTokens(user *User, sid string, refresh string) (Tokens, error) {
+	var (
+		token       *jwt.Token
+		tokenString string
+		err         error
+		now         = time.Now()
+	)
+
+	token = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": user.Username,
+		"sub":      fmt.Sprint(user.ID),
+		"sid":      sid,
+		"jti":      uuid.NewV4().String(),
+		"iat":      now.Unix(),
+		"exp":      now.Add(AccessTokenTTL).Unix(),
+	})
+	token.Header["kid"] = signingKeys.Active
+
+	if tokenString, err = token.SignedString(signingKeys.Keys[signingKeys.Active]); err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{tokenString, refresh, int(AccessTokenTTL.Seconds())}, nil
+}
+
+func newRefreshToken() string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(32))
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+
+	return buf
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"database/sql"
+	"dre/totp"
+	"dre/utils"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+// recoveryCodeCount is how many recovery codes a user is given at a time
+const recoveryCodeCount = 10
+
+var (
+	// ErrTOTPEnabled is returned when enrolling a user that already uses TOTP
+	ErrTOTPEnabled = errors.New("db: two-factor authentication is already enabled")
+	// ErrInvalidCode is returned for wrong, reused or expired second factor
+	// codes
+	ErrInvalidCode = errors.New("db: invalid two-factor code")
+)
+
+// EnrollTOTP gives a user a new TOTP secret that must be confirmed with a
+// code before it is required to sign in
+func (d *DB) EnrollTOTP(user *User) (string, error) {
+	var (
+		err    error
+		secret = totp.NewSecret()
+	)
+
+	if user.TOTPEnabled {
+		return "", ErrTOTPEnabled
+	}
+
+	if _, err = d.connection.Exec("UPDATE users SET totp_secret=$1 WHERE id=$2 AND NOT totp_enabled", secret, user.ID); err != nil {
+		return "", utils.Error(err, "db: totp not enrolled")
+	}
+
+	user.TOTPSecret = sql.NullString{String: secret, Valid: true}
+
+	return secret, nil
+}
+
+// ConfirmTOTP enables two-factor authentication for a user once they prove
+// their authenticator has the secret, and returns their recovery codes
+func (d *DB) ConfirmTOTP(user *User, code string) ([]string, error) {
+	var (
+		err  error
+		step int64
+		ok   bool
+	)
+
+	if user.TOTPEnabled {
+		return nil, ErrTOTPEnabled
+	}
+
+	if !user.TOTPSecret.Valid {
+		return nil, errors.New("db: two-factor authentication is not enrolled")
+	}
+
+	if step, ok = totp.Validate(user.TOTPSecret.String, code, time.Now()); !ok {
+		return nil, ErrInvalidCode
+	}
+
+	if _, err = d.connection.Exec("UPDATE users SET totp_enabled=true, totp_last_step=$1 WHERE id=$2", step, user.ID); err != nil {
+		return nil, utils.Error(err, "db: totp not enabled")
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+
+	return d.CreateRecoveryCodes(user)
+}
+
+// DisableTOTP turns off two-factor authentication for a user and forgets
+// their secret and recovery codes
+func (d *DB) DisableTOTP(user *User) error {
+	var err error
+
+	if _, err = d.connection.Exec("UPDATE users SET totp_secret=NULL, totp_enabled=false, totp_last_step=0 WHERE id=$1", user.ID); err != nil {
+		return utils.Error(err, "db: totp not disabled")
+	}
+
+	if _, err = d.connection.Exec("DELETE FROM recovery_codes WHERE user_id=$1", user.ID); err != nil {
+		return utils.Error(err, "db: recovery codes not deleted")
+	}
+
+	user.TOTPSecret = sql.NullString{}
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+
+	return nil
+}
+
+// CreateRecoveryCodes replaces a user's recovery codes. Only hashes are
+// stored, so the codes are returned this once.
+func (d *DB) CreateRecoveryCodes(user *User) ([]string, error) {
+	var (
+		err   error
+		codes = make([]string, recoveryCodeCount)
+		query = "INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)"
+	)
+
+	if _, err = d.connection.Exec("DELETE FROM recovery_codes WHERE user_id=$1", user.ID); err != nil {
+		return nil, utils.Error(err, "db: recovery codes not deleted")
+	}
+
+	for i := range codes {
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes(10))[:10])
+		codes[i] = code[:5] + "-" + code[5:]
+
+		if _, err = d.connection.Exec(query, user.ID, hashToken(normalizeRecoveryCode(codes[i]))); err != nil {
+			return nil, utils.Error(err, "db: recovery code not created")
+		}
+	}
+
+	return codes, nil
+}
+
+// VerifySecondFactor checks a TOTP code or unused recovery code of a user.
+// Each TOTP code and recovery code is accepted once.
+func (d *DB) VerifySecondFactor(user *User, code string) error {
+	var (
+		err    error
+		step   int64
+		ok     bool
+		result sql.Result
+		query  = "UPDATE recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL"
+	)
+
+	if !user.TOTPEnabled {
+		return errors.New("db: two-factor authentication is not enabled")
+	}
+
+	if step, ok = totp.Validate(user.TOTPSecret.String, code, time.Now()); ok {
+		result, err = d.connection.Exec("UPDATE users SET totp_last_step=$1 WHERE id=$2 AND totp_last_step < $1", step, user.ID)
+	} else {
+		result, err = d.connection.Exec(query, user.ID, hashToken(normalizeRecoveryCode(code)))
+	}
+
+	if err != nil {
+		return utils.Error(err, "db: two-factor code not checked")
+	}
+
+	if used, err := result.RowsAffected(); err != nil || used == 0 {
+		return ErrInvalidCode
+	}
+
+	return nil
+}
+
+// SetRequire2FA sets whether an account requires its members to use
+// two-factor authentication
+func (d *DB) SetRequire2FA(accountID int, require bool) error {
+	var err error
+
+	if _, err = d.connection.Exec("UPDATE accounts SET require_2fa=$1 WHERE id=$2", require, accountID); err != nil {
+		return utils.Error(err, "db: account not updated")
+	}
+
+	return nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,259 @@
+package db
+
+import (
+	"database/sql"
+	"dre/utils"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Usage periods
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// Usage is what an account used in a day or month. Runs and builds count
+// towards the period they started in.
+type Usage struct {
+	Period           string  `json:"period"`
+	ContainerSeconds float64 `json:"container_seconds"`
+	CPUSeconds       float64 `json:"cpu_seconds"`
+	MemoryGBSeconds  float64 `json:"memory_gb_seconds"`
+	BuildSeconds     float64 `json:"build_seconds"`
+}
+
+// Quota limits how much an account can use. Zero means unlimited.
+type Quota struct {
+	MonthlyMinutes     int `json:"monthly_minutes"`
+	ConcurrentSessions int `json:"concurrent_sessions"`
+}
+
+// DefaultQuota applies to accounts that don't override it
+var DefaultQuota Quota
+
+// QuotaError explains which quota an account has used up
+type QuotaError string
+
+func (e QuotaError) Error() string {
+	return string(e)
+}
+
+// FindUsage returns an account's usage per period between since and until
+func (d *DB) FindUsage(accountID int, period string, since time.Time, until time.Time) ([]Usage, error) {
+	var (
+		err    error
+		usages = make(map[string]*Usage)
+		result = []Usage{}
+		runs   []struct {
+			Period           string  `db:"period"`
+			ContainerSeconds float64 `db:"container_seconds"`
+			CPUSeconds       float64 `db:"cpu_seconds"`
+			MemoryGBSeconds  float64 `db:"memory_gb_seconds"`
+		}
+		builds []struct {
+			Period       string  `db:"period"`
+			BuildSeconds float64 `db:"build_seconds"`
+		}
+		dialect = d.connection.dialect
+	)
+
+	if period != PeriodDay && period != PeriodMonth {
+		return nil, fmt.Errorf("db: unknown usage period %q", period)
+	}
+
+	runsQuery := `SELECT ` + dialect.period(period, "started_at") + ` AS period,
+			sum(` + dialect.seconds("coalesce(ended_at, now())", "started_at") + `) AS container_seconds,
+			sum(cpu_seconds) AS cpu_seconds, sum(memory_gb_seconds) AS memory_gb_seconds
+		FROM runs WHERE account_id=$1 AND started_at >= $2 AND started_at < $3 GROUP BY 1`
+	buildsQuery := `SELECT ` + dialect.period(period, "started_at") + ` AS period,
+			sum(` + dialect.seconds("finished_at", "started_at") + `) AS build_seconds
+		FROM builds WHERE started_at >= $2 AND started_at < $3 AND finished_at IS NOT NULL
+			AND EXISTS (SELECT 1 FROM images WHERE images.build_id = builds.id AND images.account_id=$1)
+		GROUP BY 1`
+
+	usage := func(key string) *Usage {
+		if usages[key] == nil {
+			usages[key] = &Usage{Period: key}
+		}
+
+		return usages[key]
+	}
+
+	if err = d.connection.Select(&runs, runsQuery, accountID, since, until); err != nil {
+		return nil, utils.Error(err, "db: run usage not found")
+	}
+
+	if err = d.connection.Select(&builds, buildsQuery, accountID, since, until); err != nil {
+		return nil, utils.Error(err, "db: build usage not found")
+	}
+
+	for _, r := range runs {
+		u := usage(r.Period)
+		u.ContainerSeconds = r.ContainerSeconds
+		u.CPUSeconds = r.CPUSeconds
+		u.MemoryGBSeconds = r.MemoryGBSeconds
+	}
+
+	for _, b := range builds {
+		usage(b.Period).BuildSeconds = b.BuildSeconds
+	}
+
+	for _, u := range usages {
+		result = append(result, *u)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Period < result[j].Period })
+
+	return result, nil
+}
+
+// FindQuota returns the quota of an account, falling back to DefaultQuota
+// for limits the account doesn't override
+func (d *DB) FindQuota(accountID int) (Quota, error) {
+	var (
+		err   error
+		acct  Account
+		quota = DefaultQuota
+	)
+
+	if err = d.connection.Get(&acct, "SELECT * FROM accounts WHERE id=$1", accountID); err != nil {
+		return Quota{}, utils.Error(err, "db: account not found")
+	}
+
+	if acct.QuotaMonthlyMinutes.Valid {
+		quota.MonthlyMinutes = int(acct.QuotaMonthlyMinutes.Int64)
+	}
+
+	if acct.QuotaConcurrentSessions.Valid {
+		quota.ConcurrentSessions = int(acct.QuotaConcurrentSessions.Int64)
+	}
+
+	return quota, nil
+}
+
+// SetQuota overrides the quota of an account. Negative limits clear the
+// override so the default applies.
+func (d *DB) SetQuota(accountID int, quota Quota) error {
+	var (
+		err   error
+		query = "UPDATE accounts SET quota_monthly_minutes=$1, quota_concurrent_sessions=$2 WHERE id=$3"
+	)
+
+	override := func(limit int) sql.NullInt64 {
+		return sql.NullInt64{Int64: int64(limit), Valid: limit >= 0}
+	}
+
+	if _, err = d.connection.Exec(query, override(quota.MonthlyMinutes), override(quota.ConcurrentSessions), accountID); err != nil {
+		return utils.Error(err, "db: quota not set")
+	}
+
+	return nil
+}
+
+// MonthlyMinutes returns how many container minutes an account has used
+// since the start of the month
+func (d *DB) MonthlyMinutes(accountID int) (float64, error) {
+	var (
+		err     error
+		seconds float64
+		dialect = d.connection.dialect
+		query   = `SELECT coalesce(sum(` + dialect.seconds("coalesce(ended_at, now())", "started_at") + `), 0)
+			FROM runs WHERE account_id=$1 AND started_at >= ` + dialect.monthStart()
+	)
+
+	if err = d.connection.Get(&seconds, query, accountID); err != nil {
+		return 0, utils.Error(err, "db: monthly usage not found")
+	}
+
+	return seconds / 60, nil
+}
+
+// ActiveSessions returns how many of an account's containers are running
+func (d *DB) ActiveSessions(accountID int) (int, error) {
+	var (
+		err   error
+		count int
+	)
+
+	if err = d.connection.Get(&count, "SELECT count(*) FROM runs WHERE account_id=$1 AND ended_at IS NULL", accountID); err != nil {
+		return 0, utils.Error(err, "db: active sessions not found")
+	}
+
+	return count, nil
+}
+
+// CheckQuota returns a QuotaError if an account can't start another
+// container
+func (d *DB) CheckQuota(accountID int) error {
+	var (
+		err      error
+		quota    Quota
+		minutes  float64
+		sessions int
+	)
+
+	if quota, err = d.FindQuota(accountID); err != nil {
+		return err
+	}
+
+	if quota.MonthlyMinutes > 0 {
+		if minutes, err = d.MonthlyMinutes(accountID); err != nil {
+			return err
+		}
+
+		if minutes >= float64(quota.MonthlyMinutes) {
+			return QuotaError(fmt.Sprintf("monthly quota of %d container minutes is used up until the start of next month", quota.MonthlyMinutes))
+		}
+	}
+
+	if quota.ConcurrentSessions > 0 {
+		if sessions, err = d.ActiveSessions(accountID); err != nil {
+			return err
+		}
+
+		if sessions >= quota.ConcurrentSessions {
+			return QuotaError(fmt.Sprintf("limit of %d concurrent sessions reached", quota.ConcurrentSessions))
+		}
+	}
+
+	return nil
+}
+
+// EndInterruptedRuns ends runs left open by a previous process at the last
+// time their usage was recorded. Runs of the containers in running, which
+// are still running and can be attached to again, are left open.
+func (d *DB) EndInterruptedRuns(running []string) error {
+	var (
+		err  error
+		keep = make(map[string]bool)
+		open []struct {
+			ID   int    `db:"id"`
+			UUID string `db:"uuid"`
+		}
+		query = `SELECT runs.id, containers.uuid FROM runs
+			JOIN containers ON containers.id = runs.container_id
+			WHERE runs.ended_at IS NULL`
+	)
+
+	for _, id := range running {
+		keep[id] = true
+	}
+
+	if err = d.connection.Select(&open, query); err != nil {
+		return utils.Error(err, "db: open runs not found")
+	}
+
+	for _, r := range open {
+		if keep[r.UUID] {
+			continue
+		}
+
+		if _, err = d.connection.Exec("UPDATE runs SET ended_at=updated_at WHERE id=$1", r.ID); err != nil {
+			return utils.Error(err, "db: runs not ended")
+		}
+	}
+
+	return nil
+}
@@ -1,12 +1,16 @@
 package docker
 
 import (
+	"context"
+	"dre/logging"
+	"dre/tracing"
 	"dre/utils"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
 
 	pseudoterm "github.com/kr/pty"
 	uuid "github.com/satori/go.uuid"
@@ -15,7 +19,8 @@ import (
 // Container is a Docker container
 type Container struct {
 	ID      uuid.UUID
-	imageID uuid.UUID
+	Volume  string // named volume mounted at WorkspacePath, if any
+	image   string
 	pty     *Pty
 	OnStart func() error
 	OnStop  func() error
@@ -27,34 +32,57 @@ type Pty struct {
 	Conn *os.File  // a pty is simply an os.File
 }
 
-// CreateContainer takes a source URL for a repo with a Dockerfile,
-// builds an image for it, and returns a Container for that image.
-func CreateContainer(containerID uuid.UUID, sourceURL string) (Container, error) {
-	var err error
+// BuildDir is where sources are downloaded and extracted to be built
+const BuildDir = "./tmp/builds"
 
-	imageID := uuid.NewV4()
+// BuildImage takes a source URL for a repo with a Dockerfile and builds
+// an image for it tagged with tag. It returns the output of the build. Each
+// step is traced as part of the span in ctx.
+func BuildImage(ctx context.Context, tag string, sourceURL string) (string, error) {
+	var (
+		err    error
+		stdout string
+		stderr string
+	)
 
-	downloadPath := fmt.Sprintf("./tmp/containers/%s/", imageID.String())
+	downloadPath := fmt.Sprintf("%s/%s/", BuildDir, tag)
 	repoPath := downloadPath + "repo"
 	tarTarget := "tar_repo.tgz"
 	os.MkdirAll(repoPath, os.ModePerm)
+	defer os.RemoveAll(downloadPath)
 
-	log.Println("Downloading repo...")
-	if err = utils.DownloadFile(downloadPath+tarTarget, sourceURL); err != nil {
-		return Container{}, err
+	log := logging.Default().With("build_id", tag)
+
+	log.Debug("downloading source")
+	_, span := tracing.Start(ctx, "download source")
+	err = utils.DownloadFile(downloadPath+tarTarget, sourceURL)
+	tracing.End(span, err)
+	if err != nil {
+		return "", utils.Error(err, "docker: repo not downloaded")
 	}
 
-	log.Println("Unarchiving repo...")
-	if _, _, err = utils.ExecDir(downloadPath, "tar", "-C", "./repo", "-xzf", tarTarget, "--strip-components=1"); err != nil {
-		return Container{}, err
+	log.Debug("extracting source")
+	_, span = tracing.Start(ctx, "extract source")
+	_, stderr, err = utils.ExecDir(downloadPath, "tar", "-C", "./repo", "-xzf", tarTarget, "--strip-components=1")
+	tracing.End(span, err)
+	if err != nil {
+		return stderr, utils.Error(err, "docker: repo not unarchived")
 	}
 
-	log.Println("Building image...")
-	if _, _, err = utils.ExecDir(repoPath, "docker", "build", "-t", imageID.String(), "."); err != nil {
-		return Container{}, err
+	log.Debug("building image")
+	_, span = tracing.Start(ctx, "docker build")
+	stdout, stderr, err = utils.ExecDir(repoPath, "docker", "build", "-t", tag, ".")
+	tracing.End(span, err)
+	if err != nil {
+		return stdout + stderr, utils.Error(err, "docker: image not built")
 	}
 
-	return Container{ID: containerID, imageID: imageID}, nil
+	return stdout + stderr, nil
+}
+
+// NewContainer returns a Container that runs the image tagged with image
+func NewContainer(containerID uuid.UUID, image string) Container {
+	return Container{ID: containerID, image: image}
 }
 
 // Bash runs /bin/bash in the container and returns a pty connection
@@ -84,6 +112,29 @@ func (c *Container) Connect(command string) (Pty, error) {
 	return pty, nil
 }
 
+// Attach connects to the command the container was run with, for a
+// container that was left running by a previous session
+func (c *Container) Attach() (Pty, error) {
+	var (
+		err error
+		pty Pty
+	)
+
+	pty.Cmd = exec.Command("docker", "attach", c.ID.String())
+	if pty.Conn, err = pseudoterm.Start(pty.Cmd); err != nil {
+		return Pty{}, utils.Error(err, "docker: pty not started")
+	}
+
+	if c.OnStart != nil {
+		if err = c.OnStart(); err != nil {
+			pty.Stop()
+			return Pty{}, utils.Error(err, "docker: onstart failed")
+		}
+	}
+
+	return pty, nil
+}
+
 // Run runs a command in the container and returns a pty connection
 func (c *Container) Run(command string) (Pty, error) {
 	var (
@@ -91,8 +142,13 @@ func (c *Container) Run(command string) (Pty, error) {
 		pty Pty
 	)
 
+	args := []string{"run", "--name", c.ID.String(), "-it"}
+	if c.Volume != "" {
+		args = append(args, "-v", c.Volume+":"+WorkspacePath, "-w", WorkspacePath)
+	}
+
 	// EXPORT set LINES=<number of lines in Terminal on frontend>
-	pty.Cmd = exec.Command("docker", "run", "--name", c.ID.String(), "-it", c.imageID.String(), command)
+	pty.Cmd = exec.Command("docker", append(args, c.image, command)...)
 	if pty.Conn, err = pseudoterm.Start(pty.Cmd); err != nil {
 		return Pty{}, utils.Error(err, "docker: pty not started")
 	}
@@ -107,7 +163,8 @@ func (c *Container) Run(command string) (Pty, error) {
 	return pty, nil
 }
 
-// Stop kills the container and cleans up its volume and image
+// Stop kills the container and removes it along with its anonymous volumes.
+// A named workspace volume is kept.
 func (c *Container) Stop() error {
 	var err error
 
@@ -149,6 +206,20 @@ func (p *Pty) Stop() error {
 	return nil
 }
 
+// Resize sets the size of the pty's terminal. The docker client passes it on
+// to the container.
+func (p *Pty) Resize(cols int, rows int) error {
+	if cols <= 0 || rows <= 0 || cols > 1000 || rows > 1000 {
+		return fmt.Errorf("docker: invalid pty size %dx%d", cols, rows)
+	}
+
+	if err := pseudoterm.Setsize(p.Conn, &pseudoterm.Winsize{Cols: uint16(cols), Rows: uint16(rows)}); err != nil {
+		return utils.Error(err, "docker: pty not resized")
+	}
+
+	return nil
+}
+
 func (p *Pty) Write(buf []byte) error {
 	_, err := p.Conn.Write(buf)
 	return err
@@ -171,3 +242,108 @@ func (p *Pty) Read() ([]byte, error) {
 
 	return out, nil
 }
+
+// Commit saves the filesystem of a running container as an image tagged with
+// tag. Volumes such as the workspace aren't included, see CommitWorkspace.
+func Commit(containerID string, tag string) error {
+	var (
+		err    error
+		stderr string
+	)
+
+	if _, stderr, err = utils.ExecDir(".", "docker", "commit", containerID, tag); err != nil {
+		return utils.Error(err, "docker: container not committed: "+stderr)
+	}
+
+	return nil
+}
+
+// CommitWorkspace adds the workspace volume of a running container to the
+// image tagged with tag, which Commit has made from it. The files are copied
+// into a container created from the image, which is then committed as tag.
+func CommitWorkspace(containerID string, tag string) error {
+	var (
+		err       error
+		stdout    string
+		stderr    string
+		workspace io.ReadCloser
+	)
+
+	if stdout, stderr, err = utils.ExecDir(".", "docker", "create", tag); err != nil {
+		return utils.Error(err, "docker: workspace not committed: "+stderr)
+	}
+
+	temporary := strings.TrimSpace(stdout)
+	defer utils.ExecDir(".", "docker", "rm", temporary)
+
+	if workspace, err = CopyFrom(containerID, WorkspacePath); err != nil {
+		return err
+	}
+
+	// the archive's entries are under workspace/, so extracting it at the
+	// root puts them back at WorkspacePath
+	err = CopyTo(temporary, "/", workspace)
+	if closeErr := workspace.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if _, stderr, err = utils.ExecDir(".", "docker", "commit", temporary, tag); err != nil {
+		return utils.Error(err, "docker: workspace not committed: "+stderr)
+	}
+
+	return nil
+}
+
+// RunningContainers returns the names of the running containers dre started,
+// which are named by UUID. Other containers on the host aren't included.
+func RunningContainers() ([]string, error) {
+	var (
+		err    error
+		stdout string
+		stderr string
+		names  []string
+	)
+
+	if stdout, stderr, err = utils.ExecDir(".", "docker", "ps", "--format", "{{.Names}}"); err != nil {
+		return nil, utils.Error(err, "docker: containers not listed: "+stderr)
+	}
+
+	for _, name := range strings.Fields(stdout) {
+		if _, err = uuid.FromString(name); err == nil {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// Version returns the version of the docker daemon. It fails when the daemon
+// can't be reached.
+func Version() (string, error) {
+	stdout, stderr, err := utils.ExecDir(".", "docker", "version", "--format", "{{.Server.Version}}")
+	if err != nil {
+		return "", utils.Error(err, "docker: daemon not reached: "+strings.TrimSpace(stderr))
+	}
+
+	return strings.TrimSpace(stdout), nil
+}
+
+// Running reports whether the container named by id is running
+func Running(id string) (bool, error) {
+	names, err := RunningContainers()
+	if err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		if name == id {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,98 @@
+package docker
+
+import (
+	"bytes"
+	"dre/utils"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// CopyTo extracts a tar archive into dir in a container
+func CopyTo(containerID string, dir string, archive io.Reader) error {
+	var (
+		err    error
+		stderr bytes.Buffer
+		cmd    = exec.Command("docker", "cp", "-", containerID+":"+dir)
+	)
+
+	cmd.Stdin = archive
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		return utils.Error(err, "docker: archive not copied: "+stderr.String())
+	}
+
+	return nil
+}
+
+// Size returns the bytes of a file, or of everything in a directory, in a
+// running container. Images with busybox's du, which can't count bytes, are
+// measured in kilobytes.
+func Size(containerID string, path string) (int64, error) {
+	var (
+		err    error
+		stdout string
+		stderr string
+		size   int64
+		unit   int64 = 1
+	)
+
+	stdout, stderr, err = utils.ExecDir(".", "docker", "exec", containerID, "du", "-sb", path)
+	if err != nil {
+		unit = 1024
+		stdout, stderr, err = utils.ExecDir(".", "docker", "exec", containerID, "du", "-sk", path)
+	}
+
+	if err != nil {
+		return 0, utils.Error(err, "docker: file not measured: "+stderr)
+	}
+
+	if size, err = strconv.ParseInt(strings.Fields(stdout + " 0")[0], 10, 64); err != nil {
+		return 0, utils.Error(err, "docker: unexpected du output")
+	}
+
+	return size * unit, nil
+}
+
+// archive is a tar stream read from a docker cp command
+type archive struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+// Close waits for the docker cp command to exit
+func (a *archive) Close() error {
+	a.ReadCloser.Close()
+
+	if err := a.cmd.Wait(); err != nil {
+		return utils.Error(err, "docker: archive not copied: "+a.stderr.String())
+	}
+
+	return nil
+}
+
+// CopyFrom returns a tar archive of a file or directory in a container. The
+// archive must be closed.
+func CopyFrom(containerID string, path string) (io.ReadCloser, error) {
+	var (
+		err    error
+		stdout io.ReadCloser
+		stderr bytes.Buffer
+		cmd    = exec.Command("docker", "cp", containerID+":"+path, "-")
+	)
+
+	cmd.Stderr = &stderr
+
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, utils.Error(err, "docker: archive not opened")
+	}
+
+	if err = cmd.Start(); err != nil {
+		return nil, utils.Error(err, "docker: archive not opened")
+	}
+
+	return &archive{stdout, cmd, &stderr}, nil
+}
@@ -0,0 +1,45 @@
+package docker
+
+import (
+	"dre/utils"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Images returns the tags of the images dre built or committed, which are
+// named by UUID. Other images on the host aren't included.
+func Images() ([]string, error) {
+	var (
+		err    error
+		stdout string
+		stderr string
+		tags   []string
+	)
+
+	if stdout, stderr, err = utils.ExecDir(".", "docker", "images", "--format", "{{.Repository}}"); err != nil {
+		return nil, utils.Error(err, "docker: images not listed: "+stderr)
+	}
+
+	for _, tag := range strings.Fields(stdout) {
+		if _, err = uuid.FromString(tag); err == nil {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags, nil
+}
+
+// RemoveImage removes the image tagged with tag
+func RemoveImage(tag string) error {
+	var (
+		err    error
+		stderr string
+	)
+
+	if _, stderr, err = utils.ExecDir(".", "docker", "rmi", tag); err != nil {
+		return utils.Error(err, "docker: image not removed: "+stderr)
+	}
+
+	return nil
+}
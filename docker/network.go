@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"dre/utils"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errNoAddress = errors.New("no network address")
+
+// Address returns the IP address of a running container
+func Address(containerID string) (string, error) {
+	var (
+		err    error
+		stdout string
+		stderr string
+		format = "{{range .NetworkSettings.Networks}}{{.IPAddress}} {{end}}"
+	)
+
+	if stdout, stderr, err = utils.ExecDir(".", "docker", "inspect", "-f", format, containerID); err != nil {
+		return "", utils.Error(err, "docker: container not inspected: "+stderr)
+	}
+
+	if addresses := strings.Fields(stdout); len(addresses) > 0 {
+		return addresses[0], nil
+	}
+
+	return "", utils.Error(errNoAddress, "docker: container "+containerID)
+}
+
+// ListeningPorts returns the TCP ports that processes in a running
+// container are listening on
+func ListeningPorts(containerID string) ([]int, error) {
+	var (
+		err    error
+		stdout string
+		stderr string
+		seen   = make(map[int]bool)
+		ports  = []int{}
+	)
+
+	stdout, stderr, err = utils.ExecDir(".", "docker", "exec", containerID, "cat", "/proc/net/tcp", "/proc/net/tcp6")
+	if err != nil && stdout == "" {
+		return nil, utils.Error(err, "docker: ports not listed: "+stderr)
+	}
+
+	// sl local_address rem_address st ...; st 0A is LISTEN
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != "0A" {
+			continue
+		}
+
+		local := fields[1]
+		port, err := strconv.ParseInt(local[strings.LastIndex(local, ":")+1:], 16, 32)
+		if err != nil || seen[int(port)] {
+			continue
+		}
+
+		seen[int(port)] = true
+		ports = append(ports, int(port))
+	}
+
+	sort.Ints(ports)
+
+	return ports, nil
+}
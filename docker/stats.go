@@ -0,0 +1,71 @@
+package docker
+
+import (
+	"dre/utils"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Stats is a snapshot of the resources a container is using
+type Stats struct {
+	// CPUPercent is the share of one CPU in use, so 200 is two CPUs
+	CPUPercent  float64
+	MemoryBytes int64
+}
+
+// memoryUnits are the suffixes docker stats prints memory with
+var memoryUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"kB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// ContainerStats returns what a running container is using right now
+func ContainerStats(containerID string) (Stats, error) {
+	var (
+		err    error
+		stdout string
+		stderr string
+		stats  Stats
+	)
+
+	stdout, stderr, err = utils.ExecDir(".", "docker", "stats", "--no-stream", "--format", "{{.CPUPerc}}|{{.MemUsage}}", containerID)
+	if err != nil {
+		return Stats{}, utils.Error(err, "docker: stats not read: "+stderr)
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(stdout), "|", 2)
+	if len(fields) != 2 {
+		return Stats{}, fmt.Errorf("docker: unexpected stats %q", stdout)
+	}
+
+	if stats.CPUPercent, err = strconv.ParseFloat(strings.TrimSuffix(fields[0], "%"), 64); err != nil {
+		return Stats{}, utils.Error(err, "docker: unexpected cpu stats")
+	}
+
+	// memory is printed as "<used> / <limit>"
+	if stats.MemoryBytes, err = parseMemory(strings.TrimSpace(strings.Split(fields[1], "/")[0])); err != nil {
+		return Stats{}, err
+	}
+
+	return stats, nil
+}
+
+func parseMemory(value string) (int64, error) {
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(value, unit.suffix), 64)
+			if err != nil {
+				return 0, utils.Error(err, "docker: unexpected memory stats")
+			}
+
+			return int64(n * unit.bytes), nil
+		}
+	}
+
+	return 0, fmt.Errorf("docker: unexpected memory stats %q", value)
+}
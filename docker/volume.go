@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"dre/utils"
+	"strconv"
+	"strings"
+)
+
+// WorkspacePath is where a container's volume is mounted
+const WorkspacePath = "/workspace"
+
+// VolumeName returns the name of the volume for a container
+func VolumeName(containerID string) string {
+	return "dre-workspace-" + containerID
+}
+
+// CreateVolume creates a named volume that outlives the containers using it
+func CreateVolume(name string) error {
+	var (
+		err    error
+		stderr string
+	)
+
+	if _, stderr, err = utils.ExecDir(".", "docker", "volume", "create", "--label", "dre.workspace=true", name); err != nil {
+		return utils.Error(err, "docker: volume not created: "+stderr)
+	}
+
+	return nil
+}
+
+// VolumeSize returns the number of bytes used by a volume
+func VolumeSize(name string) (int64, error) {
+	var (
+		err    error
+		stdout string
+		stderr string
+		kb     int64
+	)
+
+	stdout, stderr, err = utils.ExecDir(".", "docker", "run", "--rm", "-v", name+":/volume:ro", "busybox", "du", "-sk", "/volume")
+	if err != nil {
+		return 0, utils.Error(err, "docker: volume not measured: "+stderr)
+	}
+
+	if kb, err = strconv.ParseInt(strings.Fields(stdout + " 0")[0], 10, 64); err != nil {
+		return 0, utils.Error(err, "docker: unexpected du output")
+	}
+
+	return kb * 1024, nil
+}
+
+// RemoveVolume deletes a named volume and everything in it
+func RemoveVolume(name string) error {
+	var (
+		err    error
+		stderr string
+	)
+
+	if _, stderr, err = utils.ExecDir(".", "docker", "volume", "rm", name); err != nil {
+		return utils.Error(err, "docker: volume not removed: "+stderr)
+	}
+
+	return nil
+}
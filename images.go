@@ -0,0 +1,71 @@
+package main
+
+import (
+	"dre/db"
+	"dre/docker"
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// imagesCommand removes the docker images that no image, snapshot or
+// unfinished build uses any more:
+//
+//	dre images gc [-dry-run]
+//
+// Only images dre built or committed are considered.
+func imagesCommand(database *db.DB, args []string) error {
+	var (
+		err    error
+		inUse  []string
+		tags   []string
+		used   = make(map[string]bool)
+		n      int
+		flags  = flag.NewFlagSet("images gc", flag.ContinueOnError)
+		dryRun = flags.Bool("dry-run", false, "list the images that would be removed")
+	)
+
+	if len(args) == 0 || args[0] != "gc" {
+		return errors.New("usage: dre images gc [-dry-run]")
+	}
+
+	if err = flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if inUse, err = database.FindImageTags(); err != nil {
+		return err
+	}
+
+	for _, tag := range inUse {
+		used[tag] = true
+	}
+
+	if tags, err = docker.Images(); err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if used[tag] {
+			continue
+		}
+
+		if !*dryRun {
+			if err = docker.RemoveImage(tag); err != nil {
+				fmt.Println(err)
+				continue
+			}
+		}
+
+		fmt.Println(tag)
+		n++
+	}
+
+	if *dryRun {
+		fmt.Printf("Would remove %d of %d images\n", n, len(tags))
+	} else {
+		fmt.Printf("Removed %d of %d images\n", n, len(tags))
+	}
+
+	return nil
+}
@@ -0,0 +1,251 @@
+// Package logging writes leveled, structured log lines as logfmt or JSON.
+// A Logger carries fields like a request ID, and travels with a request in
+// its context so that everything logged for the request can be correlated.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int
+
+// Levels, least severe first
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named name
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+
+	return Info, fmt.Errorf("logging: unknown level %q", name)
+}
+
+// Formats a Logger can write
+const (
+	Logfmt = "logfmt"
+	JSON   = "json"
+)
+
+// sink is where the loggers derived from one another write
+type sink struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	level  Level
+	format string
+}
+
+// Logger writes log lines at or above its level, each with the logger's
+// fields followed by those of the line
+type Logger struct {
+	sink   *sink
+	fields []interface{}
+}
+
+// New returns a Logger that writes lines of format at or above level to out
+func New(out io.Writer, level Level, format string) *Logger {
+	return &Logger{sink: &sink{out: out, level: level, format: format}}
+}
+
+var defaultLogger = New(os.Stderr, Info, Logfmt)
+
+// Default returns the logger used when a context has none
+func Default() *Logger {
+	return defaultLogger
+}
+
+// SetDefault replaces the default logger
+func SetDefault(l *Logger) {
+	defaultLogger = l
+}
+
+// With returns a logger that adds keyvals, alternating keys and values, to
+// every line
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(append(fields, l.fields...), keyvals...)
+
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+// Enabled reports whether lines at level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.sink.level
+}
+
+// Debug logs msg at Debug level
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(Debug, msg, keyvals)
+}
+
+// Info logs msg at Info level
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(Info, msg, keyvals)
+}
+
+// Warn logs msg at Warn level
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(Warn, msg, keyvals)
+}
+
+// Error logs msg at Error level
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(Error, msg, keyvals)
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var (
+		buf    bytes.Buffer
+		fields = append([]interface{}{
+			"time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+			"level", level.String(),
+			"msg", msg,
+		}, append(l.fields, keyvals...)...)
+	)
+
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	if l.sink.format == JSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	l.sink.mutex.Lock()
+	defer l.sink.mutex.Unlock()
+
+	l.sink.out.Write(buf.Bytes())
+}
+
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+
+		value := stringify(fields[i+1])
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value := fields[i+1]
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(data)
+	}
+
+	buf.WriteByte('}')
+}
+
+func stringify(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Writer returns a writer that logs each line written to it at level, for
+// output that doesn't go through a Logger, like the standard log package's
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			l.log(level, line, nil)
+		}
+
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+type key int
+
+const loggerKey key = 0
+
+// NewContext returns a context that carries l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// FromContext returns the logger ctx carries, or the default logger
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return l
+	}
+
+	return defaultLogger
+}
+
+// With returns a context whose logger adds keyvals to every line
+func With(ctx context.Context, keyvals ...interface{}) context.Context {
+	return NewContext(ctx, FromContext(ctx).With(keyvals...))
+}
@@ -1,31 +1,247 @@
 package main
 
 import (
+	"context"
+	"dre/builds"
+	"dre/config"
 	"dre/db"
+	"dre/docker"
+	"dre/logging"
+	"dre/notify"
+	"dre/oidc"
 	"dre/server"
-	"flag"
+	"dre/tracing"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+const usage = `usage: dre [flags] [command]
+
+commands:
+  serve                       run the server (the default)
+  migrate up|down|status [n]  apply, roll back or list migrations
+  users list|create|disable|enable
+  accounts list|show|quota
+  containers list|kill
+  images gc
+  attach <container-id>       open a terminal to a container on a server
+
+Run dre <command> -h for the flags of a command, and dre -h for settings.`
+
 func main() {
 	var (
-		port     *int
-		dir      string
+		cfg      config.Config
 		err      error
-		api      server.Server
 		database db.DB
+		command  = "serve"
+		args     []string
 	)
 
-	port = flag.Int("port", 3000, "port number to listen on")
-	flag.Parse()
+	if cfg, err = config.Load(os.Args[1:]); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if len(cfg.Args) > 0 {
+		command, args = cfg.Args[0], cfg.Args[1:]
+	}
 
-	if dir, err = os.Getwd(); err != nil {
-		fmt.Println("Could not get working directory")
+	// attach is a client of a server and doesn't use the database
+	if command == "attach" {
+		if err = attachCommand(cfg, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	database = db.Connect()
-	api = server.New(&database)
-	api.Start(dir, *port)
+	if err = cfg.Validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	level, _ := logging.ParseLevel(cfg.Log.Level)
+	logger := logging.New(os.Stderr, level, cfg.Log.Format)
+	logging.SetDefault(logger)
+
+	// lines of packages that use the standard logger, like net/http's
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.Info))
+
+	db.Policy = db.PasswordPolicy{MinLength: cfg.Limits.PasswordMinLength, MinClasses: cfg.Limits.PasswordMinClasses}
+	db.DefaultQuota = db.Quota{
+		MonthlyMinutes:     cfg.Limits.QuotaMonthlyMinutes,
+		ConcurrentSessions: cfg.Limits.QuotaConcurrentSessions,
+	}
+
+	if database, err = db.Connect(cfg.Database.Dialect, cfg.Database.Datasource, cfg.Database.MaxOpenConns); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case "serve":
+		err = serveCommand(cfg, &database)
+	case "migrate":
+		err = migrateCommand(&database, args)
+	case "users":
+		err = usersCommand(&database, args)
+	case "accounts":
+		err = accountsCommand(&database, args)
+	case "containers":
+		err = containersCommand(&database, args)
+	case "images":
+		err = imagesCommand(&database, args)
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// serveCommand runs the server until it fails or is told to stop by SIGTERM
+// or SIGINT, when it shuts down gracefully. A second signal cuts the grace
+// period short.
+func serveCommand(cfg config.Config, database *db.DB) error {
+	var (
+		err         error
+		api         server.Server
+		signingKeys db.SigningKeys
+		queue       *builds.Queue
+		oidcClient  *oidc.Client
+		notifier    notify.Notifier
+		running     []string
+		signals     = make(chan os.Signal, 2)
+		errs        = make(chan error, 1)
+		logger      = logging.Default()
+	)
+
+	if cfg.Tracing.Endpoint != "" {
+		var stopTracing func(context.Context) error
+
+		if stopTracing, err = tracing.Setup(cfg.Tracing.Endpoint); err != nil {
+			return err
+		}
+
+		// spans not yet exported are flushed on the way out
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := stopTracing(ctx); err != nil {
+				logger.Error("spans not exported", "error", err)
+			}
+		}()
+
+		logger.Info("exporting spans", "endpoint", cfg.Tracing.Endpoint)
+	}
+
+	if cfg.Secrets.SigningKeys != "" {
+		if signingKeys, err = db.ParseSigningKeys(cfg.Secrets.SigningKeys); err != nil {
+			return err
+		}
+	} else {
+		logger.Warn("no signing keys are configured, tokens will not survive a restart")
+		signingKeys = db.RandomSigningKeys()
+	}
+	db.SetSigningKeys(signingKeys)
+
+	if cfg.Database.AutoMigrate {
+		var n int
+
+		if n, err = database.Migrate(true, 0); err != nil {
+			return err
+		}
+
+		logger.Info("applied migrations", "count", n)
+	}
+
+	if err = database.CheckSchema(); err != nil {
+		return err
+	}
+
+	// containers left running by the last server keep their runs and are
+	// attached to again
+	if running, err = docker.RunningContainers(); err != nil {
+		logger.Error("running containers not listed", "error", err)
+	}
+
+	if err = database.EndInterruptedRuns(running); err != nil {
+		return err
+	}
+
+	queue = builds.New(database, cfg.Builds.Workers)
+	if err = queue.Start(); err != nil {
+		return err
+	}
+
+	if cfg.OIDCProviders != "" {
+		var providers []oidc.Provider
+
+		if providers, err = oidc.LoadProviders(cfg.OIDCProviders); err != nil {
+			return err
+		}
+
+		if oidcClient, err = oidc.New(providers); err != nil {
+			return err
+		}
+	}
+
+	if notifier, err = notify.New(cfg.Notifier); err != nil {
+		return err
+	}
+
+	server.MaxSessions = cfg.Limits.MaxSessions
+	server.SetLockout(cfg.Limits.LockoutAttempts, cfg.Limits.LockoutAddressAttempts, cfg.Limits.LockoutDuration)
+	server.MaxVolumeQuotaMB = cfg.Limits.MaxVolumeQuotaMB
+	server.MinFreeDiskMB = cfg.Builds.MinFreeDiskMB
+	if cfg.PreviewURL != "" {
+		server.PreviewURL, _ = url.Parse(cfg.PreviewURL)
+	}
+	api = server.New(database, queue, oidcClient, notifier)
+
+	if err = api.ResumeSessions(running); err != nil {
+		return err
+	}
+
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	go func() {
+		errs <- api.Start(cfg.Listen, cfg.StaticDir, cfg.TLS.Cert, cfg.TLS.Key)
+	}()
+
+	select {
+	case err = <-errs:
+		return err
+	case sig := <-signals:
+		logger.Info("shutting down", "signal", sig)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-signals:
+			logger.Warn("received a second signal, ending sessions now")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err = api.Shutdown(ctx, cfg.Shutdown.GracePeriod, cfg.Shutdown.KeepContainers); err != nil {
+		return err
+	}
+
+	return <-errs
 }
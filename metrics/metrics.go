@@ -0,0 +1,88 @@
+// Package metrics holds the Prometheus metrics of the server. Labels are
+// kept to a handful of values each; container UUIDs and the like never are
+// labels.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "dre"
+
+var (
+	// BuildDuration is how long image builds take, by status
+	BuildDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "build_duration_seconds",
+		Help:      "How long image builds take, by status.",
+		Buckets:   []float64{5, 10, 30, 60, 120, 300, 600, 1200},
+	}, []string{"status"})
+
+	// BuildFailures counts image builds that failed
+	BuildFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "build_failures_total",
+		Help:      "Image builds that failed.",
+	})
+
+	// ContainerStart is how long containers take to start, by whether they
+	// were run or attached to again
+	ContainerStart = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "container_start_seconds",
+		Help:      "How long containers take to start, by mode (run or attach).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"mode"})
+
+	// StreamBytes counts bytes passed between containers and clients, out
+	// to clients or in from them
+	StreamBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_bytes_total",
+		Help:      "Bytes passed between containers and their clients, by direction (in or out).",
+	}, []string{"direction"})
+
+	// WebSocketErrors counts websocket upgrades, reads and writes that failed
+	WebSocketErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_errors_total",
+		Help:      "Websocket operations that failed, by op (upgrade, read or write).",
+	}, []string{"op"})
+
+	// AuthFailures counts rejected credentials by what was presented
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Rejected credentials, by kind (signin, 2fa, token, api_key, refresh, ticket or preview).",
+	}, []string{"kind"})
+
+	// DBQueryDuration is how long database queries take, by method
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "How long database queries take, by method (get, select, exec or query).",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(BuildDuration, BuildFailures, ContainerStart, StreamBytes, WebSocketErrors, AuthFailures, DBQueryDuration)
+}
+
+// GaugeFunc registers a gauge whose value is read from value when metrics
+// are scraped
+func GaugeFunc(name string, help string, value func() float64) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, value))
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"dre/db"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// migrateCommand applies, rolls back or lists migrations:
+//
+//	dre migrate up [n]
+//	dre migrate down [n]
+//	dre migrate status
+//
+// up applies every pending migration unless n is given; down rolls back one
+// unless n is given.
+func migrateCommand(database *db.DB, args []string) error {
+	var (
+		err        error
+		n          int
+		max        int
+		migrations []db.Migration
+	)
+
+	if len(args) == 0 {
+		return errors.New("usage: dre migrate up|down|status [n]")
+	}
+
+	if len(args) > 1 {
+		if max, err = strconv.Atoi(args[1]); err != nil || max < 1 {
+			return fmt.Errorf("migrate: n must be a positive number, got %q", args[1])
+		}
+	}
+
+	switch args[0] {
+	case "up":
+		if n, err = database.Migrate(true, max); err != nil {
+			return err
+		}
+
+		fmt.Printf("Applied %d migrations\n", n)
+	case "down":
+		if max == 0 {
+			max = 1
+		}
+
+		if n, err = database.Migrate(false, max); err != nil {
+			return err
+		}
+
+		fmt.Printf("Rolled back %d migrations\n", n)
+	case "status":
+		if migrations, err = database.Migrations(); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "MIGRATION\tAPPLIED")
+		for _, m := range migrations {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = m.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\n", m.ID, applied)
+		}
+		w.Flush()
+	default:
+		return fmt.Errorf("migrate: unknown command %q", args[0])
+	}
+
+	return nil
+}
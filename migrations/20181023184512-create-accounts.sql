@@ -26,6 +26,6 @@ DROP INDEX idx_images_on_account_id;
 ALTER TABLE images DROP COLUMN account_id;
 ALTER TABLE images ADD COLUMN user_id integer;
 
-DROP TRIGGER set_users_timestamps ON users;
+DROP TRIGGER set_accounts_timestamps ON accounts;
 
 DROP TABLE accounts;
@@ -0,0 +1,35 @@
+-- +migrate Up
+
+CREATE TABLE builds (
+    id SERIAL PRIMARY KEY,
+    uuid varchar NOT NULL,
+    source_url varchar NOT NULL,
+    status varchar NOT NULL DEFAULT 'queued',
+    logs text NOT NULL DEFAULT '',
+    error varchar NOT NULL DEFAULT '',
+    started_at timestamp,
+    finished_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+CREATE TRIGGER set_builds_timestamps
+BEFORE UPDATE ON builds FOR EACH ROW EXECUTE PROCEDURE set_updated_at();
+
+CREATE UNIQUE INDEX idx_builds_on_uuid ON builds (uuid);
+CREATE INDEX idx_builds_on_status ON builds (status);
+
+ALTER TABLE images ADD COLUMN build_id integer;
+CREATE INDEX idx_images_on_build_id ON images (build_id);
+
+-- +migrate Down
+
+DROP INDEX idx_images_on_build_id;
+ALTER TABLE images DROP COLUMN build_id;
+
+DROP INDEX idx_builds_on_status;
+DROP INDEX idx_builds_on_uuid;
+
+DROP TRIGGER set_builds_timestamps ON builds;
+
+DROP TABLE builds;
@@ -0,0 +1,13 @@
+-- +migrate Up
+
+ALTER TABLE images ADD COLUMN snapshot_of integer;
+
+DROP INDEX idx_containers_on_image_id;
+CREATE INDEX idx_containers_on_image_id ON containers (image_id);
+
+-- +migrate Down
+
+DROP INDEX idx_containers_on_image_id;
+CREATE UNIQUE INDEX idx_containers_on_image_id ON containers (image_id);
+
+ALTER TABLE images DROP COLUMN snapshot_of;
@@ -0,0 +1,32 @@
+-- +migrate Up
+
+CREATE TABLE refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    uuid varchar NOT NULL,
+    user_id integer NOT NULL,
+    token_hash varchar NOT NULL,
+    previous_hash varchar NOT NULL DEFAULT '',
+    expires_at timestamp NOT NULL,
+    revoked_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+CREATE TRIGGER set_refresh_tokens_timestamps
+BEFORE UPDATE ON refresh_tokens FOR EACH ROW EXECUTE PROCEDURE set_updated_at();
+
+CREATE UNIQUE INDEX idx_refresh_tokens_on_uuid ON refresh_tokens (uuid);
+CREATE UNIQUE INDEX idx_refresh_tokens_on_token_hash ON refresh_tokens (token_hash);
+CREATE INDEX idx_refresh_tokens_on_previous_hash ON refresh_tokens (previous_hash);
+CREATE INDEX idx_refresh_tokens_on_user_id ON refresh_tokens (user_id);
+
+-- +migrate Down
+
+DROP INDEX idx_refresh_tokens_on_user_id;
+DROP INDEX idx_refresh_tokens_on_previous_hash;
+DROP INDEX idx_refresh_tokens_on_token_hash;
+DROP INDEX idx_refresh_tokens_on_uuid;
+
+DROP TRIGGER set_refresh_tokens_timestamps ON refresh_tokens;
+
+DROP TABLE refresh_tokens;
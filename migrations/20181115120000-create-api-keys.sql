@@ -0,0 +1,34 @@
+-- +migrate Up
+
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    uuid varchar NOT NULL,
+    account_id integer NOT NULL,
+    user_id integer NOT NULL,
+    name varchar NOT NULL,
+    prefix varchar NOT NULL,
+    secret_hash varchar NOT NULL,
+    scopes varchar NOT NULL DEFAULT '',
+    expires_at timestamp,
+    last_used_at timestamp,
+    revoked_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+CREATE TRIGGER set_api_keys_timestamps
+BEFORE UPDATE ON api_keys FOR EACH ROW EXECUTE PROCEDURE set_updated_at();
+
+CREATE UNIQUE INDEX idx_api_keys_on_uuid ON api_keys (uuid);
+CREATE UNIQUE INDEX idx_api_keys_on_prefix ON api_keys (prefix);
+CREATE INDEX idx_api_keys_on_account_id ON api_keys (account_id);
+
+-- +migrate Down
+
+DROP INDEX idx_api_keys_on_account_id;
+DROP INDEX idx_api_keys_on_prefix;
+DROP INDEX idx_api_keys_on_uuid;
+
+DROP TRIGGER set_api_keys_timestamps ON api_keys;
+
+DROP TABLE api_keys;
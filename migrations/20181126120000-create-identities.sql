@@ -0,0 +1,26 @@
+-- +migrate Up
+
+CREATE TABLE identities (
+    id SERIAL PRIMARY KEY,
+    provider varchar NOT NULL,
+    subject varchar NOT NULL,
+    user_id integer NOT NULL,
+    email varchar NOT NULL DEFAULT '',
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+CREATE TRIGGER set_identities_timestamps
+BEFORE UPDATE ON identities FOR EACH ROW EXECUTE PROCEDURE set_updated_at();
+
+CREATE UNIQUE INDEX idx_identities_on_provider_and_subject ON identities (provider, subject);
+CREATE INDEX idx_identities_on_user_id ON identities (user_id);
+
+-- +migrate Down
+
+DROP INDEX idx_identities_on_user_id;
+DROP INDEX idx_identities_on_provider_and_subject;
+
+DROP TRIGGER set_identities_timestamps ON identities;
+
+DROP TABLE identities;
@@ -0,0 +1,26 @@
+-- +migrate Up
+
+CREATE TABLE password_resets (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL,
+    token_hash varchar NOT NULL,
+    expires_at timestamp NOT NULL,
+    used_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+CREATE TRIGGER set_password_resets_timestamps
+BEFORE UPDATE ON password_resets FOR EACH ROW EXECUTE PROCEDURE set_updated_at();
+
+CREATE UNIQUE INDEX idx_password_resets_on_token_hash ON password_resets (token_hash);
+CREATE INDEX idx_password_resets_on_user_id ON password_resets (user_id);
+
+-- +migrate Down
+
+DROP INDEX idx_password_resets_on_user_id;
+DROP INDEX idx_password_resets_on_token_hash;
+
+DROP TRIGGER set_password_resets_timestamps ON password_resets;
+
+DROP TABLE password_resets;
@@ -0,0 +1,25 @@
+-- +migrate Up
+
+ALTER TABLE runs ADD COLUMN account_id integer;
+ALTER TABLE runs ADD COLUMN cpu_seconds double precision NOT NULL DEFAULT 0;
+ALTER TABLE runs ADD COLUMN memory_gb_seconds double precision NOT NULL DEFAULT 0;
+
+UPDATE runs SET account_id = images.account_id
+FROM containers JOIN images ON images.id = containers.image_id
+WHERE containers.id = runs.container_id;
+
+CREATE INDEX idx_runs_on_account_id_and_started_at ON runs (account_id, started_at);
+
+ALTER TABLE accounts ADD COLUMN quota_monthly_minutes integer;
+ALTER TABLE accounts ADD COLUMN quota_concurrent_sessions integer;
+
+-- +migrate Down
+
+ALTER TABLE accounts DROP COLUMN quota_concurrent_sessions;
+ALTER TABLE accounts DROP COLUMN quota_monthly_minutes;
+
+DROP INDEX idx_runs_on_account_id_and_started_at;
+
+ALTER TABLE runs DROP COLUMN memory_gb_seconds;
+ALTER TABLE runs DROP COLUMN cpu_seconds;
+ALTER TABLE runs DROP COLUMN account_id;
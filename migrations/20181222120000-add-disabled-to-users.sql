@@ -0,0 +1,7 @@
+-- +migrate Up
+
+ALTER TABLE users ADD COLUMN disabled_at timestamp;
+
+-- +migrate Down
+
+ALTER TABLE users DROP COLUMN disabled_at;
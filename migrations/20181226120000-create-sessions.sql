@@ -0,0 +1,26 @@
+-- +migrate Up
+
+CREATE TABLE sessions (
+    id SERIAL PRIMARY KEY,
+    container_id integer NOT NULL,
+    docker_name varchar NOT NULL,
+    state varchar NOT NULL DEFAULT 'running',
+    user_id integer,
+    account_id integer,
+    ended_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+CREATE TRIGGER set_sessions_timestamps
+BEFORE UPDATE ON sessions FOR EACH ROW EXECUTE PROCEDURE set_updated_at();
+
+CREATE INDEX idx_sessions_on_state ON sessions (state);
+
+-- +migrate Down
+
+DROP INDEX idx_sessions_on_state;
+
+DROP TRIGGER set_sessions_timestamps ON sessions;
+
+DROP TABLE sessions;
@@ -0,0 +1,11 @@
+-- +migrate Up
+
+-- invitations are accepted with a token sent to the invitee. Pending
+-- invitations from before have none and can't be accepted.
+ALTER TABLE invitations ADD COLUMN token_hash varchar NOT NULL DEFAULT '';
+CREATE INDEX idx_invitations_on_token_hash ON invitations (token_hash);
+
+-- +migrate Down
+
+DROP INDEX idx_invitations_on_token_hash;
+ALTER TABLE invitations DROP COLUMN token_hash;
@@ -0,0 +1,17 @@
+// Package migrations embeds the SQL migrations so the server binary can
+// apply them without sql-migrate installed
+package migrations
+
+import "embed"
+
+// Files holds every postgres migration, named so they sort in the order
+// they apply
+//
+//go:embed *.sql
+var Files embed.FS
+
+// SQLiteFiles holds the sqlite equivalent of every migration in Files,
+// under sqlite/ with the same names
+//
+//go:embed sqlite/*.sql
+var SQLiteFiles embed.FS
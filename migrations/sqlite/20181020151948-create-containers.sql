@@ -0,0 +1,51 @@
+-- +migrate Up
+-- updated_at is set by an AFTER UPDATE trigger per table, since sqlite
+-- triggers can't assign to NEW
+
+CREATE TABLE images (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid varchar,
+    source_url varchar,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+CREATE TABLE containers (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid varchar,
+    image_id integer,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_images_timestamps
+AFTER UPDATE ON images FOR EACH ROW
+BEGIN
+    UPDATE images SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_containers_timestamps
+AFTER UPDATE ON containers FOR EACH ROW
+BEGIN
+    UPDATE containers SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE UNIQUE INDEX idx_images_on_uuid ON images (uuid);
+CREATE UNIQUE INDEX idx_containers_on_uuid ON containers (uuid);
+CREATE UNIQUE INDEX idx_containers_on_image_id ON containers (image_id);
+
+-- +migrate Down
+
+DROP INDEX idx_containers_on_image_id;
+DROP INDEX idx_containers_on_uuid;
+DROP INDEX idx_images_on_uuid;
+
+DROP TRIGGER set_containers_timestamps;
+DROP TRIGGER set_images_timestamps;
+
+DROP TABLE containers;
+DROP TABLE images;
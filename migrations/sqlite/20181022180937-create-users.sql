@@ -0,0 +1,31 @@
+-- +migrate Up
+
+CREATE TABLE users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username varchar,
+    password varchar,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_users_timestamps
+AFTER UPDATE ON users FOR EACH ROW
+BEGIN
+    UPDATE users SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE UNIQUE INDEX idx_users_on_username ON users (username);
+
+ALTER TABLE images ADD COLUMN user_id integer;
+
+-- +migrate Down
+
+ALTER TABLE images DROP COLUMN user_id;
+
+DROP INDEX idx_users_on_username;
+
+DROP TRIGGER set_users_timestamps;
+
+DROP TABLE users;
@@ -0,0 +1,35 @@
+-- +migrate Up
+
+CREATE TABLE accounts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_accounts_timestamps
+AFTER UPDATE ON accounts FOR EACH ROW
+BEGIN
+    UPDATE accounts SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+ALTER TABLE images DROP COLUMN user_id;
+ALTER TABLE images ADD COLUMN account_id integer;
+CREATE INDEX idx_images_on_account_id ON images (account_id);
+
+ALTER TABLE users ADD COLUMN account_id integer;
+CREATE INDEX idx_users_on_account_id ON users (account_id);
+
+-- +migrate Down
+
+DROP INDEX idx_users_on_account_id;
+ALTER TABLE users DROP COLUMN account_id;
+
+DROP INDEX idx_images_on_account_id;
+ALTER TABLE images DROP COLUMN account_id;
+ALTER TABLE images ADD COLUMN user_id integer;
+
+DROP TRIGGER set_accounts_timestamps;
+
+DROP TABLE accounts;
@@ -0,0 +1,28 @@
+-- +migrate Up
+
+CREATE TABLE runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    container_id integer NOT NULL,
+    created_at timestamp default current_timestamp,
+    started_at timestamp,
+    ended_at timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_runs_timestamps
+AFTER UPDATE ON runs FOR EACH ROW
+BEGIN
+    UPDATE runs SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE INDEX idx_runs_on_container_id ON runs (container_id);
+
+-- +migrate Down
+
+DROP INDEX idx_runs_on_container_id;
+
+DROP TRIGGER set_runs_timestamps;
+
+DROP TABLE runs;
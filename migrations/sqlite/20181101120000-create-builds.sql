@@ -0,0 +1,40 @@
+-- +migrate Up
+
+CREATE TABLE builds (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid varchar NOT NULL,
+    source_url varchar NOT NULL,
+    status varchar NOT NULL DEFAULT 'queued',
+    logs text NOT NULL DEFAULT '',
+    error varchar NOT NULL DEFAULT '',
+    started_at timestamp,
+    finished_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_builds_timestamps
+AFTER UPDATE ON builds FOR EACH ROW
+BEGIN
+    UPDATE builds SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE UNIQUE INDEX idx_builds_on_uuid ON builds (uuid);
+CREATE INDEX idx_builds_on_status ON builds (status);
+
+ALTER TABLE images ADD COLUMN build_id integer;
+CREATE INDEX idx_images_on_build_id ON images (build_id);
+
+-- +migrate Down
+
+DROP INDEX idx_images_on_build_id;
+ALTER TABLE images DROP COLUMN build_id;
+
+DROP INDEX idx_builds_on_status;
+DROP INDEX idx_builds_on_uuid;
+
+DROP TRIGGER set_builds_timestamps;
+
+DROP TABLE builds;
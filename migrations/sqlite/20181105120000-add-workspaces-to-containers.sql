@@ -0,0 +1,11 @@
+-- +migrate Up
+
+ALTER TABLE containers ADD COLUMN volume varchar NOT NULL DEFAULT '';
+ALTER TABLE containers ADD COLUMN volume_quota_mb integer NOT NULL DEFAULT 1024;
+ALTER TABLE containers ADD COLUMN deleted_at timestamp;
+
+-- +migrate Down
+
+ALTER TABLE containers DROP COLUMN deleted_at;
+ALTER TABLE containers DROP COLUMN volume_quota_mb;
+ALTER TABLE containers DROP COLUMN volume;
@@ -0,0 +1,37 @@
+-- +migrate Up
+
+CREATE TABLE refresh_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid varchar NOT NULL,
+    user_id integer NOT NULL,
+    token_hash varchar NOT NULL,
+    previous_hash varchar NOT NULL DEFAULT '',
+    expires_at timestamp NOT NULL,
+    revoked_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_refresh_tokens_timestamps
+AFTER UPDATE ON refresh_tokens FOR EACH ROW
+BEGIN
+    UPDATE refresh_tokens SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE UNIQUE INDEX idx_refresh_tokens_on_uuid ON refresh_tokens (uuid);
+CREATE UNIQUE INDEX idx_refresh_tokens_on_token_hash ON refresh_tokens (token_hash);
+CREATE INDEX idx_refresh_tokens_on_previous_hash ON refresh_tokens (previous_hash);
+CREATE INDEX idx_refresh_tokens_on_user_id ON refresh_tokens (user_id);
+
+-- +migrate Down
+
+DROP INDEX idx_refresh_tokens_on_user_id;
+DROP INDEX idx_refresh_tokens_on_previous_hash;
+DROP INDEX idx_refresh_tokens_on_token_hash;
+DROP INDEX idx_refresh_tokens_on_uuid;
+
+DROP TRIGGER set_refresh_tokens_timestamps;
+
+DROP TABLE refresh_tokens;
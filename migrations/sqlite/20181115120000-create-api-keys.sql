@@ -0,0 +1,39 @@
+-- +migrate Up
+
+CREATE TABLE api_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid varchar NOT NULL,
+    account_id integer NOT NULL,
+    user_id integer NOT NULL,
+    name varchar NOT NULL,
+    prefix varchar NOT NULL,
+    secret_hash varchar NOT NULL,
+    scopes varchar NOT NULL DEFAULT '',
+    expires_at timestamp,
+    last_used_at timestamp,
+    revoked_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_api_keys_timestamps
+AFTER UPDATE ON api_keys FOR EACH ROW
+BEGIN
+    UPDATE api_keys SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE UNIQUE INDEX idx_api_keys_on_uuid ON api_keys (uuid);
+CREATE UNIQUE INDEX idx_api_keys_on_prefix ON api_keys (prefix);
+CREATE INDEX idx_api_keys_on_account_id ON api_keys (account_id);
+
+-- +migrate Down
+
+DROP INDEX idx_api_keys_on_account_id;
+DROP INDEX idx_api_keys_on_prefix;
+DROP INDEX idx_api_keys_on_uuid;
+
+DROP TRIGGER set_api_keys_timestamps;
+
+DROP TABLE api_keys;
@@ -0,0 +1,74 @@
+-- +migrate Up
+
+CREATE TABLE memberships (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id integer NOT NULL,
+    user_id integer NOT NULL,
+    role varchar NOT NULL,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_memberships_timestamps
+AFTER UPDATE ON memberships FOR EACH ROW
+BEGIN
+    UPDATE memberships SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE UNIQUE INDEX idx_memberships_on_account_id_and_user_id ON memberships (account_id, user_id);
+CREATE INDEX idx_memberships_on_user_id ON memberships (user_id);
+
+INSERT INTO memberships (account_id, user_id, role)
+SELECT account_id, id, 'owner' FROM users WHERE account_id IS NOT NULL;
+
+ALTER TABLE users ADD COLUMN email varchar;
+CREATE UNIQUE INDEX idx_users_on_email ON users (email);
+
+CREATE TABLE invitations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid varchar NOT NULL,
+    account_id integer NOT NULL,
+    inviter_id integer NOT NULL,
+    username varchar NOT NULL DEFAULT '',
+    email varchar NOT NULL DEFAULT '',
+    role varchar NOT NULL,
+    accepted_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_invitations_timestamps
+AFTER UPDATE ON invitations FOR EACH ROW
+BEGIN
+    UPDATE invitations SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE UNIQUE INDEX idx_invitations_on_uuid ON invitations (uuid);
+CREATE INDEX idx_invitations_on_account_id ON invitations (account_id);
+CREATE INDEX idx_invitations_on_username ON invitations (username);
+CREATE INDEX idx_invitations_on_email ON invitations (email);
+
+-- +migrate Down
+
+DROP INDEX idx_invitations_on_email;
+DROP INDEX idx_invitations_on_username;
+DROP INDEX idx_invitations_on_account_id;
+DROP INDEX idx_invitations_on_uuid;
+
+DROP TRIGGER set_invitations_timestamps;
+
+DROP TABLE invitations;
+
+DROP INDEX idx_users_on_email;
+ALTER TABLE users DROP COLUMN email;
+
+DROP INDEX idx_memberships_on_user_id;
+DROP INDEX idx_memberships_on_account_id_and_user_id;
+
+DROP TRIGGER set_memberships_timestamps;
+
+DROP TABLE memberships;
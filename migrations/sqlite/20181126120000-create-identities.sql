@@ -0,0 +1,31 @@
+-- +migrate Up
+
+CREATE TABLE identities (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    provider varchar NOT NULL,
+    subject varchar NOT NULL,
+    user_id integer NOT NULL,
+    email varchar NOT NULL DEFAULT '',
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_identities_timestamps
+AFTER UPDATE ON identities FOR EACH ROW
+BEGIN
+    UPDATE identities SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE UNIQUE INDEX idx_identities_on_provider_and_subject ON identities (provider, subject);
+CREATE INDEX idx_identities_on_user_id ON identities (user_id);
+
+-- +migrate Down
+
+DROP INDEX idx_identities_on_user_id;
+DROP INDEX idx_identities_on_provider_and_subject;
+
+DROP TRIGGER set_identities_timestamps;
+
+DROP TABLE identities;
@@ -0,0 +1,31 @@
+-- +migrate Up
+
+CREATE TABLE password_resets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL,
+    token_hash varchar NOT NULL,
+    expires_at timestamp NOT NULL,
+    used_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_password_resets_timestamps
+AFTER UPDATE ON password_resets FOR EACH ROW
+BEGIN
+    UPDATE password_resets SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE UNIQUE INDEX idx_password_resets_on_token_hash ON password_resets (token_hash);
+CREATE INDEX idx_password_resets_on_user_id ON password_resets (user_id);
+
+-- +migrate Down
+
+DROP INDEX idx_password_resets_on_user_id;
+DROP INDEX idx_password_resets_on_token_hash;
+
+DROP TRIGGER set_password_resets_timestamps;
+
+DROP TABLE password_resets;
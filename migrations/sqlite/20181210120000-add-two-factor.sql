@@ -0,0 +1,40 @@
+-- +migrate Up
+
+ALTER TABLE users ADD COLUMN totp_secret varchar;
+ALTER TABLE users ADD COLUMN totp_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE accounts ADD COLUMN require_2fa boolean NOT NULL DEFAULT false;
+
+CREATE TABLE recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL,
+    code_hash varchar NOT NULL,
+    used_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_recovery_codes_timestamps
+AFTER UPDATE ON recovery_codes FOR EACH ROW
+BEGIN
+    UPDATE recovery_codes SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE UNIQUE INDEX idx_recovery_codes_on_user_id_and_code_hash ON recovery_codes (user_id, code_hash);
+
+-- +migrate Down
+
+DROP INDEX idx_recovery_codes_on_user_id_and_code_hash;
+
+DROP TRIGGER set_recovery_codes_timestamps;
+
+DROP TABLE recovery_codes;
+
+ALTER TABLE accounts DROP COLUMN require_2fa;
+
+ALTER TABLE users DROP COLUMN totp_last_step;
+ALTER TABLE users DROP COLUMN totp_enabled;
+ALTER TABLE users DROP COLUMN totp_secret;
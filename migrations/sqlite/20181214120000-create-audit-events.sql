@@ -0,0 +1,25 @@
+-- +migrate Up
+
+CREATE TABLE audit_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id integer,
+    actor_id integer,
+    actor varchar NOT NULL DEFAULT '',
+    api_key varchar,
+    action varchar NOT NULL,
+    target varchar NOT NULL DEFAULT '',
+    ip varchar NOT NULL DEFAULT '',
+    user_agent varchar NOT NULL DEFAULT '',
+    details text NOT NULL DEFAULT '{}',
+    created_at timestamp NOT NULL default current_timestamp
+);
+
+CREATE INDEX idx_audit_events_on_account_id_and_id ON audit_events (account_id, id);
+CREATE INDEX idx_audit_events_on_actor_id ON audit_events (actor_id);
+
+-- +migrate Down
+
+DROP INDEX idx_audit_events_on_actor_id;
+DROP INDEX idx_audit_events_on_account_id_and_id;
+
+DROP TABLE audit_events;
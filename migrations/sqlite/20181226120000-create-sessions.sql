@@ -0,0 +1,31 @@
+-- +migrate Up
+
+CREATE TABLE sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    container_id integer NOT NULL,
+    docker_name varchar NOT NULL,
+    state varchar NOT NULL DEFAULT 'running',
+    user_id integer,
+    account_id integer,
+    ended_at timestamp,
+    created_at timestamp default current_timestamp,
+    updated_at timestamp default current_timestamp
+);
+
+-- +migrate StatementBegin
+CREATE TRIGGER set_sessions_timestamps
+AFTER UPDATE ON sessions FOR EACH ROW
+BEGIN
+    UPDATE sessions SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+-- +migrate StatementEnd
+
+CREATE INDEX idx_sessions_on_state ON sessions (state);
+
+-- +migrate Down
+
+DROP INDEX idx_sessions_on_state;
+
+DROP TRIGGER set_sessions_timestamps;
+
+DROP TABLE sessions;
@@ -0,0 +1,75 @@
+package notify
+
+import (
+	"dre/logging"
+	"dre/utils"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a notification for a user
+type Message struct {
+	// To is the user's email, or their username if they have none
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages to users
+type Notifier interface {
+	Notify(message Message) error
+}
+
+// New returns the notifier described by spec: "log" writes messages to the
+// log and "file:<path>" appends them to a file
+func New(spec string) (Notifier, error) {
+	switch {
+	case spec == "" || spec == "log":
+		return LogNotifier{}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return &FileNotifier{Path: strings.TrimPrefix(spec, "file:")}, nil
+	default:
+		return nil, fmt.Errorf("notify: unknown notifier %q", spec)
+	}
+}
+
+// LogNotifier writes messages to the log. It is meant for local use.
+type LogNotifier struct{}
+
+// Notify logs message
+func (LogNotifier) Notify(message Message) error {
+	logging.Default().Info("notification", "to", message.To, "subject", message.Subject, "body", message.Body)
+	return nil
+}
+
+// FileNotifier appends messages to a file
+type FileNotifier struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+// Notify appends message to the notifier's file
+func (n *FileNotifier) Notify(message Message) error {
+	var (
+		file *os.File
+		err  error
+	)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if file, err = os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		return utils.Error(err, "notify: file not opened")
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), message.To, message.Subject, message.Body)
+	if err != nil {
+		return utils.Error(err, "notify: message not written")
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"dre/utils"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider types
+const (
+	TypeOIDC   = "oidc"
+	TypeGitHub = "github"
+)
+
+// LoginTTL is how long a user has to finish signing in with a provider
+const LoginTTL = 10 * time.Minute
+
+var (
+	errUnknownProvider = errors.New("oidc: unknown provider")
+	errUnknownState    = errors.New("oidc: unknown or expired state")
+)
+
+// Provider configures an identity provider. OIDC providers are discovered
+// from their issuer; GitHub uses its OAuth2 endpoints.
+type Provider struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+	// Domains maps email domains to the account that new users with a
+	// verified email in the domain join
+	Domains map[string]int `json:"domains"`
+	// Endpoints of a GitHub Enterprise install, defaulting to github.com
+	AuthURL     string `json:"auth_url"`
+	TokenURL    string `json:"token_url"`
+	UserInfoURL string `json:"userinfo_url"`
+}
+
+// Identity is a user as described by a provider
+type Identity struct {
+	Provider      string
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+}
+
+// Domain returns the domain of a verified email, or "" if there is none
+func (i *Identity) Domain() string {
+	if !i.EmailVerified || !strings.Contains(i.Email, "@") {
+		return ""
+	}
+
+	return strings.ToLower(i.Email[strings.LastIndex(i.Email, "@")+1:])
+}
+
+// login is a sign in that was started and not yet finished
+type login struct {
+	provider string
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+// Client signs users in with providers using the authorization code flow
+// with PKCE
+type Client struct {
+	providers map[string]*provider
+	http      *http.Client
+	mutex     sync.Mutex
+	logins    map[string]login
+}
+
+// LoadProviders reads a JSON array of providers from a file
+func LoadProviders(path string) ([]Provider, error) {
+	var (
+		providers []Provider
+		data      []byte
+		err       error
+	)
+
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return nil, utils.Error(err, "oidc: providers not read")
+	}
+
+	if err = json.Unmarshal(data, &providers); err != nil {
+		return nil, utils.Error(err, "oidc: providers not parsed")
+	}
+
+	return providers, nil
+}
+
+// New returns a Client for providers
+func New(providers []Provider) (*Client, error) {
+	client := &Client{
+		providers: make(map[string]*provider),
+		http:      &http.Client{Timeout: 10 * time.Second},
+		logins:    make(map[string]login),
+	}
+
+	for _, p := range providers {
+		if p.Type == "" {
+			p.Type = TypeOIDC
+		}
+
+		if p.Name == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return nil, fmt.Errorf("oidc: provider %q needs a name, client_id and redirect_url", p.Name)
+		}
+
+		switch p.Type {
+		case TypeOIDC:
+			if p.Issuer == "" {
+				return nil, fmt.Errorf("oidc: provider %q needs an issuer", p.Name)
+			}
+		case TypeGitHub:
+		default:
+			return nil, fmt.Errorf("oidc: provider %q has unknown type %q", p.Name, p.Type)
+		}
+
+		client.providers[p.Name] = &provider{Provider: p, client: client.http}
+	}
+
+	return client, nil
+}
+
+// Provider returns the configuration of a provider
+func (c *Client) Provider(name string) (Provider, bool) {
+	p, ok := c.providers[name]
+	if !ok {
+		return Provider{}, false
+	}
+
+	return p.Provider, true
+}
+
+// AuthURL starts a sign in with a provider and returns the URL to send the
+// user to, along with the sign in's state. Callers must check the state
+// comes back from the browser that started the sign in.
+func (c *Client) AuthURL(ctx context.Context, name string) (string, string, error) {
+	var (
+		p        *provider
+		ok       bool
+		err      error
+		endpoint string
+		state    = randomString()
+		l        = login{provider: name, verifier: randomString(), nonce: randomString()}
+	)
+
+	if p, ok = c.providers[name]; !ok {
+		return "", "", errUnknownProvider
+	}
+
+	if endpoint, err = p.authEndpoint(ctx); err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(l.verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.scopes(), " ")},
+		"state":                 {state},
+		"nonce":                 {l.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for s, pending := range c.logins {
+		if time.Now().After(pending.expires) {
+			delete(c.logins, s)
+		}
+	}
+
+	l.expires = time.Now().Add(LoginTTL)
+	c.logins[state] = l
+
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + query.Encode(), state, nil
+	}
+
+	return endpoint + "?" + query.Encode(), state, nil
+}
+
+// Exchange finishes a sign in with the code and state the provider
+// redirected back with, and returns the user's identity
+func (c *Client) Exchange(ctx context.Context, name string, state string, code string) (Identity, error) {
+	var (
+		l  login
+		ok bool
+	)
+
+	c.mutex.Lock()
+	l, ok = c.logins[state]
+	delete(c.logins, state)
+	c.mutex.Unlock()
+
+	if !ok || l.provider != name || time.Now().After(l.expires) {
+		return Identity{}, errUnknownState
+	}
+
+	return c.providers[name].exchange(ctx, code, l)
+}
+
+func randomString() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
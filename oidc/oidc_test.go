@@ -0,0 +1,249 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"dre/oidc/oidctest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const redirectURL = "http://localhost/v1/oidc/mock/callback"
+
+func newTestClient(t *testing.T) (*Client, *oidctest.Provider) {
+	mock := oidctest.NewProvider("dre", "secret")
+	t.Cleanup(mock.Close)
+
+	client, err := New([]Provider{{
+		Name:         "mock",
+		Issuer:       mock.Issuer(),
+		ClientID:     "dre",
+		ClientSecret: "secret",
+		RedirectURL:  redirectURL,
+		Domains:      map[string]int{"corp.io": 7},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, mock
+}
+
+// signIn runs a sign in through the mock and returns the identity
+func signIn(client *Client, mock *oidctest.Provider) (Identity, error) {
+	authURL, _, err := client.AuthURL(context.Background(), "mock")
+	if err != nil {
+		return Identity{}, err
+	}
+
+	callback, err := mock.Authorize(authURL)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return client.Exchange(context.Background(), "mock", callback.Get("state"), callback.Get("code"))
+}
+
+func TestDiscovery(t *testing.T) {
+	client, mock := newTestClient(t)
+
+	authURL, state, err := client.AuthURL(context.Background(), "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse(authURL)
+	query := u.Query()
+
+	if u.Scheme+"://"+u.Host+u.Path != mock.URL+"/authorize" {
+		t.Errorf("auth URL is %s, want the discovered endpoint", authURL)
+	}
+
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Errorf("auth URL has no S256 challenge: %s", authURL)
+	}
+
+	if query.Get("state") != state || query.Get("nonce") == "" || query.Get("redirect_uri") != redirectURL {
+		t.Errorf("auth URL lacks state, nonce or redirect_uri: %s", authURL)
+	}
+
+	if _, _, err = client.AuthURL(context.Background(), "unknown"); err != errUnknownProvider {
+		t.Errorf("unknown provider gave %v", err)
+	}
+}
+
+func TestDiscoveryOfAnotherIssuer(t *testing.T) {
+	mock := oidctest.NewProvider("dre", "secret")
+	defer mock.Close()
+
+	// the document names mock.URL, not the configured issuer
+	client, _ := New([]Provider{{Name: "mock", Issuer: mock.URL + "/", ClientID: "dre", RedirectURL: redirectURL}})
+
+	if _, _, err := client.AuthURL(context.Background(), "mock"); err == nil {
+		t.Error("discovery document of another issuer accepted")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	client, mock := newTestClient(t)
+	mock.Claims["sub"] = "248289761001"
+	mock.Claims["email"] = "jane@corp.io"
+	mock.Claims["email_verified"] = true
+	mock.Claims["preferred_username"] = "jane"
+
+	identity, err := signIn(client, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Identity{Provider: "mock", Subject: "248289761001", Username: "jane", Email: "jane@corp.io", EmailVerified: true}
+	if identity != want {
+		t.Errorf("got %+v, want %+v", identity, want)
+	}
+}
+
+func TestExchangeChecksState(t *testing.T) {
+	client, mock := newTestClient(t)
+
+	authURL, _, _ := client.AuthURL(context.Background(), "mock")
+	callback, err := mock.Authorize(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.Exchange(context.Background(), "mock", "forged", callback.Get("code")); err != errUnknownState {
+		t.Errorf("forged state gave %v", err)
+	}
+
+	if _, err = client.Exchange(context.Background(), "mock", callback.Get("state"), callback.Get("code")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.Exchange(context.Background(), "mock", callback.Get("state"), callback.Get("code")); err != errUnknownState {
+		t.Errorf("reused state gave %v", err)
+	}
+}
+
+func TestExchangeChecksStateExpiry(t *testing.T) {
+	client, mock := newTestClient(t)
+
+	authURL, _, _ := client.AuthURL(context.Background(), "mock")
+	callback, _ := mock.Authorize(authURL)
+
+	client.mutex.Lock()
+	l := client.logins[callback.Get("state")]
+	l.expires = time.Now().Add(-time.Second)
+	client.logins[callback.Get("state")] = l
+	client.mutex.Unlock()
+
+	if _, err := client.Exchange(context.Background(), "mock", callback.Get("state"), callback.Get("code")); err != errUnknownState {
+		t.Errorf("expired state gave %v", err)
+	}
+}
+
+func TestExchangeSendsVerifier(t *testing.T) {
+	client, mock := newTestClient(t)
+
+	authURL, _, _ := client.AuthURL(context.Background(), "mock")
+	callback, _ := mock.Authorize(authURL)
+
+	// a code stolen from the redirect is useless without the verifier
+	client.mutex.Lock()
+	l := client.logins[callback.Get("state")]
+	l.verifier = randomString()
+	client.logins[callback.Get("state")] = l
+	client.mutex.Unlock()
+
+	if _, err := client.Exchange(context.Background(), "mock", callback.Get("state"), callback.Get("code")); err == nil {
+		t.Error("code exchanged with the wrong verifier")
+	}
+}
+
+func TestExchangeVerifiesIDToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(mock *oidctest.Provider)
+	}{
+		{"signed by another key", func(mock *oidctest.Provider) { mock.SigningKey = otherKey }},
+		{"for another client", func(mock *oidctest.Provider) { mock.Claims["aud"] = "other" }},
+		{"for another client among several", func(mock *oidctest.Provider) { mock.Claims["aud"] = []string{"other", "another"} }},
+		{"from another issuer", func(mock *oidctest.Provider) { mock.Claims["iss"] = "https://evil.example.com" }},
+		{"expired", func(mock *oidctest.Provider) { mock.Claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"without expiry", func(mock *oidctest.Provider) { mock.Claims["exp"] = nil }},
+		{"for another sign in", func(mock *oidctest.Provider) { mock.Claims["nonce"] = "replayed" }},
+		{"without subject", func(mock *oidctest.Provider) { mock.Claims["sub"] = "" }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, mock := newTestClient(t)
+			test.change(mock)
+
+			if identity, err := signIn(client, mock); err == nil {
+				t.Errorf("id token accepted: %+v", identity)
+			}
+		})
+	}
+
+	t.Run("for this client among several", func(t *testing.T) {
+		client, mock := newTestClient(t)
+		mock.Claims["aud"] = []string{"other", "dre"}
+
+		if _, err := signIn(client, mock); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestDomain(t *testing.T) {
+	tests := []struct {
+		email    string
+		verified bool
+		domain   string
+	}{
+		{"jane@corp.io", true, "corp.io"},
+		{"Jane@CORP.io", true, "corp.io"},
+		{"jane@corp.io", false, ""},
+		{"jane", true, ""},
+		{"", true, ""},
+	}
+
+	for _, test := range tests {
+		identity := Identity{Email: test.email, EmailVerified: test.verified}
+
+		if domain := identity.Domain(); domain != test.domain {
+			t.Errorf("Domain() of %q verified=%t is %q, want %q", test.email, test.verified, domain, test.domain)
+		}
+	}
+}
+
+func TestDomainMapsToAccount(t *testing.T) {
+	client, mock := newTestClient(t)
+	mock.Claims["email"] = "jane@corp.io"
+
+	for _, verified := range []bool{true, false} {
+		mock.Claims["email_verified"] = verified
+
+		identity, err := signIn(client, mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		provider, _ := client.Provider("mock")
+		want := 0
+		if verified {
+			want = 7
+		}
+
+		if account := provider.Domains[identity.Domain()]; account != want {
+			t.Errorf("verified=%t maps to account %d, want %d", verified, account, want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package oidctest runs a mock OIDC provider for tests, in the way of
+// net/http/httptest. It implements discovery, the authorization code flow
+// with PKCE and a key set, and signs ID tokens with claims set by the test.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// KeyID identifies the key the provider publishes
+const KeyID = "test-key"
+
+// authorization is a code issued to a user who approved a sign in
+type authorization struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+}
+
+// Provider is a mock OIDC provider listening on a local address
+type Provider struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	// Claims are added to the ID tokens issued, replacing the defaults of
+	// the same name. The defaults are iss, aud, sub, iat, exp and nonce.
+	Claims map[string]interface{}
+	// SigningKey signs ID tokens. It is the published key unless a test
+	// replaces it.
+	SigningKey *rsa.PrivateKey
+
+	published *rsa.PublicKey
+	mutex     sync.Mutex
+	codes     map[string]authorization
+}
+
+// NewProvider starts a provider for a client. It must be closed.
+func NewProvider(clientID string, clientSecret string) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	p := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Claims:       make(map[string]interface{}),
+		SigningKey:   key,
+		published:    &key.PublicKey,
+		codes:        make(map[string]authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discoveryHandler)
+	mux.HandleFunc("/authorize", p.authorizeHandler)
+	mux.HandleFunc("/token", p.tokenHandler)
+	mux.HandleFunc("/jwks", p.keysHandler)
+	p.Server = httptest.NewServer(mux)
+
+	return p
+}
+
+// Issuer returns the provider's issuer, which is its URL
+func (p *Provider) Issuer() string {
+	return p.URL
+}
+
+// Authorize plays a user approving the sign in at authURL, and returns the
+// query the provider redirects back to the client with
+func (p *Provider) Authorize(authURL string) (url.Values, error) {
+	var (
+		resp     *http.Response
+		location *url.URL
+		err      error
+		client   = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	)
+
+	if resp, err = client.Get(authURL); err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		return nil, errors.New("oidctest: authorization refused: " + resp.Status)
+	}
+
+	if location, err = resp.Location(); err != nil {
+		return nil, err
+	}
+
+	return location.Query(), nil
+}
+
+func (p *Provider) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                           p.URL,
+		"authorization_endpoint":           p.URL + "/authorize",
+		"token_endpoint":                   p.URL + "/token",
+		"jwks_uri":                         p.URL + "/jwks",
+		"response_types_supported":         []string{"code"},
+		"code_challenge_methods_supported": []string{"S256"},
+	})
+}
+
+// authorizeHandler approves every sign in by a client that asks for a code
+// with an S256 challenge
+func (p *Provider) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if query.Get("client_id") != p.ClientID || query.Get("response_type") != "code" ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" ||
+		query.Get("redirect_uri") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+
+	p.mutex.Lock()
+	p.codes[code] = authorization{
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+	}
+	p.mutex.Unlock()
+
+	redirect, _ := url.Parse(query.Get("redirect_uri"))
+	redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// tokenHandler exchanges a code for tokens once, given the client's
+// credentials and the verifier of the code's challenge
+func (p *Provider) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	p.mutex.Lock()
+	auth, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mutex.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+
+	switch {
+	case r.PostForm.Get("client_id") != p.ClientID || r.PostForm.Get("client_secret") != p.ClientSecret:
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+	case r.PostForm.Get("grant_type") != "authorization_code" || !ok ||
+		r.PostForm.Get("redirect_uri") != auth.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != auth.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{
+			"access_token": randomString(),
+			"token_type":   "Bearer",
+			"id_token":     p.idToken(auth.nonce),
+		})
+	}
+}
+
+func (p *Provider) keysHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": KeyID,
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.published.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.published.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *Provider) idToken(nonce string) string {
+	claims := jwt.MapClaims{
+		"iss":   p.URL,
+		"aud":   p.ClientID,
+		"sub":   "subject",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+
+	for name, value := range p.Claims {
+		claims[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = KeyID
+
+	signed, err := token.SignedString(p.SigningKey)
+	if err != nil {
+		panic(err)
+	}
+
+	return signed
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,344 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rsa"
+	"dre/utils"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// discovery is the part of an OIDC discovery document that is used
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type provider struct {
+	Provider
+	client    *http.Client
+	mutex     sync.Mutex
+	discovery *discovery
+	keys      map[string]*rsa.PublicKey
+}
+
+func (p *provider) scopes() []string {
+	if len(p.Scopes) > 0 {
+		return p.Scopes
+	}
+
+	if p.Type == TypeGitHub {
+		return []string{"read:user", "user:email"}
+	}
+
+	return []string{"openid", "email", "profile"}
+}
+
+func (p *provider) authEndpoint(ctx context.Context) (string, error) {
+	if p.Type == TypeGitHub {
+		return orDefault(p.AuthURL, "https://github.com/login/oauth/authorize"), nil
+	}
+
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return d.AuthorizationEndpoint, nil
+}
+
+// discover fetches and caches the provider's discovery document
+func (p *provider) discover(ctx context.Context) (*discovery, error) {
+	var (
+		d   discovery
+		err error
+	)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	address := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err = p.getJSON(ctx, address, "", &d); err != nil {
+		return nil, err
+	}
+
+	if d.Issuer != p.Issuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: invalid discovery document for %s", p.Issuer)
+	}
+
+	p.discovery = &d
+
+	return p.discovery, nil
+}
+
+func (p *provider) exchange(ctx context.Context, code string, l login) (Identity, error) {
+	var (
+		tokens struct {
+			AccessToken string `json:"access_token"`
+			IDToken     string `json:"id_token"`
+			Error       string `json:"error"`
+		}
+		tokenURL string
+		d        *discovery
+		err      error
+	)
+
+	if p.Type == TypeGitHub {
+		tokenURL = orDefault(p.TokenURL, "https://github.com/login/oauth/access_token")
+	} else if d, err = p.discover(ctx); err != nil {
+		return Identity{}, err
+	} else {
+		tokenURL = d.TokenEndpoint
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code_verifier": {l.verifier},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err = p.doJSON(req.WithContext(ctx), &tokens); err != nil {
+		return Identity{}, err
+	}
+
+	if tokens.Error != "" || tokens.AccessToken == "" {
+		return Identity{}, fmt.Errorf("oidc: code not exchanged: %s", tokens.Error)
+	}
+
+	if p.Type == TypeGitHub {
+		return p.githubIdentity(ctx, tokens.AccessToken)
+	}
+
+	return p.verify(ctx, d, tokens.IDToken, l.nonce)
+}
+
+// verify checks an ID token's signature, issuer, audience, expiry and nonce
+// and returns the identity it describes
+func (p *provider) verify(ctx context.Context, d *discovery, idToken string, nonce string) (Identity, error) {
+	var (
+		token  *jwt.Token
+		claims jwt.MapClaims
+		ok     bool
+		err    error
+	)
+
+	token, err = jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, d, kid)
+	})
+
+	if err != nil {
+		return Identity{}, utils.Error(err, "oidc: id token not verified")
+	}
+
+	if claims, ok = token.Claims.(jwt.MapClaims); !ok || !token.Valid || claims["exp"] == nil {
+		return Identity{}, errors.New("oidc: invalid id token")
+	}
+
+	if !claims.VerifyIssuer(d.Issuer, true) || !hasAudience(claims, p.ClientID) {
+		return Identity{}, errors.New("oidc: id token is for another issuer or client")
+	}
+
+	if claims["nonce"] != nonce {
+		return Identity{}, errors.New("oidc: id token nonce mismatch")
+	}
+
+	identity := Identity{Provider: p.Name}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	identity.Username, _ = claims["preferred_username"].(string)
+
+	if identity.Subject == "" {
+		return Identity{}, errors.New("oidc: id token has no subject")
+	}
+
+	return identity, nil
+}
+
+// key returns the provider's signing key with kid, refetching the key set
+// once if the key is unknown in case the provider rotated its keys
+func (p *provider) key(ctx context.Context, d *discovery, kid string) (*rsa.PublicKey, error) {
+	var (
+		set struct {
+			Keys []jwk `json:"keys"`
+		}
+		err error
+	)
+
+	p.mutex.Lock()
+	key, ok := p.keys[kid]
+	p.mutex.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	if err = p.getJSON(ctx, d.JWKSURI, "", &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, nErr := base64.RawURLEncoding.DecodeString(k.N)
+		e, eErr := base64.RawURLEncoding.DecodeString(k.E)
+		if nErr != nil || eErr != nil {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	p.mutex.Lock()
+	p.keys = keys
+	p.mutex.Unlock()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+	}
+
+	return key, nil
+}
+
+func (p *provider) githubIdentity(ctx context.Context, accessToken string) (Identity, error) {
+	var (
+		user struct {
+			ID    int64  `json:"id"`
+			Login string `json:"login"`
+		}
+		emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		userURL = orDefault(p.UserInfoURL, "https://api.github.com/user")
+		err     error
+	)
+
+	if err = p.getJSON(ctx, userURL, accessToken, &user); err != nil {
+		return Identity{}, err
+	}
+
+	if err = p.getJSON(ctx, userURL+"/emails", accessToken, &emails); err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{Provider: p.Name, Subject: fmt.Sprint(user.ID), Username: user.Login}
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = email.Email
+			identity.EmailVerified = email.Verified
+		}
+	}
+
+	if user.ID == 0 {
+		return Identity{}, errors.New("oidc: github user has no id")
+	}
+
+	return identity, nil
+}
+
+func (p *provider) getJSON(ctx context.Context, address string, accessToken string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, address, nil)
+	if err != nil {
+		return err
+	}
+
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	return p.doJSON(req.WithContext(ctx), v)
+}
+
+func (p *provider) doJSON(req *http.Request, v interface{}) error {
+	var (
+		resp *http.Response
+		body []byte
+		err  error
+	)
+
+	req.Header.Set("Accept", "application/json")
+
+	if resp, err = p.client.Do(req); err != nil {
+		return utils.Error(err, "oidc: request to "+req.URL.Host+" failed")
+	}
+	defer resp.Body.Close()
+
+	if body, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+		return utils.Error(err, "oidc: response not read")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s returned %s", req.URL, resp.Status)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// hasAudience reports whether aud, a string or an array of strings,
+// contains clientID
+func hasAudience(claims jwt.MapClaims, clientID string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
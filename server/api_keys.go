@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"dre/db"
+	"encoding/json"
+	"net/http"
+)
+
+type apiKeyParameters struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"`
+}
+
+// apiKeysHandler lists, creates and revokes the API keys of the user's
+// account. API keys can't be used to manage API keys.
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := apiKeyFromContext(r.Context()); ok {
+		http.Error(w, "API keys can't manage API keys", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		listAPIKeysHandler(w, r)
+	case http.MethodPost:
+		createAPIKeyHandler(w, r)
+	case http.MethodDelete:
+		revokeAPIKeyHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err  error
+		keys []db.APIKey
+		ctx  = r.Context()
+	)
+
+	if keys, err = dbFromContext(ctx).FindAPIKeys(userFromContext(ctx).AccountID); err != nil {
+		logger(r).Error("find API keys failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		params apiKeyParameters
+		err    error
+		key    db.APIKey
+		user   db.User
+		ctx    context.Context
+	)
+
+	ctx = r.Context()
+	user = userFromContext(ctx)
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if params.Name == "" || len(params.Scopes) == 0 || params.ExpiresIn < 0 {
+		http.Error(w, "API keys need a name and scopes", http.StatusBadRequest)
+		return
+	}
+
+	for _, scope := range params.Scopes {
+		if !db.ValidScope(scope) {
+			http.Error(w, "Unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if key, err = dbFromContext(ctx).CreateAPIKey(&user, params.Name, params.Scopes, params.ExpiresIn); err != nil {
+		logger(r).Error("create API key failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, db.AuditAPIKeyCreated, key.UUID, map[string]interface{}{"name": key.Name, "scopes": params.Scopes})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+		ctx = r.Context()
+	)
+
+	if err = dbFromContext(ctx).RevokeAPIKey(userFromContext(ctx).AccountID, r.URL.Query().Get("id")); err != nil {
+		logger(r).Info("API key not found", "error", err)
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	audit(r, db.AuditAPIKeyRevoked, r.URL.Query().Get("id"), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"dre/db"
+	"dre/metrics"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// audit records an event by the request's user in the account the request
+// acts on. Failing to record an event is logged and doesn't fail the request.
+func audit(r *http.Request, action string, target string, details map[string]interface{}) {
+	var (
+		ctx   = r.Context()
+		user  = userFromContext(ctx)
+		event = db.AuditEvent{Action: action, Target: target}
+	)
+
+	event.AccountID = &user.AccountID
+	event.ActorID = &user.ID
+	event.Actor = user.Username
+
+	if key, ok := apiKeyFromContext(ctx); ok {
+		event.APIKey = &key.UUID
+	}
+
+	recordEvent(r, event, details)
+}
+
+// auditUser records an event by a user that isn't authenticated yet, like a
+// sign in. The event belongs to the user's default account. user may be nil
+// when nobody could be identified, in which case actor names who was tried.
+func auditUser(r *http.Request, user *db.User, actor string, action string, details map[string]interface{}) {
+	event := db.AuditEvent{Action: action, Actor: actor}
+
+	if user != nil {
+		event.AccountID = &user.AccountID
+		event.ActorID = &user.ID
+		event.Actor = user.Username
+	}
+
+	recordEvent(r, event, details)
+}
+
+// auditFailedSignIn records a failed sign in as username, which may not
+// exist
+func auditFailedSignIn(r *http.Request, username string, details map[string]interface{}) {
+	if user, err := dbFromContext(r.Context()).FindUser(username); err == nil {
+		auditUser(r, &user, username, db.AuditSignInFailed, details)
+		return
+	}
+
+	auditUser(r, nil, username, db.AuditSignInFailed, details)
+}
+
+func recordEvent(r *http.Request, event db.AuditEvent, details map[string]interface{}) {
+	switch event.Action {
+	case db.AuditSignInFailed:
+		metrics.AuthFailures.WithLabelValues("signin").Inc()
+	case db.AuditTwoFactorFailed:
+		metrics.AuthFailures.WithLabelValues("2fa").Inc()
+	}
+
+	event.IP = clientAddress(r)
+	event.UserAgent = r.UserAgent()
+
+	if err := dbFromContext(r.Context()).CreateAuditEvent(&event, details); err != nil {
+		logger(r).Error("audit event not recorded", "action", event.Action, "error", err)
+	}
+}
+
+// auditEventsHandler lists the account's audit events, newest first. Events
+// can be filtered by action, actor_id, target, since and until, and paged
+// through by passing the next_before of a response as before.
+func auditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		err    error
+		events []db.AuditEvent
+		filter db.AuditFilter
+		next   int
+		ctx    = r.Context()
+		query  = r.URL.Query()
+	)
+
+	filter.Action = query.Get("action")
+	filter.Target = query.Get("target")
+
+	for name, value := range map[string]*int{"actor_id": &filter.ActorID, "before": &filter.Before, "limit": &filter.Limit} {
+		if query.Get(name) == "" {
+			continue
+		}
+
+		if *value, err = strconv.Atoi(query.Get(name)); err != nil {
+			http.Error(w, "Invalid "+name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	for name, value := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if query.Get(name) == "" {
+			continue
+		}
+
+		if *value, err = time.Parse(time.RFC3339, query.Get(name)); err != nil {
+			http.Error(w, "Invalid "+name+", expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if events, err = dbFromContext(ctx).FindAuditEvents(userFromContext(ctx).AccountID, filter); err != nil {
+		logger(r).Error("find audit events failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if events == nil {
+		events = []db.AuditEvent{}
+	}
+
+	if filter.Limit <= 0 || filter.Limit > db.MaxAuditEvents {
+		filter.Limit = db.MaxAuditEvents
+	}
+
+	if len(events) == filter.Limit {
+		next = events[len(events)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events":      events,
+		"next_before": next,
+	})
+}
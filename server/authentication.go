@@ -3,10 +3,10 @@ package server
 import (
 	"context"
 	"dre/db"
+	"dre/metrics"
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -19,19 +19,29 @@ func signupHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		creds    = &db.Credentials{}
 		err      error
-		database *db.DB
+		database db.Store
 		user     db.User
 	)
 
 	if err = json.NewDecoder(r.Body).Decode(creds); err != nil {
-		log.Println(err)
+		logger(r).Info("invalid request body", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	if err = db.CheckPassword(creds.Username, creds.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	database = dbFromContext(r.Context())
-	if user, err = database.CreateUser(creds.Username, creds.Password); err != nil {
-		log.Println(err)
+	if user, err = database.CreateUser(creds.Username, creds.Password, creds.Email); err != nil {
+		if err == db.ErrUserTaken {
+			http.Error(w, "Username or email is taken", http.StatusConflict)
+			return
+		}
+
+		logger(r).Error("create user failed", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -49,59 +59,228 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		creds    = &db.Credentials{}
 		err      error
-		database *db.DB
+		database db.Store
 		user     db.User
-		token    string
 	)
 
 	if err = json.NewDecoder(r.Body).Decode(creds); err != nil {
-		fmt.Println(err)
+		logger(r).Info("invalid request body", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	if !checkLogin(w, r, creds.Username) {
+		auditFailedSignIn(r, creds.Username, map[string]interface{}{"method": "password", "reason": "locked out"})
+		return
+	}
+
 	database = dbFromContext(r.Context())
-	user, err = database.SignInUser(creds.Username, creds.Password)
-	token, err = db.CreateToken(&user)
+	if user, err = database.SignInUser(creds.Username, creds.Password); err == db.ErrUserDisabled {
+		auditFailedSignIn(r, creds.Username, map[string]interface{}{"method": "password", "reason": "disabled"})
+		http.Error(w, "User is disabled", http.StatusForbidden)
+		return
+	} else if err != nil {
+		logger(r).Info("sign in failed", "error", err)
+		failLogin(r, creds.Username)
+		auditFailedSignIn(r, creds.Username, map[string]interface{}{"method": "password"})
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	usernameThrottle.reset(creds.Username)
+
+	signIn(w, r, user, map[string]interface{}{"method": "password"})
+}
+
+type refreshParameters struct {
+	RefreshToken string `json:"refresh_token"`
+	All          bool   `json:"all"`
+}
+
+// refreshHandler exchanges a refresh token for new tokens
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		params refreshParameters
+		err    error
+		tokens db.Tokens
+	)
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if tokens, err = dbFromContext(r.Context()).RefreshTokens(params.RefreshToken); err != nil {
+		logger(r).Info("refresh tokens failed", "error", err)
+		metrics.AuthFailures.WithLabelValues("refresh").Inc()
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// signoutHandler revokes a refresh token along with the access tokens issued
+// with it, or every token of the user when all is set
+func signoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		params   refreshParameters
+		err      error
+		user     db.User
+		database db.Store
+	)
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user = userFromContext(r.Context())
+	database = dbFromContext(r.Context())
+
+	if params.All {
+		err = database.RevokeUserTokens(&user)
+	} else {
+		err = database.RevokeRefreshToken(&user, params.RefreshToken)
+	}
+
+	if err != nil {
+		logger(r).Info("revoke tokens failed", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	audit(r, db.AuditSignOut, "", map[string]interface{}{"all": params.All})
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 const userKey = "USER_KEY"
 
 func authenticateMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("start authenticateMiddleware")
-
 		var (
 			user          db.User
 			authorization string
 			token         string
 			err           error
-			database      *db.DB
+			database      db.Store
+			membership    db.Membership
 		)
 
-		if authorization = r.Header.Get("Authorization"); authorization == "" {
+		authorization = r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			metrics.AuthFailures.WithLabelValues("token").Inc()
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
 		database = dbFromContext(r.Context())
-		token = strings.Split(authorization, "Bearer ")[1]
+		token = strings.TrimPrefix(authorization, "Bearer ")
+		ctx := r.Context()
+
+		if strings.HasPrefix(token, db.APIKeyPrefix) {
+			var key db.APIKey
 
-		if user, err = database.AuthenticateToken(token); err != nil {
-			fmt.Println(err)
+			if key, user, err = database.AuthenticateAPIKey(token); err != nil {
+				logger(r).Info("authenticate API key failed", "error", err)
+				metrics.AuthFailures.WithLabelValues("api_key").Inc()
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			ctx = context.WithValue(ctx, apiKeyKey, key)
+			user.AccountID = key.AccountID
+		} else if user, err = database.AuthenticateToken(token); err != nil {
+			logger(r).Info("authenticate token failed", "error", err)
+			metrics.AuthFailures.WithLabelValues("token").Inc()
 			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if header := r.Header.Get("X-Account-ID"); header != "" {
+			if user.AccountID, err = strconv.Atoi(header); err != nil {
+				http.Error(w, "Invalid X-Account-ID", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// user.AccountID is the account the request acts on
+		if membership, err = database.FindMembership(user.AccountID, user.ID); err != nil {
+			logger(r).Info("not a member of the account", "error", err)
+			http.Error(w, "Not a member of the account", http.StatusForbidden)
+			return
+		}
+
+		_, apiKey := apiKeyFromContext(ctx)
+		if !checkSecondFactor(w, r, user, membership, apiKey) {
+			return
 		}
 
-		ctx := context.WithValue(r.Context(), userKey, user)
-		next(w, r.WithContext(ctx))
+		ctx = context.WithValue(ctx, membershipKey, membership)
+		ctx = context.WithValue(ctx, userKey, user)
+		r = withLogFields(r.WithContext(ctx), "user_id", user.ID, "account_id", user.AccountID)
 
-		log.Println("end authenticateMiddleware")
+		if apiKey {
+			audit(r, db.AuditAPIKeyUsed, r.URL.Path, map[string]interface{}{"method": r.Method})
+		}
+
+		next(w, r)
 	}
 }
 
 func userFromContext(ctx context.Context) db.User {
 	return ctx.Value(userKey).(db.User)
 }
+
+const apiKeyKey = "API_KEY_KEY"
+
+// apiKeyFromContext returns the API key that authenticated a request, if
+// it wasn't authenticated by an access token
+func apiKeyFromContext(ctx context.Context) (db.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyKey).(db.APIKey)
+	return key, ok
+}
+
+// scopeMiddleware rejects requests authenticated by an API key without
+// scope. Access tokens are allowed everything.
+func scopeMiddleware(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := apiKeyFromContext(r.Context()); ok && !key.HasScope(scope) {
+			http.Error(w, "API key lacks scope "+scope, http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+const membershipKey = "MEMBERSHIP_KEY"
+
+// membershipFromContext returns the membership of the user in the account
+// the request acts on
+func membershipFromContext(ctx context.Context) db.Membership {
+	return ctx.Value(membershipKey).(db.Membership)
+}
+
+// roleMiddleware rejects requests from members whose role is below role
+func roleMiddleware(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !db.RoleAtLeast(membershipFromContext(r.Context()).Role, role) {
+			http.Error(w, "Requires role "+role, http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
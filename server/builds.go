@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"dre/builds"
+	"dre/db"
+	"encoding/json"
+	"net/http"
+)
+
+// buildsHandler returns the status and logs of a build. With wait=true it
+// blocks until the build has finished or the client goes away.
+func buildsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		err   error
+		build db.Build
+		queue *builds.Queue
+		ctx   context.Context
+		id    string
+	)
+
+	ctx = r.Context()
+	queue = queueFromContext(ctx)
+
+	if id = r.URL.Query().Get("id"); id == "" {
+		http.Error(w, "No id", http.StatusBadRequest)
+		return
+	}
+
+	build, err = dbFromContext(ctx).FindAccountBuild(userFromContext(ctx).AccountID, id)
+	if err == nil && r.URL.Query().Get("wait") == "true" {
+		build, err = queue.Wait(ctx, id)
+	}
+
+	if err != nil {
+		logger(r).Info("build not found", "error", err)
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(build)
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"archive/tar"
+	"context"
+	"dre/db"
+	"dre/docker"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+)
+
+// Size limits for files copied in and out of containers
+var (
+	maxUploadSize   int64 = 64 << 20
+	maxDownloadSize int64 = 256 << 20
+)
+
+var errTooLarge = errors.New("server: file too large")
+
+// filesHandler copies files in and out of a running container. Uploads are
+// either a tar archive extracted into path (Content-Type application/x-tar)
+// or a single file written to path. Downloads return a single file as is and
+// a directory as a tar archive.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err   error
+		ctr   db.Container
+		ctx   context.Context
+		query = r.URL.Query()
+	)
+
+	ctx = r.Context()
+
+	if query.Get("path") == "" || !path.IsAbs(query.Get("path")) {
+		http.Error(w, "No absolute path", http.StatusBadRequest)
+		return
+	}
+
+	if ctr, err = findAccountContainer(ctx, query.Get("container_id")); err != nil {
+		logger(r).Info("container not found", "error", err)
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+
+	if containerPool.get(ctr.UUID) == nil {
+		http.Error(w, "Container is not running", http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		audit(r, db.AuditFilesDownloaded, ctr.UUID, map[string]interface{}{"path": path.Clean(query.Get("path"))})
+		downloadFile(w, r, ctr, path.Clean(query.Get("path")))
+	case http.MethodPost, http.MethodPut:
+		if !db.RoleAtLeast(membershipFromContext(ctx).Role, db.RoleMember) {
+			http.Error(w, "Requires role member", http.StatusForbidden)
+			return
+		}
+
+		uploadFile(w, r, ctr, path.Clean(query.Get("path")))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func uploadFile(w http.ResponseWriter, r *http.Request, ctr db.Container, target string) {
+	var (
+		err  error
+		body *os.File
+		dir  = target
+	)
+
+	if body, err = spool(r.Body, maxUploadSize); err != nil {
+		logger(r).Info("file too large", "error", err)
+
+		if err == errTooLarge {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "File could not be read", http.StatusBadRequest)
+		}
+
+		return
+	}
+	defer os.Remove(body.Name())
+	defer body.Close()
+
+	if r.Header.Get("Content-Type") == "application/x-tar" {
+		err = docker.CopyTo(ctr.UUID, dir, body)
+	} else {
+		dir = path.Dir(target)
+		err = docker.CopyTo(ctr.UUID, dir, tarFile(body, path.Base(target)))
+	}
+
+	if err != nil {
+		logger(r).Error("file could not be copied", "error", err)
+		http.Error(w, "File could not be copied", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, db.AuditFilesUploaded, ctr.UUID, map[string]interface{}{"path": target})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func downloadFile(w http.ResponseWriter, r *http.Request, ctr db.Container, source string) {
+	var (
+		err     error
+		archive io.ReadCloser
+		reader  *tar.Reader
+		writer  *tar.Writer
+		header  *tar.Header
+		total   int64
+		size    int64
+	)
+
+	if archive, err = docker.CopyFrom(ctr.UUID, source); err != nil {
+		logger(r).Error("file could not be copied", "error", err)
+		http.Error(w, "File could not be copied", http.StatusInternalServerError)
+		return
+	}
+	defer archive.Close()
+
+	reader = tar.NewReader(archive)
+	if header, err = reader.Next(); err != nil {
+		logger(r).Info("file not found", "error", err)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if header.Typeflag == tar.TypeReg {
+		if header.Size > maxDownloadSize {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(header.Size, 10))
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(path.Base(source)))
+		io.Copy(w, reader)
+		return
+	}
+
+	// directories are measured first, since the archive can't be cut short
+	// once the response has started. Those that can't be measured are still
+	// cut short below.
+	if size, err = docker.Size(ctr.UUID, source); err != nil {
+		logger(r).Warn("download not measured", "path", source, "error", err)
+	} else if size > maxDownloadSize {
+		http.Error(w, "Directory too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(path.Base(source)+".tar"))
+
+	writer = tar.NewWriter(w)
+	for err = nil; err == nil; header, err = reader.Next() {
+		if total += header.Size; total > maxDownloadSize {
+			// the response has started so the archive can only be cut short
+			logger(r).Warn("download exceeded size limit", "path", source)
+			return
+		}
+
+		if err = writer.WriteHeader(header); err != nil {
+			break
+		}
+
+		if _, err = io.Copy(writer, reader); err != nil {
+			break
+		}
+	}
+
+	if err != io.EOF {
+		logger(r).Error("download failed", "path", source, "error", err)
+		return
+	}
+
+	writer.Close()
+}
+
+// spool copies up to limit bytes of r to a temporary file and rewinds it
+func spool(r io.Reader, limit int64) (*os.File, error) {
+	var (
+		file *os.File
+		n    int64
+		err  error
+	)
+
+	if file, err = ioutil.TempFile("", "dre-upload-"); err != nil {
+		return nil, err
+	}
+
+	if n, err = io.Copy(file, io.LimitReader(r, limit+1)); err == nil && n > limit {
+		err = errTooLarge
+	}
+
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// tarFile returns a tar archive containing file under name
+func tarFile(file *os.File, name string) io.Reader {
+	reader, writer := io.Pipe()
+
+	go func() {
+		var (
+			info os.FileInfo
+			err  error
+		)
+
+		if info, err = file.Stat(); err != nil {
+			writer.CloseWithError(err)
+			return
+		}
+
+		tw := tar.NewWriter(writer)
+		header := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}
+
+		if err = tw.WriteHeader(header); err == nil {
+			if _, err = io.Copy(tw, file); err == nil {
+				err = tw.Close()
+			}
+		}
+
+		writer.CloseWithError(err)
+	}()
+
+	return reader
+}
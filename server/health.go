@@ -0,0 +1,169 @@
+package server
+
+import (
+	"dre/docker"
+	"dre/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Limits on what the server takes on, set from the config
+var (
+	// MaxSessions is how many sessions the server runs at once, 0 for no
+	// limit
+	MaxSessions int
+	// MinFreeDiskMB is the free disk builds need to be ready
+	MinFreeDiskMB = 1024
+)
+
+// readyTimeout is how long the readiness checks have, together
+const readyTimeout = 5 * time.Second
+
+// check reports whether one thing the server needs is fine, with details
+// like how much of it is left
+type check func() (map[string]interface{}, error)
+
+// healthHandler reports that the process is up and serving requests
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyHandler reports whether the server can serve sessions, responding
+// 503 with the failed checks if not
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	type result struct {
+		name    string
+		details map[string]interface{}
+	}
+
+	var (
+		checks  = s.readyChecks()
+		results = make(chan result, len(checks))
+		report  = make(map[string]interface{}, len(checks))
+		ready   = true
+		timeout = time.After(readyTimeout)
+	)
+
+	for name, c := range checks {
+		go func(name string, c check) {
+			details, err := c()
+			if details == nil {
+				details = make(map[string]interface{})
+			}
+
+			details["ok"] = err == nil
+			if err != nil {
+				// wrapped errors end their messages with newlines
+				details["error"] = strings.Replace(err.Error(), "\n", "", -1)
+			}
+
+			results <- result{name, details}
+		}(name, c)
+	}
+
+	for len(report) < len(checks) {
+		select {
+		case res := <-results:
+			report[res.name] = res.details
+			ready = ready && res.details["ok"].(bool)
+		case <-timeout:
+			for name := range checks {
+				if _, ok := report[name]; !ok {
+					report[name] = map[string]interface{}{"ok": false, "error": "timed out after " + readyTimeout.String()}
+				}
+			}
+			ready = false
+		}
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": ready, "checks": report})
+}
+
+// readyChecks returns the checks /readyz runs by name
+func (s *Server) readyChecks() map[string]check {
+	return map[string]check{
+		"database": func() (map[string]interface{}, error) {
+			return nil, s.database.Ping()
+		},
+		"schema": func() (map[string]interface{}, error) {
+			return nil, s.database.CheckSchema()
+		},
+		"docker": func() (map[string]interface{}, error) {
+			version, err := docker.Version()
+			if err != nil {
+				return nil, err
+			}
+
+			return map[string]interface{}{"version": version}, nil
+		},
+		"disk":     checkDisk,
+		"sessions": checkSessions,
+	}
+}
+
+// checkDisk checks there is room left to download and extract sources
+func checkDisk() (map[string]interface{}, error) {
+	var (
+		err  error
+		free uint64
+	)
+
+	if err = os.MkdirAll(docker.BuildDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if free, err = utils.FreeSpace(docker.BuildDir); err != nil {
+		return nil, err
+	}
+
+	details := map[string]interface{}{
+		"path":        docker.BuildDir,
+		"free_mb":     free >> 20,
+		"min_free_mb": MinFreeDiskMB,
+	}
+
+	if free>>20 < uint64(MinFreeDiskMB) {
+		return details, fmt.Errorf("%d MB free, %d MB needed", free>>20, MinFreeDiskMB)
+	}
+
+	return details, nil
+}
+
+// checkSessions checks the server can take on another session
+func checkSessions() (map[string]interface{}, error) {
+	active := containerPool.len()
+	details := map[string]interface{}{"active": active, "max": MaxSessions}
+
+	if containerPool.isDraining() {
+		return details, errors.New("server is shutting down")
+	}
+
+	if containerPool.full() {
+		return details, errors.New("server is at capacity")
+	}
+
+	return details, nil
+}
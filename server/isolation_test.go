@@ -0,0 +1,199 @@
+package server
+
+import (
+	"dre/db"
+	"dre/notify"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testServer is a server on an in-memory database with two accounts. Alice's
+// account has an image, a container and a build; Bob's has nothing.
+type testServer struct {
+	handler   http.Handler
+	database  db.DB
+	alice     string
+	bob       string
+	container db.Container
+	build     db.Build
+}
+
+func newTestServer(t *testing.T) testServer {
+	var (
+		ts    testServer
+		err   error
+		user  db.User
+		image db.Image
+	)
+
+	db.SetSigningKeys(db.RandomSigningKeys())
+	PreviewURL, _ = url.Parse("http://preview.localhost")
+
+	if ts.database, err = db.Connect(db.DialectSQLite, ":memory:", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ts.database.Migrate(true, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.alice = signedIn(t, ts.database, "alice")
+	ts.bob = signedIn(t, ts.database, "bob")
+
+	if user, err = ts.database.FindUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if image, err = ts.database.CreateImage(user, "http://example.com/source.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ts.build, err = ts.database.CreateBuild(image.SourceURL); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ts.database.SetImageBuild(&image, &ts.build); err != nil {
+		t.Fatal(err)
+	}
+
+	if ts.container, err = ts.database.CreateContainer(&image); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(&ts.database, nil, nil, notify.LogNotifier{})
+	ts.handler = s.handler(t.TempDir())
+
+	return ts
+}
+
+// signedIn creates a user with an account of their own and returns their
+// access token
+func signedIn(t *testing.T, database db.DB, username string) string {
+	user, err := database.CreateUser(username, "correct-horse-9", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := database.CreateTokens(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tokens.AccessToken
+}
+
+// do sends a request with token and returns the response
+func (ts testServer) do(method string, target string, body string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	ts.handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestOtherAccountsAreNotFound(t *testing.T) {
+	ts := newTestServer(t)
+	ctr := ts.container.UUID
+
+	requests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{"build", http.MethodGet, "/v1/builds?id=" + ts.build.UUID, ""},
+		{"download file", http.MethodGet, "/v1/files?container_id=" + ctr + "&path=/etc/hostname", ""},
+		{"upload file", http.MethodPut, "/v1/files?container_id=" + ctr + "&path=/tmp/x", "x"},
+		{"ports", http.MethodGet, "/v1/ports?container_id=" + ctr, ""},
+		{"preview", http.MethodPost, "/v1/previews", `{"container_id":"` + ctr + `","port":8080}`},
+		{"snapshot", http.MethodPost, "/v1/snapshots", `{"container_id":"` + ctr + `"}`},
+		{"pty", http.MethodGet, "/v1/pty?container_id=" + ctr, ""},
+		// last, since Alice deletes the container
+		{"delete container", http.MethodDelete, "/v1/containers?id=" + ctr, ""},
+	}
+
+	for _, req := range requests {
+		t.Run(req.name, func(t *testing.T) {
+			if w := ts.do(req.method, req.target, req.body, ts.bob); w.Code != http.StatusNotFound {
+				t.Errorf("other account got %d, want 404: %s", w.Code, w.Body)
+			}
+
+			// Alice gets past the account check, whatever fails after it
+			if w := ts.do(req.method, req.target, req.body, ts.alice); w.Code == http.StatusNotFound {
+				t.Errorf("owner got 404: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestOtherAccountsContainersAreNotListed(t *testing.T) {
+	ts := newTestServer(t)
+
+	w := ts.do(http.MethodGet, "/v1/containers", "", ts.bob)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	if strings.Contains(w.Body.String(), ts.container.UUID) {
+		t.Errorf("other account's container listed: %s", w.Body)
+	}
+}
+
+func TestTicketsForOtherAccountsContainersAreNotFound(t *testing.T) {
+	ts := newTestServer(t)
+
+	w := ts.do(http.MethodPost, "/v1/pty/tickets", "", ts.bob)
+	if w.Code != http.StatusOK {
+		t.Fatalf("ticket not issued, got %d: %s", w.Code, w.Body)
+	}
+
+	ticket := strings.Split(strings.Split(w.Body.String(), `"ticket":"`)[1], `"`)[0]
+
+	w = ts.do(http.MethodGet, "/v1/pty?ticket="+ticket+"&container_id="+ts.container.UUID, "", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d, want 404: %s", w.Code, w.Body)
+	}
+}
+
+func TestAPIKeysListOnlyTheirAccount(t *testing.T) {
+	ts := newTestServer(t)
+
+	alice, _ := ts.database.FindUser("alice")
+	bob, _ := ts.database.FindUser("bob")
+
+	if _, err := ts.database.CreateMembership(bob.AccountID, alice.ID, db.RoleMember); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ts.database.CreateAPIKey(&alice, "ci", []string{db.ScopeRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// accounts lists the accounts token can see
+	accounts := func(token string) []db.Membership {
+		var memberships []db.Membership
+
+		w := ts.do(http.MethodGet, "/v1/accounts", "", token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+
+		json.NewDecoder(w.Body).Decode(&memberships)
+		return memberships
+	}
+
+	if memberships := accounts(ts.alice); len(memberships) != 2 {
+		t.Errorf("user listed %d accounts, want 2", len(memberships))
+	}
+
+	if memberships := accounts(key.Key); len(memberships) != 1 || memberships[0].AccountID != alice.AccountID {
+		t.Errorf("API key listed %+v, want only its account %d", memberships, alice.AccountID)
+	}
+}
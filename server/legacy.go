@@ -4,28 +4,62 @@ import (
 	"context"
 	"dre/db"
 	"dre/docker"
+	"dre/metrics"
 	"dre/streams"
+	"dre/tracing"
 	"dre/ws"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func containersHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+	switch r.Method {
+	case http.MethodGet:
+		scopeMiddleware(db.ScopeRead, listContainersHandler)(w, r)
+	case http.MethodPost:
+		scopeMiddleware(db.ScopeContainersCreate, roleMiddleware(db.RoleMember, createContainerHandler))(w, r)
+	case http.MethodDelete:
+		scopeMiddleware(db.ScopeContainersDelete, roleMiddleware(db.RoleMember, deleteContainerHandler))(w, r)
+	default:
 		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// listContainersHandler lists the containers of the user's account
+func listContainersHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err        error
+		containers []db.Container
+		ctx        = r.Context()
+	)
+
+	if containers, err = dbFromContext(ctx).FindAccountContainers(userFromContext(ctx).AccountID); err != nil {
+		logger(r).Error("find account containers failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	for i := range containers {
+		containers[i].Running = containerPool.get(containers[i].UUID) != nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(containers)
+}
+
+func createContainerHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		params    parameters
-		database  *db.DB
+		database  db.Store
 		err       error
 		image     db.Image
 		container db.Container
+		build     db.Build
 		user      db.User
 		ctx       context.Context
 	)
@@ -35,108 +69,324 @@ func containersHandler(w http.ResponseWriter, r *http.Request) {
 	database = dbFromContext(ctx)
 
 	if params, err = parseJSON(r); err != nil {
-		fmt.Println(err)
+		logger(r).Info("invalid request body", "error", err)
+	}
+
+	if params.VolumeQuotaMB != 0 && !params.Persistent {
+		http.Error(w, "volume_quota_mb requires persistent", http.StatusBadRequest)
+		return
 	}
 
-	if image, err = database.CreateImage(user, params.SourceURL); err != nil {
-		fmt.Println(err)
+	if params.VolumeQuotaMB < 0 || params.VolumeQuotaMB > MaxVolumeQuotaMB {
+		http.Error(w, fmt.Sprintf("volume_quota_mb must be between 1 and %d, or 0 for the default", MaxVolumeQuotaMB), http.StatusBadRequest)
+		return
+	}
+
+	if params.ImageID != "" {
+		if image, err = database.FindAccountImage(user.AccountID, params.ImageID); err != nil {
+			logger(r).Info("image not found", "error", err)
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+	} else if image, build, err = createSourceImage(ctx, params.SourceURL); err != nil {
+		logger(r).Error("build could not be queued", "error", err)
+		http.Error(w, "Build could not be queued", http.StatusServiceUnavailable)
+		return
 	}
 
 	if container, err = database.CreateContainer(&image); err != nil {
-		fmt.Println(err)
+		logger(r).Error("container could not be created", "error", err)
+		http.Error(w, "Container could not be created", http.StatusInternalServerError)
+		return
+	}
+
+	if params.Persistent {
+		volume := docker.VolumeName(container.UUID)
+
+		if err = docker.CreateVolume(volume); err != nil {
+			logger(r).Error("workspace could not be created", "error", err)
+			http.Error(w, "Workspace could not be created", http.StatusInternalServerError)
+			return
+		}
+
+		if err = database.SetContainerVolume(&container, volume, params.VolumeQuotaMB); err != nil {
+			logger(r).Error("workspace could not be created", "error", err)
+			http.Error(w, "Workspace could not be created", http.StatusInternalServerError)
+			return
+		}
 	}
 
+	audit(r, db.AuditContainerCreated, container.UUID, map[string]interface{}{
+		"image_id":   image.UUID,
+		"persistent": container.Persistent(),
+	})
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(container)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"container": container,
+		"build":     build,
+		"image":     image,
+	})
+}
+
+// deleteContainerHandler deletes a container that isn't running along with
+// its workspace volume
+func deleteContainerHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err      error
+		ctr      db.Container
+		database db.Store
+		id       string
+	)
+
+	database = dbFromContext(r.Context())
+
+	if id = r.URL.Query().Get("id"); id == "" {
+		http.Error(w, "No id", http.StatusBadRequest)
+		return
+	}
+
+	if ctr, err = findAccountContainer(r.Context(), id); err != nil {
+		logger(r).Info("container not found", "error", err)
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+
+	if containerPool.get(ctr.UUID) != nil {
+		http.Error(w, "Container is running", http.StatusConflict)
+		return
+	}
+
+	if ctr.Persistent() {
+		if err = docker.RemoveVolume(ctr.Volume); err != nil {
+			logger(r).Error("workspace could not be deleted", "error", err)
+			http.Error(w, "Workspace could not be deleted", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = database.DeleteContainer(&ctr); err != nil {
+		logger(r).Error("container could not be deleted", "error", err)
+		http.Error(w, "Container could not be deleted", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, db.AuditContainerDeleted, ctr.UUID, nil)
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func legacyPtyHandler(w http.ResponseWriter, r *http.Request) {
+// createSourceImage creates an image of the user's account for a source URL
+// and queues its build
+func createSourceImage(ctx context.Context, sourceURL string) (db.Image, db.Build, error) {
+	var (
+		database = dbFromContext(ctx)
+		image    db.Image
+		build    db.Build
+		err      error
+	)
+
+	if image, err = database.CreateImage(userFromContext(ctx), sourceURL); err != nil {
+		return db.Image{}, db.Build{}, err
+	}
+
+	if build, err = queueFromContext(ctx).Enqueue(ctx, sourceURL); err != nil {
+		return db.Image{}, db.Build{}, err
+	}
+
+	if err = database.SetImageBuild(&image, &build); err != nil {
+		return db.Image{}, db.Build{}, err
+	}
+
+	return image, build, nil
+}
+
+// createSourceContainer creates a container of the user's account for a
+// source URL
+func createSourceContainer(ctx context.Context, sourceURL string) (db.Container, error) {
+	var (
+		image db.Image
+		err   error
+	)
+
+	if image, _, err = createSourceImage(ctx, sourceURL); err != nil {
+		return db.Container{}, err
+	}
+
+	return dbFromContext(ctx).CreateContainer(&image)
+}
+
+// attachContainer connects the request's websocket to a container, starting
+// the container if it isn't running. Viewers can only watch running
+// containers.
+func attachContainer(w http.ResponseWriter, r *http.Request, ctr db.Container) {
 	var (
 		err       error
 		pty       docker.Pty
 		dctr      docker.Container
 		webSocket ws.WS
-		params    parameters
 		adapter   *streams.Adapter
-		ctr       db.Container
-		database  *db.DB
+		database  db.Store
 		image     db.Image
+		tag       string
+		size      int64
+		running   bool
+		session   db.Session
+		role      string
 		ctx       context.Context
 	)
 
+	r = withLogFields(r, "container_id", ctr.UUID)
 	ctx = r.Context()
 	webSocket = ws.FromContext(ctx)
 	database = dbFromContext(ctx)
-	params = parseParams(r.URL.Query())
-	adapter = containerPool[params.ContainerID]
+	role = membershipFromContext(ctx).Role
+	adapter = containerPool.get(ctr.UUID)
+
+	if adapter != nil {
+		logger(r).Info("joining session")
+
+		readOnly := !db.RoleAtLeast(role, db.RoleMember)
+		audit(r, db.AuditSessionAttached, ctr.UUID, map[string]interface{}{"read_only": readOnly})
+
+		if readOnly {
+			adapter.AddStream(streams.ReadOnly(&webSocket))
+		} else {
+			webSocket.OnResize = adapter.Resize
+			if err = adapter.Join(&webSocket); err != nil {
+				logger(r).Warn("session could not be joined", "error", err)
+			}
+		}
 
-	if params.ContainerID == "" {
-		http.Error(w, "No container_id", http.StatusBadRequest)
+		audit(r, db.AuditSessionDetached, ctr.UUID, nil)
 		return
 	}
 
-	if params.ContainerID != "" && adapter != nil {
-		log.Println("Connecting to ContainerID: " + params.ContainerID)
-		adapter.AddStream(&webSocket)
+	if !db.RoleAtLeast(role, db.RoleMember) {
+		http.Error(w, "Container is not running", http.StatusConflict)
 		return
 	}
 
-	if ctr, err = database.FindContainer(params.ContainerID); err != nil {
-		log.Println(err)
-		http.Error(w, "Container not found", http.StatusBadRequest)
+	if containerPool.full() {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Server is at capacity", http.StatusServiceUnavailable)
 		return
 	}
 
-	if image, err = database.FindImage(ctr.ImageID); err != nil {
-		log.Println(err)
-		http.Error(w, "Image not found", http.StatusBadRequest)
+	// a container left running by a previous server is attached to again
+	if running, err = docker.Running(ctr.UUID); err != nil {
+		logger(r).Error("container could not be checked", "error", err)
+		http.Error(w, "Container could not be checked", http.StatusInternalServerError)
 		return
 	}
 
-	uid, _ := uuid.FromString(ctr.UUID)
-	if dctr, err = docker.CreateContainer(uid, image.SourceURL); err != nil {
-		log.Println(err)
-		http.Error(w, "Container could not be built", http.StatusInternalServerError)
-		return
+	if !running {
+		if image, err = database.FindImage(ctr.ImageID); err != nil {
+			logger(r).Info("image not found", "error", err)
+			http.Error(w, "Image not found", http.StatusBadRequest)
+			return
+		}
+
+		if tag, err = imageTag(ctx, &image); err != nil {
+			logger(r).Error("container could not be built", "error", err)
+			http.Error(w, "Container could not be built", http.StatusInternalServerError)
+			return
+		}
 	}
 
-	log.Println("Starting container...")
+	if ctr.Persistent() && !running {
+		if size, err = docker.VolumeSize(ctr.Volume); err != nil {
+			logger(r).Error("workspace could not be checked", "error", err)
+			http.Error(w, "Workspace could not be checked", http.StatusInternalServerError)
+			return
+		}
+
+		if size > int64(ctr.VolumeQuotaMB)*1024*1024 {
+			http.Error(w, "Workspace is over its quota", http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	uid, _ := uuid.FromString(ctr.UUID)
+	dctr = docker.NewContainer(uid, tag)
+	dctr.Volume = ctr.Volume
+
+	logger(r).Info("starting container", "reattach", running)
 
 	dctr.OnStart = ctr.Start
 	dctr.OnStop = ctr.End
 
 	// defer dctr.Stop()
 
-	if pty, err = dctr.Bash(); err != nil {
-		fmt.Println(err)
+	start, mode := time.Now(), "run"
+	if running {
+		mode = "attach"
+	}
+
+	_, span := tracing.Start(ctx, "container start", attribute.String("container.id", ctr.UUID), attribute.String("mode", mode))
+	if running {
+		dctr.OnStart = ctr.Resume
+		pty, err = dctr.Attach()
+	} else {
+		pty, err = dctr.Bash()
+	}
+	tracing.End(span, err)
+
+	if err != nil {
+		logger(r).Error("container could not be started", "error", err)
 		http.Error(w, "Container could not be started", http.StatusInternalServerError)
 		return
 	}
+	metrics.ContainerStart.WithLabelValues(mode).Observe(time.Since(start).Seconds())
 	// defer pty.Stop()
 
-	newAdapter := streams.NewAdapter(&pty, &webSocket)
-	containerPool[dctr.ID.String()] = &newAdapter
-	newAdapter.OnDisconnect = func() error {
-		var err error
+	if session, err = database.CreateSession(&ctr, userFromContext(ctx), dctr.ID.String()); err != nil {
+		logger(r).Error("session could not be started", "error", err)
+		pty.Stop()
+		dctr.Stop()
+		http.Error(w, "Session could not be started", http.StatusInternalServerError)
+		return
+	}
 
-		if err = pty.Stop(); err != nil {
-			return err
-		}
+	r = withLogFields(r, "session_id", session.ID, "run_id", ctr.RunID())
 
-		// Need to wait to see if others are still connected
-		if err = dctr.Stop(); err != nil {
-			return err
-		}
+	adapter = streams.NewAdapter(&pty, &webSocket)
+	webSocket.OnResize = adapter.Resize
+
+	audit(r, db.AuditSessionAttached, ctr.UUID, map[string]interface{}{"started": !running, "reattached": running})
+
+	startSession(r.Context(), database, &ctr, &session, &dctr, &pty, adapter, func(stopped bool) {
+		audit(r, db.AuditSessionDetached, ctr.UUID, map[string]interface{}{"stopped": stopped})
+	})
+}
+
+// imageTag returns the docker tag of an image, waiting for the image's build
+// to finish if it is still queued or running
+func imageTag(ctx context.Context, image *db.Image) (string, error) {
+	var (
+		build db.Build
+		err   error
+	)
+
+	if image.SnapshotOf.Valid {
+		return image.UUID, nil
+	}
 
-		return nil
+	if build, err = dbFromContext(ctx).FindImageBuild(image); err != nil {
+		return "", err
 	}
 
-	fmt.Println("Connecting to ContainerID: " + dctr.ID.String())
+	ctx, span := tracing.Start(ctx, "wait for build", attribute.String("build.id", build.UUID))
+	build, err = queueFromContext(ctx).Wait(ctx, build.UUID)
+	tracing.End(span, err)
 
-	go func() {
-		newAdapter.Connect()
-		containerPool[dctr.ID.String()] = nil
-	}()
+	if err != nil {
+		return "", err
+	}
+
+	if build.Status != db.BuildSucceeded {
+		return "", fmt.Errorf("build %s %s: %s", build.UUID, build.Status, build.Error)
+	}
 
-	fmt.Println("Done")
+	return build.UUID, nil
 }
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"dre/logging"
+	"dre/tracing"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// requestIDHeader carries a request's ID. A client may send its own to
+// correlate its logs with the server's.
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// probePaths are polled by load balancers and scrapers, so their requests
+// are only logged at debug level unless they fail
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// logger returns the logger of a request, which adds the request's ID and,
+// once known, its user and account to every line
+func logger(r *http.Request) *logging.Logger {
+	return logging.FromContext(r.Context())
+}
+
+// requestMiddleware gives every request an ID, a logger and a span, and
+// logs the request once it has been served
+func requestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		// spans are named after the route so that they group well
+		route := r.URL.Path
+		if mux, ok := next.(*http.ServeMux); ok {
+			_, route = mux.Handler(r)
+		}
+
+		ctx, span := tracing.StartRequest(r, route)
+
+		fields := []interface{}{"request_id", id}
+		if traceID := tracing.TraceID(ctx); traceID != "" {
+			fields = append(fields, "trace_id", traceID)
+		}
+
+		recorder := &statusRecorder{
+			ResponseWriter: w,
+			status:         http.StatusOK,
+			logger:         logging.FromContext(ctx).With(fields...),
+		}
+
+		ctx = logging.NewContext(ctx, recorder.logger)
+		ctx = context.WithValue(ctx, recorderKey, recorder)
+
+		start := time.Now()
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		log := recorder.logger.Info
+		if recorder.status >= http.StatusInternalServerError {
+			log = recorder.logger.Error
+		} else if probePaths[r.URL.Path] {
+			log = recorder.logger.Debug
+		}
+
+		log("request", "method", r.Method, "path", r.URL.Path, "status", recorder.status,
+			"duration_ms", time.Since(start).Milliseconds())
+		tracing.EndRequest(span, recorder.status)
+	})
+}
+
+const recorderKey = "RECORDER_KEY"
+
+// withLogFields returns r with a logger that adds keyvals to every line,
+// including the line logged when the request has been served
+func withLogFields(r *http.Request, keyvals ...interface{}) *http.Request {
+	if recorder, ok := r.Context().Value(recorderKey).(*statusRecorder); ok {
+		recorder.logger = recorder.logger.With(keyvals...)
+	}
+
+	return r.WithContext(logging.With(r.Context(), keyvals...))
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status of a response. A hijacked connection,
+// like a websocket's, is recorded as switching protocols.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	logger      *logging.Logger
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	r.status, r.wroteHeader = http.StatusSwitchingProtocols, true
+
+	return hijacker.Hijack()
+}
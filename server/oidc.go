@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/subtle"
+	"dre/db"
+	"dre/oidc"
+	"net/http"
+	"strings"
+)
+
+const oidcPrefix = "/v1/oidc/"
+
+// oidcStateCookie ties a sign in to the browser that started it, so that a
+// callback someone else started can't sign the browser in as them
+const oidcStateCookie = "dre_oidc_state"
+
+// oidcHandler signs users in with an identity provider.
+// /v1/oidc/<provider>/login redirects to the provider, which redirects back
+// to /v1/oidc/<provider>/callback. Users signing in for the first time get
+// a new user, which joins the account configured for their email domain.
+// The callback returns the same tokens as signinHandler.
+func oidcHandler(client *oidc.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var (
+			parts = strings.Split(strings.TrimPrefix(r.URL.Path, oidcPrefix), "/")
+			ctx   = r.Context()
+			err   error
+		)
+
+		if len(parts) != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch parts[1] {
+		case "login":
+			var address, state string
+
+			if address, state, err = client.AuthURL(ctx, parts[0]); err != nil {
+				logger(r).Info("provider not available", "error", err)
+				http.Error(w, "Provider not available", http.StatusNotFound)
+				return
+			}
+
+			provider, _ := client.Provider(parts[0])
+			http.SetCookie(w, &http.Cookie{
+				Name:     oidcStateCookie,
+				Value:    state,
+				Path:     oidcPrefix + parts[0],
+				MaxAge:   int(oidc.LoginTTL.Seconds()),
+				Secure:   strings.HasPrefix(provider.RedirectURL, "https://"),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+
+			http.Redirect(w, r, address, http.StatusFound)
+		case "callback":
+			oidcCallback(w, r, client, parts[0])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request, client *oidc.Client, name string) {
+	var (
+		err      error
+		identity oidc.Identity
+		provider oidc.Provider
+		user     db.User
+		database = dbFromContext(r.Context())
+		query    = r.URL.Query()
+	)
+
+	if query.Get("error") != "" {
+		http.Error(w, "Sign in failed: "+query.Get("error"), http.StatusUnauthorized)
+		return
+	}
+
+	// the sign in is over either way
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: oidcPrefix + name, MaxAge: -1})
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		logger(r).Info("oidc state not from this browser", "error", err)
+		auditUser(r, nil, "", db.AuditSignInFailed, map[string]interface{}{"method": "oidc", "provider": name, "reason": "state"})
+		http.Error(w, "Sign in was not started in this browser", http.StatusUnauthorized)
+		return
+	}
+
+	if identity, err = client.Exchange(r.Context(), name, query.Get("state"), query.Get("code")); err != nil {
+		logger(r).Info("oidc exchange failed", "error", err)
+		auditUser(r, nil, "", db.AuditSignInFailed, map[string]interface{}{"method": "oidc", "provider": name})
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if user, err = database.FindIdentityUser(identity.Provider, identity.Subject); err != nil {
+		provider, _ = client.Provider(name)
+		user, err = database.CreateIdentityUser(
+			identity.Provider,
+			identity.Subject,
+			identityUsername(identity),
+			verifiedEmail(identity),
+			provider.Domains[identity.Domain()],
+		)
+
+		// a concurrent first sign in with the identity created its user
+		if err == db.ErrIdentityTaken {
+			user, err = database.FindIdentityUser(identity.Provider, identity.Subject)
+		}
+	}
+
+	if err != nil {
+		logger(r).Error("identity user not found or created", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	signIn(w, r, user, map[string]interface{}{"method": "oidc", "provider": name})
+}
+
+// identityUsername suggests a username for a new user
+func identityUsername(identity oidc.Identity) string {
+	if identity.Username != "" {
+		return identity.Username
+	}
+
+	if i := strings.Index(identity.Email, "@"); i > 0 {
+		return identity.Email[:i]
+	}
+
+	return identity.Provider + "-user"
+}
+
+func verifiedEmail(identity oidc.Identity) string {
+	if identity.EmailVerified {
+		return identity.Email
+	}
+
+	return ""
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"dre/notify"
+	"dre/oidc"
+	"dre/oidc/oidctest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOIDCSignInJoinsDomainAccount(t *testing.T) {
+	ts := newTestServer(t)
+
+	mock := oidctest.NewProvider("dre", "secret")
+	defer mock.Close()
+
+	alice, err := ts.database.FindUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := oidc.New([]oidc.Provider{{
+		Name:         "mock",
+		Issuer:       mock.Issuer(),
+		ClientID:     "dre",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/v1/oidc/mock/callback",
+		Domains:      map[string]int{"corp.io": alice.AccountID},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(&ts.database, nil, client, notify.LogNotifier{})
+	handler := s.handler(t.TempDir())
+
+	tests := []struct {
+		subject  string
+		verified bool
+		member   bool
+	}{
+		{"verified", true, true},
+		{"unverified", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.subject, func(t *testing.T) {
+			mock.Claims["sub"] = test.subject
+			mock.Claims["email"] = test.subject + "@corp.io"
+			mock.Claims["email_verified"] = test.verified
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, oidcPrefix+"mock/login", nil))
+			if w.Code != http.StatusFound {
+				t.Fatalf("login got %d: %s", w.Code, w.Body)
+			}
+
+			callback, err := mock.Authorize(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, oidcPrefix+"mock/callback?"+callback.Encode(), nil)
+			for _, cookie := range w.Result().Cookies() {
+				r.AddCookie(cookie)
+			}
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("callback got %d: %s", w.Code, w.Body)
+			}
+
+			user, err := ts.database.FindIdentityUser("mock", test.subject)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ts.database.FindMembership(alice.AccountID, user.ID)
+			if member := err == nil; member != test.member {
+				t.Errorf("member of the domain's account is %t, want %t", member, test.member)
+			}
+
+			if test.verified && user.AccountID != alice.AccountID {
+				t.Errorf("signed in to account %d, want the domain's %d", user.AccountID, alice.AccountID)
+			}
+		})
+	}
+
+	// a callback without a sign in started is refused
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, oidcPrefix+"mock/callback?state=forged&code=x", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("forged callback got %d, want 401", w.Code)
+	}
+}
+
+func TestOIDCCallbackNeedsTheBrowserThatSignedIn(t *testing.T) {
+	ts := newTestServer(t)
+
+	mock := oidctest.NewProvider("dre", "secret")
+	defer mock.Close()
+	mock.Claims["sub"] = "attacker"
+
+	client, err := oidc.New([]oidc.Provider{{
+		Name:         "mock",
+		Issuer:       mock.Issuer(),
+		ClientID:     "dre",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/v1/oidc/mock/callback",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(&ts.database, nil, client, notify.LogNotifier{})
+	handler := s.handler(t.TempDir())
+
+	// login starts a sign in and returns its callback and state cookie
+	login := func() (string, *http.Cookie) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, oidcPrefix+"mock/login", nil))
+
+		callback, err := mock.Authorize(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || !cookies[0].HttpOnly {
+			t.Fatalf("login set cookies %v, want an HttpOnly state cookie", cookies)
+		}
+
+		return oidcPrefix + "mock/callback?" + callback.Encode(), cookies[0]
+	}
+
+	// the attacker signs in as themselves but sends the callback on
+	attackerCallback, _ := login()
+	_, victimCookie := login()
+
+	for name, cookies := range map[string][]*http.Cookie{"no": nil, "another sign in's": {victimCookie}} {
+		r := httptest.NewRequest(http.MethodGet, attackerCallback, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("callback with %s state cookie got %d, want 401", name, w.Code)
+		}
+	}
+
+	if _, err = ts.database.FindIdentityUser("mock", "attacker"); err == nil {
+		t.Error("callback from another browser signed in")
+	}
+}
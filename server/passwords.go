@@ -0,0 +1,182 @@
+package server
+
+import (
+	"dre/db"
+	"dre/notify"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type passwordParameters struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+	Token       string `json:"token"`
+}
+
+// changePasswordHandler sets the user's password after checking their
+// current one. Other sessions are signed out and new tokens returned.
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		params   passwordParameters
+		err      error
+		user     db.User
+		database db.Store
+		tokens   db.Tokens
+	)
+
+	if _, ok := apiKeyFromContext(r.Context()); ok {
+		http.Error(w, "API keys can't change passwords", http.StatusForbidden)
+		return
+	}
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user = userFromContext(r.Context())
+	database = dbFromContext(r.Context())
+
+	if !checkLogin(w, r, user.Username) {
+		return
+	}
+
+	if _, err = database.SignInUser(user.Username, params.Password); err != nil {
+		failLogin(r, user.Username)
+		audit(r, db.AuditSignInFailed, "", map[string]interface{}{"method": "password", "reason": "change password"})
+		http.Error(w, "Incorrect password", http.StatusUnauthorized)
+		return
+	}
+
+	if err = db.CheckPassword(user.Username, params.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = database.UpdatePassword(&user, params.NewPassword); err != nil {
+		logger(r).Error("update password failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, db.AuditPasswordChanged, "", nil)
+
+	if tokens, err = database.CreateTokens(&user); err != nil {
+		logger(r).Error("create tokens failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// passwordResetHandler sends a one-time password reset token through
+// notifier. It responds the same whether or not the user exists.
+func passwordResetHandler(notifier notify.Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var (
+			params   passwordParameters
+			err      error
+			user     db.User
+			token    string
+			database = dbFromContext(r.Context())
+		)
+
+		if err = json.NewDecoder(r.Body).Decode(&params); err != nil || params.Username == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+
+		if resetThrottle.locked(params.Username) > 0 {
+			return
+		}
+		resetThrottle.fail(params.Username)
+
+		if user, err = database.FindUser(params.Username); err != nil {
+			logger(r).Info("user not found", "error", err)
+			return
+		}
+
+		if token, err = database.CreatePasswordReset(&user); err != nil {
+			logger(r).Error("create password reset failed", "error", err)
+			return
+		}
+
+		auditUser(r, &user, "", db.AuditPasswordResetRequest, nil)
+
+		to := user.Username
+		if user.Email != nil {
+			to = *user.Email
+		}
+
+		err = notifier.Notify(notify.Message{
+			To:      to,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("A password reset was requested for %s. To choose a new password, POST the token below "+
+				"to /v1/password/reset/confirm within %s:\n\n%s\n\nIf you didn't ask for this you can ignore it.",
+				user.Username, db.PasswordResetTTL, token),
+		})
+
+		if err != nil {
+			logger(r).Error("password reset not sent", "error", err)
+		}
+	}
+}
+
+// confirmPasswordResetHandler sets a password with a reset token and signs
+// the user out everywhere
+func confirmPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		params passwordParameters
+		err    error
+		user   db.User
+	)
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if user, err = dbFromContext(r.Context()).ResetPassword(params.Token, params.Password); err != nil {
+		if err == db.ErrUnknownReset {
+			http.Error(w, "Unknown or expired token", http.StatusUnauthorized)
+			return
+		}
+
+		if _, ok := err.(db.PolicyError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger(r).Error("reset password failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	usernameThrottle.reset(user.Username)
+	auditUser(r, &user, "", db.AuditPasswordReset, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"dre/streams"
+	"net/http"
+	"sync"
+)
+
+// pool holds the adapter of every running container by container UUID
+type pool struct {
+	mutex    sync.Mutex
+	adapters map[string]*streams.Adapter
+	// draining is set once the server is shutting down. keep is set if
+	// containers should be left running when it does.
+	draining bool
+	keep     bool
+}
+
+var containerPool = &pool{adapters: make(map[string]*streams.Adapter)}
+
+func (p *pool) get(id string) *streams.Adapter {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.adapters[id]
+}
+
+func (p *pool) put(id string, adapter *streams.Adapter) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.adapters[id] = adapter
+}
+
+func (p *pool) remove(id string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.adapters, id)
+}
+
+func (p *pool) len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.adapters)
+}
+
+// full reports whether the pool holds MaxSessions adapters
+func (p *pool) full() bool {
+	return MaxSessions > 0 && p.len() >= MaxSessions
+}
+
+// all returns every adapter in the pool
+func (p *pool) all() []*streams.Adapter {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	adapters := make([]*streams.Adapter, 0, len(p.adapters))
+	for _, adapter := range p.adapters {
+		adapters = append(adapters, adapter)
+	}
+
+	return adapters
+}
+
+// drain stops new sessions from being started. If keep is set, containers
+// whose sessions end from then on are left running.
+func (p *pool) drain(keep bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.draining, p.keep = true, keep
+}
+
+func (p *pool) isDraining() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.draining
+}
+
+func (p *pool) keeping() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.draining && p.keep
+}
+
+// drainMiddleware rejects new sessions once the server is shutting down. It
+// runs before the websocket upgrade so that clients get an ordinary HTTP
+// error they can retry.
+func drainMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if containerPool.isDraining() {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		next(w, r)
+	}
+}
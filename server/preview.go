@@ -0,0 +1,354 @@
+package server
+
+import (
+	"context"
+	"dre/db"
+	"dre/docker"
+	"dre/metrics"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PreviewURL is where previews are served, each on a host of its own below
+// it, <container_id>-<port>.<host>, so that a sandboxed page can't reach
+// the API's origin or another preview's. Previews are off when it's nil.
+var PreviewURL *url.URL
+
+// previewCookie holds a preview session on the preview's host
+const previewCookie = "dre_preview"
+
+// previewTicketParameter carries the ticket that opens a preview
+const previewTicketParameter = "dre_ticket"
+
+// previews are the sessions of opened previews by their cookie
+var previews = struct {
+	sync.Mutex
+	sessions map[string]ticket
+}{sessions: make(map[string]ticket)}
+
+type port struct {
+	Port int    `json:"port"`
+	URL  string `json:"url,omitempty"`
+}
+
+type previewParameters struct {
+	ContainerID string `json:"container_id"`
+	Port        int    `json:"port"`
+}
+
+// portsHandler lists the ports that a running container is listening on
+// along with the URLs that preview them, which are opened with a ticket from
+// createPreviewHandler
+func portsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		err       error
+		ctr       db.Container
+		listening []int
+		ports     = []port{}
+	)
+
+	if ctr, err = findAccountContainer(r.Context(), r.URL.Query().Get("container_id")); err != nil {
+		logger(r).Info("container not found", "error", err)
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+
+	if containerPool.get(ctr.UUID) == nil {
+		http.Error(w, "Container is not running", http.StatusConflict)
+		return
+	}
+
+	if listening, err = docker.ListeningPorts(ctr.UUID); err != nil {
+		logger(r).Error("ports could not be listed", "error", err)
+		http.Error(w, "Ports could not be listed", http.StatusInternalServerError)
+		return
+	}
+
+	for _, p := range listening {
+		listed := port{Port: p}
+		if PreviewURL != nil {
+			listed.URL = previewURL(previewHost(ctr.UUID, p))
+		}
+
+		ports = append(ports, listed)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ports": ports})
+}
+
+// createPreviewHandler returns a URL that opens the preview of a port of a
+// running container in a browser. It holds a ticket for the preview's host,
+// which is swapped for a cookie there. API keys can't open previews, as
+// their sessions would outlive the key.
+func createPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		params previewParameters
+		err    error
+		ctr    db.Container
+		id     string
+		host   string
+		ctx    = r.Context()
+	)
+
+	if _, ok := apiKeyFromContext(ctx); ok {
+		http.Error(w, "API keys can't open previews", http.StatusForbidden)
+		return
+	}
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if params.Port < 1 || params.Port > 65535 {
+		http.Error(w, "Invalid port", http.StatusBadRequest)
+		return
+	}
+
+	if ctr, err = findAccountContainer(ctx, params.ContainerID); err != nil {
+		logger(r).Info("container not found", "error", err)
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+
+	if containerPool.get(ctr.UUID) == nil {
+		http.Error(w, "Container is not running", http.StatusConflict)
+		return
+	}
+
+	host = previewHost(ctr.UUID, params.Port)
+	t := ticket{
+		user:    userFromContext(ctx),
+		preview: host,
+		token:   strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+	}
+
+	if id, err = issueTicket(t); err != nil {
+		logger(r).Error("ticket not generated", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":        previewURL(host) + "?" + url.Values{previewTicketParameter: {id}}.Encode(),
+		"expires_in": int(ticketTTL.Seconds()),
+	})
+}
+
+// previewHost returns the host a port of a container is previewed on
+func previewHost(containerID string, port int) string {
+	return fmt.Sprintf("%s-%d.%s", containerID, port, PreviewURL.Host)
+}
+
+func previewURL(host string) string {
+	return PreviewURL.Scheme + "://" + host + "/"
+}
+
+// parsePreviewHost returns the container and port previewed on host, or
+// false if host isn't a preview's
+func parsePreviewHost(host string) (string, int, bool) {
+	host = strings.ToLower(host)
+	name := strings.TrimSuffix(host, "."+strings.ToLower(PreviewURL.Host))
+
+	i := strings.LastIndex(name, "-")
+	if name == host || i < 0 {
+		return "", 0, false
+	}
+
+	port, err := strconv.Atoi(name[i+1:])
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, false
+	}
+
+	return name[:i], port, true
+}
+
+// previewMiddleware authenticates a request to a preview's host by its
+// session cookie. A ticket for the host starts the session: it is swapped
+// for the cookie and the browser is sent back without it. The session lasts
+// as long as the access token it was opened with.
+func previewMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			t          ticket
+			user       db.User
+			membership db.Membership
+			err        error
+			database   = dbFromContext(r.Context())
+			host       = strings.ToLower(r.Host)
+		)
+
+		if id := r.URL.Query().Get(previewTicketParameter); id != "" {
+			openPreview(w, r, id, host)
+			return
+		}
+
+		if t, err = previewSession(r, host); err == nil {
+			user, err = database.AuthenticateToken(t.token)
+		}
+
+		if err != nil {
+			logger(r).Info("preview session rejected", "error", err)
+			metrics.AuthFailures.WithLabelValues("preview").Inc()
+			http.Error(w, "Open the preview from /v1/previews", http.StatusUnauthorized)
+			return
+		}
+		user.AccountID = t.user.AccountID
+
+		if membership, err = database.FindMembership(user.AccountID, user.ID); err != nil {
+			logger(r).Info("not a member of the account", "error", err)
+			http.Error(w, "Not a member of the account", http.StatusForbidden)
+			return
+		}
+
+		if missingSecondFactor(user, membership, false) {
+			http.Error(w, "Account requires two-factor authentication", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), membershipKey, membership)
+		ctx = context.WithValue(ctx, userKey, user)
+		next(w, withLogFields(r.WithContext(ctx), "user_id", user.ID, "account_id", user.AccountID))
+	}
+}
+
+// openPreview redeems a ticket for the preview on host, and redirects to the
+// same URL without it along with the session's cookie
+func openPreview(w http.ResponseWriter, r *http.Request, id string, host string) {
+	var (
+		t       ticket
+		session string
+		err     error
+	)
+
+	if t, err = redeemTicket(id); err == nil && t.preview != host {
+		err = errors.New("server: ticket is for another host")
+	}
+
+	if err != nil {
+		logger(r).Info("redeem ticket failed", "error", err)
+		metrics.AuthFailures.WithLabelValues("ticket").Inc()
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if session, err = randomID(); err != nil {
+		logger(r).Error("preview session not generated", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	t.expires = time.Now().Add(db.AccessTokenTTL)
+
+	previews.Lock()
+	for pending, old := range previews.sessions {
+		if time.Now().After(old.expires) {
+			delete(previews.sessions, pending)
+		}
+	}
+	previews.sessions[session] = t
+	previews.Unlock()
+
+	// without a Domain the cookie stays on the preview's own host
+	http.SetCookie(w, &http.Cookie{
+		Name:     previewCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(db.AccessTokenTTL.Seconds()),
+		Secure:   PreviewURL.Scheme == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := r.URL.Query()
+	query.Del(previewTicketParameter)
+	target := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// previewSession returns the unexpired session on host of a preview
+// request. Other hosts' cookies are ignored, in case a preview set one for
+// a parent domain.
+func previewSession(r *http.Request, host string) (ticket, error) {
+	previews.Lock()
+	defer previews.Unlock()
+
+	for _, cookie := range r.Cookies() {
+		if cookie.Name != previewCookie {
+			continue
+		}
+
+		if t, ok := previews.sessions[cookie.Value]; ok && t.preview == host && time.Now().Before(t.expires) {
+			return t, nil
+		}
+	}
+
+	return ticket{}, errors.New("server: no preview session")
+}
+
+// previewHandler proxies a preview's host to the port of a running
+// container, including WebSocket upgrades
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		ctr     db.Container
+		address string
+		number  int
+		id      string
+		ctx     = r.Context()
+	)
+
+	id, number, _ = parsePreviewHost(r.Host)
+
+	if ctr, err = findAccountContainer(ctx, id); err != nil {
+		logger(r).Info("container not found", "error", err)
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+
+	if containerPool.get(ctr.UUID) == nil {
+		http.Error(w, "Container is not running", http.StatusConflict)
+		return
+	}
+
+	if address, err = docker.Address(ctr.UUID); err != nil {
+		logger(r).Error("container is not reachable", "error", err)
+		http.Error(w, "Container is not reachable", http.StatusBadGateway)
+		return
+	}
+
+	// the preview's cookie is for this server, not for the sandboxed app
+	cookies := r.Cookies()
+	r.Header.Del("Authorization")
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != previewCookie {
+			r.AddCookie(cookie)
+		}
+	}
+
+	target := &url.URL{Scheme: "http", Host: net.JoinHostPort(address, strconv.Itoa(number))}
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"dre/db"
+	"dre/streams"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// openPreview asks for the preview of a port of the test container and
+// returns the URL that opens it
+func (ts testServer) openPreview(t *testing.T, port string, token string) *url.URL {
+	w := ts.do(http.MethodPost, "/v1/previews", `{"container_id":"`+ts.container.UUID+`","port":`+port+`}`, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("preview not opened, got %d: %s", w.Code, w.Body)
+	}
+
+	var body struct {
+		URL string `json:"url"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+
+	u, err := url.Parse(body.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+// get requests target, which may be on a preview's host, with cookies
+func (ts testServer) get(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	ts.handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestPreviewTicketsOpenTheirHostOnly(t *testing.T) {
+	ts := newTestServer(t)
+	containerPool.put(ts.container.UUID, streams.NewAdapter(nil))
+	defer containerPool.remove(ts.container.UUID)
+
+	preview := ts.openPreview(t, "8080", ts.alice)
+	if want := ts.container.UUID + "-8080.preview.localhost"; preview.Host != want {
+		t.Errorf("preview is on %s, want %s", preview.Host, want)
+	}
+
+	w := ts.get(preview.String())
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("ticket got %d to %q, want a redirect to /", w.Code, w.Header().Get("Location"))
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != previewCookie || !cookies[0].HttpOnly || cookies[0].Domain != "" {
+		t.Fatalf("got cookies %v, want an HttpOnly cookie for the preview's host", cookies)
+	}
+	session := cookies[0]
+
+	if w = ts.get(preview.String()); w.Code != http.StatusUnauthorized {
+		t.Errorf("reused ticket got %d, want 401", w.Code)
+	}
+
+	home := "http://" + preview.Host + "/"
+
+	// the session gets past authentication, whatever fails after it
+	if w = ts.get(home, session); w.Code == http.StatusUnauthorized || w.Code == http.StatusNotFound {
+		t.Errorf("session got %d: %s", w.Code, w.Body)
+	}
+
+	if w = ts.get(home); w.Code != http.StatusUnauthorized {
+		t.Errorf("no session got %d, want 401", w.Code)
+	}
+
+	other := "http://" + ts.container.UUID + "-9090.preview.localhost/"
+	if w = ts.get(other, session); w.Code != http.StatusUnauthorized {
+		t.Errorf("session on another preview got %d, want 401", w.Code)
+	}
+
+	ticket := ts.openPreview(t, "9090", ts.alice).Query().Get(previewTicketParameter)
+	if w = ts.get(other + "?" + previewTicketParameter + "=" + ticket); w.Code != http.StatusFound {
+		t.Fatalf("ticket on its own preview got %d", w.Code)
+	}
+
+	ticket = ts.openPreview(t, "9090", ts.alice).Query().Get(previewTicketParameter)
+	if w = ts.get(home + "?" + previewTicketParameter + "=" + ticket); w.Code != http.StatusUnauthorized {
+		t.Errorf("ticket on another preview got %d, want 401", w.Code)
+	}
+
+	ticket = ts.openPreview(t, "8080", ts.alice).Query().Get(previewTicketParameter)
+	if w = ts.get("/v1/pty?container_id=" + ts.container.UUID + "&ticket=" + ticket); w.Code != http.StatusUnauthorized {
+		t.Errorf("preview ticket opened a terminal, got %d", w.Code)
+	}
+
+	// the session ends with the sign in it was opened from
+	if w = ts.do(http.MethodPost, "/v1/signout", `{"all":true}`, ts.alice); w.Code != http.StatusNoContent {
+		t.Fatalf("sign out got %d: %s", w.Code, w.Body)
+	}
+
+	if w = ts.get(home, session); w.Code != http.StatusUnauthorized {
+		t.Errorf("session after sign out got %d, want 401", w.Code)
+	}
+}
+
+func TestPreviewsAreNotOpenedWithAPIKeys(t *testing.T) {
+	ts := newTestServer(t)
+	containerPool.put(ts.container.UUID, streams.NewAdapter(nil))
+	defer containerPool.remove(ts.container.UUID)
+
+	alice, err := ts.database.FindUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ts.database.CreateAPIKey(&alice, "ci", []string{db.ScopeSessionsAttach}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := ts.do(http.MethodPost, "/v1/previews", `{"container_id":"`+ts.container.UUID+`","port":8080}`, key.Key)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("API key got %d, want 403", w.Code)
+	}
+}
+
+func TestPreviewHosts(t *testing.T) {
+	defer func(u *url.URL) { PreviewURL = u }(PreviewURL)
+	PreviewURL, _ = url.Parse("https://Preview.example.com:8443")
+
+	tests := []struct {
+		host      string
+		container string
+		port      int
+		ok        bool
+	}{
+		{"abc-def-8080.preview.example.com:8443", "abc-def", 8080, true},
+		{"ABC-8080.PREVIEW.example.com:8443", "abc", 8080, true},
+		{"abc-8080.preview.example.com", "", 0, false},
+		{"preview.example.com:8443", "", 0, false},
+		{"abc.preview.example.com:8443", "", 0, false},
+		{"abc-70000.preview.example.com:8443", "", 0, false},
+		{"abc-8080.evilpreview.example.com:8443", "", 0, false},
+		{"localhost:3000", "", 0, false},
+	}
+
+	for _, test := range tests {
+		container, port, ok := parsePreviewHost(test.host)
+		if container != test.container || port != test.port || ok != test.ok {
+			t.Errorf("parsePreviewHost(%q) = %q, %d, %t, want %q, %d, %t",
+				test.host, container, port, ok, test.container, test.port, test.ok)
+		}
+	}
+}
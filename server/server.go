@@ -2,165 +2,293 @@ package server
 
 import (
 	"context"
+	"dre/builds"
 	"dre/db"
-	"dre/docker"
+	"dre/logging"
+	"dre/metrics"
+	"dre/notify"
+	"dre/oidc"
 	"dre/streams"
 	"dre/utils"
 	"dre/ws"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
-	"strconv"
-
-	uuid "github.com/satori/go.uuid"
+	"time"
 )
 
 // Server is a http server
 type Server struct {
-	database *db.DB
+	database db.Store
+	queue    *builds.Queue
+	oidc     *oidc.Client
+	notifier notify.Notifier
+	http     *http.Server
 }
 
-// New returns a new Server with initialized handlers
-func New(database *db.DB) Server {
-	server := Server{database}
+// New returns a new Server with initialized handlers. oidcClient may be nil
+// if no identity providers are configured. notifier delivers password resets
+// and invitations.
+func New(database db.Store, queue *builds.Queue, oidcClient *oidc.Client, notifier notify.Notifier) Server {
+	server := Server{database, queue, oidcClient, notifier, &http.Server{}}
 
 	return server
 }
 
-// Start runs the server and listens on the provided port
-func (s *Server) Start(staticDir string, port int) error {
-	var (
-		portStr string
-		addr    string
-		err     error
-	)
+// Start serves staticDir and the API on addr, over HTTPS when certFile and
+// keyFile are set
+func (s *Server) Start(addr string, staticDir string, certFile string, keyFile string) error {
+	var err error
 
-	http.Handle("/v1/pty", dbMiddleware(s.database, ws.Middleware(ptyHandler)))
-	http.Handle("/", http.FileServer(http.Dir(staticDir)))
+	s.registerMetrics()
 
-	portStr = strconv.FormatInt(int64(port), 10)
-	addr = "localhost:" + portStr
-	fmt.Println("Listening on: " + addr)
+	logging.Default().Info("listening", "addr", addr)
+
+	s.http.Addr = addr
+	s.http.Handler = s.handler(staticDir)
+	if certFile != "" {
+		err = s.http.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = s.http.ListenAndServe()
+	}
 
-	if err = http.ListenAndServe(addr, nil); err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("net.http could not listen on address '%s': %s", addr, err)
 	}
 
 	return nil
 }
 
-type parameters struct {
-	SourceURL   string `json:"source_url"`
-	ContainerID string `json:"container_id"`
-}
+// handler routes the API, and staticDir for every other path. Requests to
+// the hosts of previews are proxied to them instead.
+func (s *Server) handler(staticDir string) http.Handler {
+	mux := http.NewServeMux()
 
-var containerPool = make(map[string]*streams.Adapter)
+	mux.Handle("/v1/signup", dbMiddleware(s.database, signupHandler))
+	mux.Handle("/v1/signin", dbMiddleware(s.database, signinHandler))
+	if s.oidc != nil {
+		mux.Handle(oidcPrefix, dbMiddleware(s.database, oidcHandler(s.oidc)))
+	}
+	mux.Handle("/v1/signin/2fa", dbMiddleware(s.database, secondFactorHandler))
+	mux.Handle("/v1/tokens/refresh", dbMiddleware(s.database, refreshHandler))
+	mux.Handle("/v1/password", dbMiddleware(s.database, authenticateMiddleware(changePasswordHandler)))
+	mux.Handle("/v1/password/reset", dbMiddleware(s.database, passwordResetHandler(s.notifier)))
+	mux.Handle("/v1/password/reset/confirm", dbMiddleware(s.database, confirmPasswordResetHandler))
+	mux.Handle(twoFactorPrefix, dbMiddleware(s.database, authenticateMiddleware(twoFactorHandler)))
+	mux.Handle(twoFactorPrefix+"/confirm", dbMiddleware(s.database, authenticateMiddleware(confirmTwoFactorHandler)))
+	mux.Handle(twoFactorPrefix+"/recovery_codes", dbMiddleware(s.database, authenticateMiddleware(recoveryCodesHandler)))
+	mux.Handle("/v1/signout", dbMiddleware(s.database, authenticateMiddleware(signoutHandler)))
+	mux.Handle("/v1/containers", s.middleware(authenticateMiddleware(containersHandler)))
+	mux.Handle("/v1/snapshots", s.middleware(authenticateMiddleware(scopeMiddleware(db.ScopeContainersCreate, roleMiddleware(db.RoleMember, snapshotsHandler)))))
+	mux.Handle("/v1/files", s.middleware(authenticateMiddleware(scopeMiddleware(db.ScopeSessionsAttach, filesHandler))))
+	mux.Handle("/v1/ports", s.middleware(authenticateMiddleware(scopeMiddleware(db.ScopeSessionsAttach, portsHandler))))
+	if PreviewURL != nil {
+		mux.Handle("/v1/previews", s.middleware(authenticateMiddleware(scopeMiddleware(db.ScopeSessionsAttach, createPreviewHandler))))
+	}
+	mux.Handle("/v1/builds", s.middleware(authenticateMiddleware(scopeMiddleware(db.ScopeRead, buildsHandler))))
+	mux.Handle("/v1/api_keys", dbMiddleware(s.database, authenticateMiddleware(roleMiddleware(db.RoleAdmin, apiKeysHandler))))
+	mux.Handle("/v1/accounts", dbMiddleware(s.database, authenticateMiddleware(accountsHandler)))
+	mux.Handle("/v1/members", dbMiddleware(s.database, authenticateMiddleware(membersHandler)))
+	mux.Handle("/v1/invitations", dbMiddleware(s.database, authenticateMiddleware(invitationsHandler(s.notifier))))
+	mux.Handle("/v1/invitations/accept", dbMiddleware(s.database, authenticateMiddleware(acceptInvitationHandler)))
+	mux.Handle("/v1/usage", dbMiddleware(s.database, authenticateMiddleware(scopeMiddleware(db.ScopeRead, usageHandler))))
+	mux.Handle("/v1/audit_events", dbMiddleware(s.database, authenticateMiddleware(scopeMiddleware(db.ScopeRead, roleMiddleware(db.RoleAdmin, auditEventsHandler)))))
+	mux.Handle("/v1/pty/tickets", s.middleware(authenticateMiddleware(scopeMiddleware(db.ScopeSessionsAttach, ticketsHandler))))
+	mux.Handle("/v1/pty", drainMiddleware(s.middleware(ticketMiddleware(scopeMiddleware(db.ScopeSessionsAttach, quotaMiddleware(ptyHandler))))))
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", s.readyHandler)
+	mux.Handle("/", http.FileServer(http.Dir(staticDir)))
+
+	api := requestMiddleware(mux)
+	if PreviewURL == nil {
+		return api
+	}
 
-func ptyHandler(w http.ResponseWriter, r *http.Request) {
-	var (
-		err       error
-		pty       docker.Pty
-		dctr      docker.Container
-		webSocket ws.WS
-		params    parameters
-		ctx       context.Context
-	)
+	previewMux := http.NewServeMux()
+	previewMux.Handle("/", s.middleware(previewMiddleware(previewHandler)))
+	preview := requestMiddleware(previewMux)
 
-	ctx = r.Context()
-	webSocket = ws.FromContext(ctx)
-	params = parseParams(r.URL.Query())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := parsePreviewHost(r.Host); ok {
+			preview.ServeHTTP(w, r)
+			return
+		}
 
-	log.Println(params)
-	if params.SourceURL == "" {
-		// containerID, _ := uuid.FromString(params.ContainerID)
-		// container := docker.Container{ID: containerID}
-		adapter := containerPool[params.ContainerID]
-		adapter.AddStream(&webSocket)
-		// if pty, err = container.Connect("/bin/bash"); err != nil {
-		// 	fmt.Println(err)
-		// 	http.Error(w, "Could not connect to container", http.StatusInternalServerError)
-		// }
-		// newAdapter := streams.NewAdapter(&pty, &webSocket)
-		// newAdapter.OnDisconnect = func() error {
-		// 	var err error
-
-		// 	if err = pty.Stop(); err != nil {
-		// 		return err
-		// 	}
-
-		// 	// Need to wait to see if others are still connected
-		// 	if err = dctr.Stop(); err != nil {
-		// 		return err
-		// 	}
-
-		// 	return nil
-		// }
-		log.Println("Connecting to ContainerID: " + params.ContainerID)
-
-		// go func() {
-		// 	newAdapter.Connect()
-			// containerPool[dctr.ID.String()] = nil
-		// }()
+		api.ServeHTTP(w, r)
+	})
+}
 
-		return
+// Shutdown stops the server gracefully. New sessions are refused at once and
+// attached terminals are told the server is going away. Sessions then have
+// grace to end on their own before they are closed, which stops their
+// containers and ends their runs. With keepContainers, sessions are closed
+// at once and their containers are left running, to be attached to again
+// once the server is back. Cancelling ctx cuts the grace period short.
+func (s *Server) Shutdown(ctx context.Context, grace time.Duration, keepContainers bool) error {
+	var err error
+
+	containerPool.drain(keepContainers)
+
+	notice := fmt.Sprintf("The server is shutting down, this session ends in %s.", grace)
+	if keepContainers {
+		notice, grace = "The server is restarting, reconnect in a moment to carry on.", 0
 	}
 
-	if dctr, err = docker.CreateContainer(uuid.NewV4(), params.SourceURL); err != nil {
-		log.Println("Container could not be built")
-		log.Println(err)
-		return
+	for _, adapter := range containerPool.all() {
+		broadcastNotice(adapter, notice)
 	}
 
-	log.Println("Starting container...")
+	graceCtx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
 
-	if pty, err = dctr.Bash(); err != nil {
-		fmt.Println(err)
-		http.Error(w, "Container could not be started", http.StatusInternalServerError)
-		return
+	// resumed sessions nobody rejoined have no streams to close, and would
+	// otherwise wait out resumeTimeout
+	if waitForSessions(graceCtx) != nil {
+		for _, adapter := range containerPool.all() {
+			adapter.Close()
+			adapter.Expire()
+		}
+	}
+
+	stopCtx, stop := context.WithTimeout(context.Background(), stopTimeout)
+	defer stop()
+
+	if err = waitForSessions(stopCtx); err != nil {
+		return fmt.Errorf("server: %d sessions did not end: %s", containerPool.len(), err)
 	}
 
-	newAdapter := streams.NewAdapter(&pty, &webSocket)
-	containerPool[dctr.ID.String()] = &newAdapter
-	newAdapter.OnDisconnect = func() error {
-		var err error
+	return s.http.Shutdown(stopCtx)
+}
+
+// broadcastNotice writes a notice from the server to every terminal attached
+// to adapter
+func broadcastNotice(adapter *streams.Adapter, notice string) {
+	message := base64.StdEncoding.EncodeToString([]byte("\r\n*** " + notice + " ***\r\n"))
+	adapter.Broadcast([]byte(message))
+}
+
+// stopTimeout is how long closed sessions have to stop their containers
+const stopTimeout = 30 * time.Second
+
+// registerMetrics registers the gauges read from the server's state
+func (s *Server) registerMetrics() {
+	metrics.GaugeFunc("sessions_active", "Sessions with a running container.", func() float64 {
+		return float64(containerPool.len())
+	})
 
-		if err = pty.Stop(); err != nil {
-			return err
+	metrics.GaugeFunc("session_viewers", "Clients attached to sessions, members and read-only viewers alike.", func() float64 {
+		viewers := 0
+		for _, adapter := range containerPool.all() {
+			viewers += adapter.Viewers()
 		}
 
-		// Need to wait to see if others are still connected
-		if err = dctr.Stop(); err != nil {
-			return err
+		return float64(viewers)
+	})
+
+	metrics.GaugeFunc("build_queue_depth", "Builds waiting for a worker.", func() float64 {
+		return float64(s.queue.Depth())
+	})
+}
+
+// waitForSessions waits until every session has ended or ctx is done
+func waitForSessions(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for containerPool.len() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+type parameters struct {
+	SourceURL     string `json:"source_url"`
+	ContainerID   string `json:"container_id"`
+	ImageID       string `json:"image_id"`
+	Persistent    bool   `json:"persistent"`
+	VolumeQuotaMB int    `json:"volume_quota_mb"`
+}
+
+// ptyHandler attaches a websocket to a container of the user's account.
+// With source_url it creates a container for the source first.
+func ptyHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		ctr    db.Container
+		params parameters
+		ctx    context.Context
+	)
+
+	ctx = r.Context()
+	params = parseParams(r.URL.Query())
+
+	if params.SourceURL != "" {
+		if !db.RoleAtLeast(membershipFromContext(ctx).Role, db.RoleMember) {
+			http.Error(w, "Requires role member", http.StatusForbidden)
+			return
 		}
 
-		return nil
+		if ctr, err = createSourceContainer(ctx, params.SourceURL); err != nil {
+			logger(r).Error("container could not be created", "error", err)
+			http.Error(w, "Container could not be created", http.StatusInternalServerError)
+			return
+		}
+	} else if ctr, err = findAccountContainer(ctx, params.ContainerID); err != nil {
+		logger(r).Info("container not found", "error", err)
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
 	}
 
-	fmt.Println("Connecting to ContainerID: " + dctr.ID.String())
+	// the websocket is only upgraded once the container is known, so that
+	// errors until then are plain responses
+	ws.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		attachContainer(w, r, ctr)
+	})(w, r)
+}
 
-	go func() {
-		newAdapter.Connect()
-		// containerPool[dctr.ID.String()] = nil
-	}()
+// findAccountContainer finds a container whose image belongs to the account
+// of the user in ctx. Containers of other accounts are not found.
+func findAccountContainer(ctx context.Context, id string) (db.Container, error) {
+	return dbFromContext(ctx).FindAccountContainer(userFromContext(ctx).AccountID, id)
+}
 
-	fmt.Println("Done")
+// middleware adds the server's database and build queue to the request context
+func (s *Server) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return dbMiddleware(s.database, queueMiddleware(s.queue, next))
 }
 
 var dbKey = "DB_KEY"
 
-func dbMiddleware(database *db.DB, next http.HandlerFunc) http.HandlerFunc {
+func dbMiddleware(database db.Store, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), dbKey, database.WithContext(r.Context()))
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func dbFromContext(ctx context.Context) db.Store {
+	return ctx.Value(dbKey).(db.Store)
+}
+
+var queueKey = "QUEUE_KEY"
+
+func queueMiddleware(queue *builds.Queue, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("begin dbMiddleware")
-		ctx := context.WithValue(r.Context(), dbKey, database)
+		ctx := context.WithValue(r.Context(), queueKey, queue)
 		next(w, r.WithContext(ctx))
-		log.Println("end dbMiddleware")
 	}
 }
 
-func dbFromContext(ctx context.Context) *db.DB {
-	return ctx.Value(dbKey).(*db.DB)
+func queueFromContext(ctx context.Context) *builds.Queue {
+	return ctx.Value(queueKey).(*builds.Queue)
 }
 
 func parseJSON(r *http.Request) (parameters, error) {
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"dre/db"
+	"dre/docker"
+	"dre/logging"
+	"dre/metrics"
+	"dre/streams"
+	"dre/tracing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// resumeTimeout is how long a resumed session waits for a member to
+// reconnect before its container is stopped
+const resumeTimeout = 15 * time.Minute
+
+// startSession adds a session's adapter to the pool and connects it in the
+// background, metering the container while it runs. Once every member has
+// left, the container is stopped and the session ended, unless the server is
+// shutting down and keeping containers. ended is called after either. The
+// session is logged and traced with the logger and span in ctx.
+func startSession(ctx context.Context, database db.Store, ctr *db.Container, session *db.Session, dctr *docker.Container, pty *docker.Pty, adapter *streams.Adapter, ended func(stopped bool)) {
+	done := make(chan struct{})
+	log := logging.FromContext(ctx)
+	_, span := tracing.Start(ctx, "session", attribute.String("container.id", ctr.UUID), attribute.Int("session.id", session.ID))
+
+	adapter.OnDisconnect = func() error {
+		var err error
+
+		// the container and its run are left for the next server
+		if containerPool.keeping() {
+			return database.SetSessionState(session, db.SessionDetached)
+		}
+
+		if err = pty.Stop(); err != nil {
+			return err
+		}
+
+		if err = dctr.Stop(); err != nil {
+			return err
+		}
+
+		return database.SetSessionState(session, db.SessionEnded)
+	}
+
+	containerPool.put(ctr.UUID, adapter)
+	go meter(log, ctr, ctr.UUID, done)
+	if ctr.Persistent() {
+		go watchVolume(log, ctr, adapter, done)
+	}
+
+	log.Info("session started")
+
+	go func() {
+		start := time.Now()
+		err := adapter.Connect()
+		if err != nil {
+			log.Error("session ended with an error", "error", err)
+		}
+		span.SetAttributes(attribute.Bool("session.kept", containerPool.keeping()))
+		tracing.End(span, err)
+
+		log.Info("session ended", "kept", containerPool.keeping(), "duration_ms", time.Since(start).Milliseconds())
+
+		close(done)
+		ended(!containerPool.keeping())
+		containerPool.remove(ctr.UUID)
+	}()
+}
+
+// ResumeSessions attaches to the containers of sessions a previous server
+// left open, given the containers that are still running, so that members
+// can reconnect to them. Sessions whose containers are gone are ended.
+// Resumed sessions nobody reconnects to within resumeTimeout are ended too.
+func (s *Server) ResumeSessions(running []string) error {
+	var (
+		err      error
+		sessions []db.Session
+		alive    = make(map[string]bool)
+	)
+
+	for _, name := range running {
+		alive[name] = true
+	}
+
+	if sessions, err = s.database.FindOpenSessions(); err != nil {
+		return err
+	}
+
+	for i := range sessions {
+		session := sessions[i]
+
+		if alive[session.DockerName] && containerPool.get(session.ContainerUUID) == nil {
+			if err = s.resumeSession(&session); err == nil {
+				continue
+			}
+
+			logging.Default().Error("session could not be resumed", "session_id", session.ID,
+				"container_id", session.ContainerUUID, "error", err)
+		}
+
+		if err = s.database.SetSessionState(&session, db.SessionEnded); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resumeSession attaches to the container of a session and waits for its
+// members to reconnect
+func (s *Server) resumeSession(session *db.Session) error {
+	var (
+		err  error
+		ctr  db.Container
+		dctr docker.Container
+		pty  docker.Pty
+	)
+
+	if ctr, err = s.database.FindContainer(session.ContainerUUID); err != nil {
+		return err
+	}
+
+	uid, _ := uuid.FromString(ctr.UUID)
+	dctr = docker.NewContainer(uid, "")
+	dctr.Volume = ctr.Volume
+	dctr.OnStart = ctr.Resume
+	dctr.OnStop = ctr.End
+
+	start := time.Now()
+	_, span := tracing.Start(context.Background(), "container start", attribute.String("container.id", ctr.UUID), attribute.String("mode", "attach"))
+	pty, err = dctr.Attach()
+	tracing.End(span, err)
+
+	if err != nil {
+		return err
+	}
+	metrics.ContainerStart.WithLabelValues("attach").Observe(time.Since(start).Seconds())
+
+	if err = s.database.SetSessionState(session, db.SessionRunning); err != nil {
+		pty.Stop()
+		return err
+	}
+
+	adapter := streams.NewAdapter(&pty)
+	time.AfterFunc(resumeTimeout, adapter.Expire)
+
+	log := logging.Default().With("container_id", ctr.UUID, "session_id", session.ID, "run_id", ctr.RunID())
+	log.Info("session resumed")
+	auditSession(s.database, session, db.AuditSessionResumed, nil)
+
+	startSession(logging.NewContext(context.Background(), log), s.database, &ctr, session, &dctr, &pty, adapter, func(stopped bool) {
+		auditSession(s.database, session, db.AuditSessionDetached, map[string]interface{}{"stopped": stopped})
+	})
+
+	return nil
+}
+
+// auditSession records an event of a session the server resumed, which no
+// request is behind
+func auditSession(database db.Store, session *db.Session, action string, details map[string]interface{}) {
+	event := db.AuditEvent{Actor: "server", Action: action, Target: session.ContainerUUID, UserAgent: "dre server"}
+
+	if session.AccountID.Valid {
+		accountID := int(session.AccountID.Int64)
+		event.AccountID = &accountID
+	}
+
+	if err := database.CreateAuditEvent(&event, details); err != nil {
+		logging.Default().Error("audit event not recorded", "action", action, "error", err)
+	}
+}
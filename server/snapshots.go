@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"dre/db"
+	"dre/docker"
+	"encoding/json"
+	"net/http"
+)
+
+// snapshotsHandler saves a running container as a new image owned by the
+// user's account, so that new containers can be started from it. The
+// workspace of a persistent container is copied into the image, which the
+// response reports with workspace_included.
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		params   parameters
+		database db.Store
+		err      error
+		ctr      db.Container
+		snapshot db.Image
+		user     db.User
+		ctx      context.Context
+	)
+
+	ctx = r.Context()
+	user = userFromContext(ctx)
+	database = dbFromContext(ctx)
+
+	if params, err = parseJSON(r); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if ctr, err = findAccountContainer(ctx, params.ContainerID); err != nil {
+		logger(r).Info("container not found", "error", err)
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+
+	if containerPool.get(ctr.UUID) == nil {
+		http.Error(w, "Container is not running", http.StatusConflict)
+		return
+	}
+
+	if snapshot, err = database.CreateSnapshotImage(user, &ctr); err != nil {
+		logger(r).Error("snapshot could not be created", "error", err)
+		http.Error(w, "Snapshot could not be created", http.StatusInternalServerError)
+		return
+	}
+
+	if err = docker.Commit(ctr.UUID, snapshot.UUID); err == nil && ctr.Persistent() {
+		err = docker.CommitWorkspace(ctr.UUID, snapshot.UUID)
+	}
+
+	if err != nil {
+		logger(r).Error("snapshot could not be created", "error", err)
+		database.DeleteImage(&snapshot)
+		http.Error(w, "Snapshot could not be created", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, db.AuditSnapshotCreated, ctr.UUID, map[string]interface{}{
+		"image_id":           snapshot.UUID,
+		"workspace_included": ctr.Persistent(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		db.Image
+		WorkspaceIncluded bool `json:"workspace_included"`
+	}{snapshot, ctr.Persistent()})
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"context"
+	"dre/db"
+	"dre/notify"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type memberParameters struct {
+	ID       string `json:"id"`
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	Token    string `json:"token"`
+}
+
+// canGrant reports whether a member with role can give or take away
+// target. Only owners can make or unmake owners.
+func canGrant(role string, target string) bool {
+	if target == db.RoleOwner {
+		return role == db.RoleOwner
+	}
+
+	return db.RoleAtLeast(role, db.RoleAdmin)
+}
+
+// accountsHandler lists the accounts the user belongs to and updates the
+// settings of the account the request acts on. API keys can't change
+// settings.
+func accountsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		scopeMiddleware(db.ScopeRead, listAccountsHandler)(w, r)
+	case http.MethodPut:
+		roleMiddleware(db.RoleAdmin, updateAccountHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// listAccountsHandler lists the memberships of the user, or only the one of
+// the account an API key belongs to
+func listAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err         error
+		memberships []db.Membership
+		ctx         = r.Context()
+	)
+
+	if _, ok := apiKeyFromContext(ctx); ok {
+		memberships = []db.Membership{membershipFromContext(ctx)}
+	} else if memberships, err = dbFromContext(ctx).FindUserMemberships(userFromContext(ctx).ID); err != nil {
+		logger(r).Error("find user memberships failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(memberships)
+}
+
+type accountParameters struct {
+	Require2FA bool `json:"require_2fa"`
+}
+
+// updateAccountHandler sets whether the account requires two-factor
+// authentication. Admins must use it themselves before requiring it, so
+// they can't lock themselves out.
+func updateAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		params accountParameters
+		err    error
+		ctx    = r.Context()
+		user   = userFromContext(ctx)
+	)
+
+	if _, ok := apiKeyFromContext(ctx); ok {
+		http.Error(w, "API keys can't change account settings", http.StatusForbidden)
+		return
+	}
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if params.Require2FA && !user.TOTPEnabled {
+		http.Error(w, "Enable two-factor authentication before requiring it", http.StatusConflict)
+		return
+	}
+
+	if err = dbFromContext(ctx).SetRequire2FA(user.AccountID, params.Require2FA); err != nil {
+		logger(r).Error("set require 2FA failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, db.AuditAccountUpdated, strconv.Itoa(user.AccountID), map[string]interface{}{"require_2fa": params.Require2FA})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// membersHandler lists the members of an account, changes their roles and
+// removes them. API keys can't manage members.
+func membersHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := apiKeyFromContext(r.Context()); ok {
+		http.Error(w, "API keys can't manage members", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		listMembersHandler(w, r)
+	case http.MethodPut:
+		roleMiddleware(db.RoleAdmin, updateMemberHandler)(w, r)
+	case http.MethodDelete:
+		deleteMemberHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func listMembersHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err         error
+		memberships []db.Membership
+		ctx         = r.Context()
+	)
+
+	if memberships, err = dbFromContext(ctx).FindMemberships(userFromContext(ctx).AccountID); err != nil {
+		logger(r).Error("find memberships failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(memberships)
+}
+
+func updateMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		params     memberParameters
+		err        error
+		membership db.Membership
+		role       string
+		database   db.Store
+		ctx        context.Context
+	)
+
+	ctx = r.Context()
+	database = dbFromContext(ctx)
+	role = membershipFromContext(ctx).Role
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil || !db.ValidRole(params.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	if membership, err = database.FindMembership(userFromContext(ctx).AccountID, params.UserID); err != nil {
+		logger(r).Info("member not found", "error", err)
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	if !canGrant(role, membership.Role) || !canGrant(role, params.Role) {
+		http.Error(w, "Requires role owner", http.StatusForbidden)
+		return
+	}
+
+	previous := membership.Role
+	if err = database.UpdateMembershipRole(&membership, params.Role); err != nil {
+		logger(r).Info("account needs an owner", "error", err)
+		http.Error(w, "Account needs an owner", http.StatusConflict)
+		return
+	}
+
+	audit(r, db.AuditMemberRoleChanged, membership.Username, map[string]interface{}{"from": previous, "to": params.Role})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(membership)
+}
+
+// deleteMemberHandler removes a member from the account. Anyone can leave;
+// removing others requires a role that could grant theirs.
+func deleteMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err        error
+		membership db.Membership
+		user       db.User
+		userID     int
+		database   db.Store
+		ctx        context.Context
+	)
+
+	ctx = r.Context()
+	user = userFromContext(ctx)
+	database = dbFromContext(ctx)
+
+	if userID, err = strconv.Atoi(r.URL.Query().Get("user_id")); err != nil {
+		http.Error(w, "No user_id", http.StatusBadRequest)
+		return
+	}
+
+	if membership, err = database.FindMembership(user.AccountID, userID); err != nil {
+		logger(r).Info("member not found", "error", err)
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	if userID != user.ID && !canGrant(membershipFromContext(ctx).Role, membership.Role) {
+		http.Error(w, "Requires role admin", http.StatusForbidden)
+		return
+	}
+
+	if err = database.DeleteMembership(&membership); err != nil {
+		logger(r).Info("account needs an owner", "error", err)
+		http.Error(w, "Account needs an owner", http.StatusConflict)
+		return
+	}
+
+	audit(r, db.AuditMemberRemoved, membership.Username, map[string]interface{}{"role": membership.Role})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// invitationsHandler lists the pending invitations sent by the account,
+// invites users, sending them the token that accepts the invitation through
+// notifier, and revokes invitations. API keys can't manage invitations.
+func invitationsHandler(notifier notify.Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := apiKeyFromContext(r.Context()); ok {
+			http.Error(w, "API keys can't manage invitations", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			roleMiddleware(db.RoleAdmin, listInvitationsHandler)(w, r)
+		case http.MethodPost:
+			roleMiddleware(db.RoleAdmin, createInvitationHandler(notifier))(w, r)
+		case http.MethodDelete:
+			roleMiddleware(db.RoleAdmin, deleteInvitationHandler)(w, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err         error
+		invitations []db.Invitation
+		ctx         = r.Context()
+	)
+
+	if invitations, err = dbFromContext(ctx).FindAccountInvitations(userFromContext(ctx).AccountID); err != nil {
+		logger(r).Error("find invitations failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+// createInvitationHandler invites a username or an email address. The token
+// that accepts the invitation goes to the email, or to the invited user, and
+// is left out of the response.
+func createInvitationHandler(notifier notify.Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			params     memberParameters
+			err        error
+			invitation db.Invitation
+			token      string
+			invitee    db.User
+			user       db.User
+			database   db.Store
+			ctx        context.Context
+		)
+
+		ctx = r.Context()
+		user = userFromContext(ctx)
+		database = dbFromContext(ctx)
+
+		if err = json.NewDecoder(r.Body).Decode(&params); err != nil || !db.ValidRole(params.Role) {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+
+		if params.Username == "" && params.Email == "" {
+			http.Error(w, "No username or email", http.StatusBadRequest)
+			return
+		}
+
+		if !canGrant(membershipFromContext(ctx).Role, params.Role) {
+			http.Error(w, "Requires role owner", http.StatusForbidden)
+			return
+		}
+
+		invitation, token, err = database.CreateInvitation(&user, user.AccountID, params.Username, params.Email, params.Role)
+		if err != nil {
+			logger(r).Error("create invitation failed", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		to := params.Email
+		if to == "" {
+			to = params.Username
+			if invitee, err = database.FindUser(params.Username); err == nil && invitee.Email != nil {
+				to = *invitee.Email
+			}
+		}
+
+		err = notifier.Notify(notify.Message{
+			To:      to,
+			Subject: "You have been invited to an account",
+			Body: fmt.Sprintf("%s invited you to join their account as %s. To accept, sign in and POST the token below "+
+				"to /v1/invitations/accept:\n\n%s\n\nIf you didn't expect this you can ignore it.",
+				user.Username, invitation.Role, token),
+		})
+
+		if err != nil {
+			logger(r).Error("invitation not sent", "error", err)
+			database.DeleteInvitation(user.AccountID, invitation.UUID)
+			http.Error(w, "Invitation could not be sent", http.StatusInternalServerError)
+			return
+		}
+
+		audit(r, db.AuditMemberInvited, invitation.UUID, map[string]interface{}{
+			"username": params.Username,
+			"email":    params.Email,
+			"role":     params.Role,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(invitation)
+	}
+}
+
+func deleteInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+		ctx = r.Context()
+	)
+
+	if err = dbFromContext(ctx).DeleteInvitation(userFromContext(ctx).AccountID, r.URL.Query().Get("id")); err != nil {
+		logger(r).Info("invitation not found", "error", err)
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+
+	audit(r, db.AuditInvitationRevoked, r.URL.Query().Get("id"), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// acceptInvitationHandler makes the user a member of the account whose
+// invitation token they post. API keys can't accept invitations.
+func acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if _, ok := apiKeyFromContext(r.Context()); ok {
+		http.Error(w, "API keys can't accept invitations", http.StatusForbidden)
+		return
+	}
+
+	var (
+		params     memberParameters
+		err        error
+		membership db.Membership
+		invitation db.Invitation
+		user       db.User
+		ctx        context.Context
+	)
+
+	ctx = r.Context()
+	user = userFromContext(ctx)
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if membership, invitation, err = dbFromContext(ctx).AcceptInvitation(&user, params.Token); err != nil {
+		if err == db.ErrLastOwner {
+			http.Error(w, "The account needs an owner", http.StatusConflict)
+			return
+		}
+
+		logger(r).Info("invitation not found", "error", err)
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+
+	// the event belongs to the account that was joined
+	user.AccountID = membership.AccountID
+	ctx = context.WithValue(ctx, userKey, user)
+	audit(r.WithContext(ctx), db.AuditInvitationAccepted, invitation.UUID, map[string]interface{}{"role": membership.Role})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(membership)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// throttle locks keys out for a while after too many failures within a
+// window. Locks are kept in memory and don't survive a restart.
+type throttle struct {
+	limit   int
+	window  time.Duration
+	lockout time.Duration
+	mutex   sync.Mutex
+	keys    map[string]*failures
+}
+
+type failures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+func newThrottle(limit int, window time.Duration, lockout time.Duration) *throttle {
+	return &throttle{limit: limit, window: window, lockout: lockout, keys: make(map[string]*failures)}
+}
+
+// Failed sign ins are throttled per username and per client address. The
+// address limit is higher since users may share an address.
+var (
+	usernameThrottle = newThrottle(5, 15*time.Minute, 15*time.Minute)
+	addressThrottle  = newThrottle(50, 15*time.Minute, 15*time.Minute)
+	resetThrottle    = newThrottle(3, time.Hour, time.Hour)
+)
+
+// SetLockout sets how many failed sign ins lock a username or an address out,
+// and how long they count and lock out for. It must be called before the
+// server starts.
+func SetLockout(attempts int, addressAttempts int, duration time.Duration) {
+	usernameThrottle = newThrottle(attempts, duration, duration)
+	addressThrottle = newThrottle(addressAttempts, duration, duration)
+}
+
+// locked returns how long key is locked out for, or 0 if it isn't
+func (t *throttle) locked(key string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if f, ok := t.keys[key]; ok {
+		return time.Until(f.lockedUntil)
+	}
+
+	return 0
+}
+
+// fail records a failure for key, locking it out once it reaches the limit
+func (t *throttle) fail(key string) {
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for k, f := range t.keys {
+		if now.Sub(f.first) > t.window && now.After(f.lockedUntil) {
+			delete(t.keys, k)
+		}
+	}
+
+	f, ok := t.keys[key]
+	if !ok {
+		f = &failures{first: now}
+		t.keys[key] = f
+	}
+
+	if f.count++; f.count >= t.limit {
+		f.lockedUntil = now.Add(t.lockout)
+		f.count = 0
+		f.first = now
+	}
+}
+
+// reset forgets the failures of key
+func (t *throttle) reset(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.keys, key)
+}
+
+// clientAddress returns the IP address a request came from
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// checkLogin responds with 429 and returns false if the request's username
+// or address is locked out
+func checkLogin(w http.ResponseWriter, r *http.Request, username string) bool {
+	wait := usernameThrottle.locked(username)
+	if d := addressThrottle.locked(clientAddress(r)); d > wait {
+		wait = d
+	}
+
+	if wait <= 0 {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+
+	return false
+}
+
+// failLogin records a failed sign in for a username and the request's address
+func failLogin(r *http.Request, username string) {
+	usernameThrottle.fail(username)
+	addressThrottle.fail(clientAddress(r))
+}
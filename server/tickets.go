@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"dre/db"
+	"dre/metrics"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ticketTTL is how long a ticket can be redeemed for
+const ticketTTL = 30 * time.Second
+
+// ticketProtocol prefixes tickets sent as a websocket subprotocol
+const ticketProtocol = "ticket."
+
+// ticket lets a browser open a websocket as a user, since browsers can't set
+// an Authorization header on websockets. Tickets are used once.
+type ticket struct {
+	user    db.User
+	key     *db.APIKey
+	expires time.Time
+	// preview is the host of the preview a ticket opens, which it can't be
+	// used for anything else
+	preview string
+	// token is the access token a preview was opened with
+	token string
+}
+
+var tickets = struct {
+	sync.Mutex
+	pending map[string]ticket
+}{pending: make(map[string]ticket)}
+
+// ticketsHandler issues a ticket for the authenticated user and account
+func ticketsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		ctx = r.Context()
+		t   = ticket{user: userFromContext(ctx)}
+		id  string
+		err error
+	)
+
+	if key, ok := apiKeyFromContext(ctx); ok {
+		t.key = &key
+	}
+
+	if id, err = issueTicket(t); err != nil {
+		logger(r).Error("ticket not generated", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":     id,
+		"expires_in": int(ticketTTL.Seconds()),
+	})
+}
+
+// issueTicket stores t until ticketTTL from now and returns its ID
+func issueTicket(t ticket) (string, error) {
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
+	t.expires = time.Now().Add(ticketTTL)
+
+	tickets.Lock()
+	for pending, old := range tickets.pending {
+		if time.Now().After(old.expires) {
+			delete(tickets.pending, pending)
+		}
+	}
+	tickets.pending[id] = t
+	tickets.Unlock()
+
+	return id, nil
+}
+
+// randomID returns 32 random bytes, encoded to be used in URLs
+func randomID() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// redeemTicket returns and forgets an unexpired ticket
+func redeemTicket(id string) (ticket, error) {
+	tickets.Lock()
+	t, ok := tickets.pending[id]
+	delete(tickets.pending, id)
+	tickets.Unlock()
+
+	if !ok || time.Now().After(t.expires) {
+		return ticket{}, fmt.Errorf("server: unknown or expired ticket")
+	}
+
+	return t, nil
+}
+
+// requestTicket returns the ticket of a websocket request, given as the
+// ticket query parameter or as a "ticket.<ticket>" subprotocol
+func requestTicket(r *http.Request) string {
+	if id := r.URL.Query().Get("ticket"); id != "" {
+		return id
+	}
+
+	for _, protocols := range r.Header["Sec-Websocket-Protocol"] {
+		for _, protocol := range strings.Split(protocols, ",") {
+			if protocol = strings.TrimSpace(protocol); strings.HasPrefix(protocol, ticketProtocol) {
+				return strings.TrimPrefix(protocol, ticketProtocol)
+			}
+		}
+	}
+
+	return ""
+}
+
+// ticketMiddleware authenticates a websocket request by its ticket before it
+// is upgraded. Requests without a ticket are authenticated like any other.
+func ticketMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			t          ticket
+			user       db.User
+			membership db.Membership
+			err        error
+			ctx        context.Context
+			database   db.Store
+			id         = requestTicket(r)
+		)
+
+		if id == "" {
+			authenticateMiddleware(next)(w, r)
+			return
+		}
+
+		if t, err = redeemTicket(id); err == nil && t.preview != "" {
+			err = errors.New("server: ticket is for a preview")
+		}
+
+		if err != nil {
+			logger(r).Info("redeem ticket failed", "error", err)
+			metrics.AuthFailures.WithLabelValues("ticket").Inc()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ctx = r.Context()
+		database = dbFromContext(ctx)
+
+		// the user may have been removed from the account since
+		if user, err = database.FindUserByID(t.user.ID); err == nil && user.Disabled() {
+			err = db.ErrUserDisabled
+		}
+
+		if err != nil {
+			logger(r).Info("ticket user rejected", "error", err)
+			metrics.AuthFailures.WithLabelValues("ticket").Inc()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		user.AccountID = t.user.AccountID
+
+		if membership, err = database.FindMembership(user.AccountID, user.ID); err != nil {
+			logger(r).Info("not a member of the account", "error", err)
+			http.Error(w, "Not a member of the account", http.StatusForbidden)
+			return
+		}
+
+		if !checkSecondFactor(w, r, user, membership, t.key != nil) {
+			return
+		}
+
+		if t.key != nil {
+			ctx = context.WithValue(ctx, apiKeyKey, *t.key)
+		}
+
+		ctx = context.WithValue(ctx, membershipKey, membership)
+		ctx = context.WithValue(ctx, userKey, user)
+		next(w, withLogFields(r.WithContext(ctx), "user_id", user.ID, "account_id", user.AccountID))
+	}
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"crypto/rand"
+	"dre/db"
+	"dre/totp"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// challengeTTL is how long a user has to give their second factor after
+// their password
+const challengeTTL = 5 * time.Minute
+
+// challengeAttempts is how many codes can be tried against a challenge
+const challengeAttempts = 5
+
+// totpIssuer names the service in authenticator apps
+const totpIssuer = "dre"
+
+// challenge is a sign in waiting for its second factor
+type challenge struct {
+	userID   int
+	attempts int
+	expires  time.Time
+}
+
+var challenges = struct {
+	sync.Mutex
+	pending map[string]*challenge
+}{pending: make(map[string]*challenge)}
+
+type twoFactorParameters struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// signIn responds with tokens for a user that proved who they are, or with
+// a second factor challenge if they use two-factor authentication. details
+// describe how they signed in for the audit log.
+func signIn(w http.ResponseWriter, r *http.Request, user db.User, details map[string]interface{}) {
+	var (
+		tokens db.Tokens
+		err    error
+	)
+
+	if user.Disabled() {
+		details["reason"] = "disabled"
+		auditUser(r, &user, "", db.AuditSignInFailed, details)
+		http.Error(w, "User is disabled", http.StatusForbidden)
+		return
+	}
+
+	if user.TOTPEnabled {
+		buf := make([]byte, 32)
+		if _, err = rand.Read(buf); err != nil {
+			logger(r).Error("challenge not generated", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		id := base64.RawURLEncoding.EncodeToString(buf)
+
+		challenges.Lock()
+		for pending, old := range challenges.pending {
+			if time.Now().After(old.expires) {
+				delete(challenges.pending, pending)
+			}
+		}
+		challenges.pending[id] = &challenge{userID: user.ID, expires: time.Now().Add(challengeTTL)}
+		challenges.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"challenge":     id,
+			"second_factor": "totp",
+			"expires_in":    int(challengeTTL.Seconds()),
+		})
+		return
+	}
+
+	if tokens, err = dbFromContext(r.Context()).CreateTokens(&user); err != nil {
+		logger(r).Error("create tokens failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	auditUser(r, &user, "", db.AuditSignIn, details)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// secondFactorHandler finishes a sign in with a TOTP or recovery code
+func secondFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		params   twoFactorParameters
+		err      error
+		user     db.User
+		tokens   db.Tokens
+		database = dbFromContext(r.Context())
+	)
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	challenges.Lock()
+	c, ok := challenges.pending[params.Challenge]
+	if ok && (time.Now().After(c.expires) || c.attempts >= challengeAttempts) {
+		delete(challenges.pending, params.Challenge)
+		ok = false
+	}
+	if ok {
+		c.attempts++
+	}
+	challenges.Unlock()
+
+	if !ok {
+		http.Error(w, "Unknown or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	if user, err = database.FindUserByID(c.userID); err != nil {
+		logger(r).Info("find user by id failed", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !checkLogin(w, r, user.Username) {
+		return
+	}
+
+	if err = database.VerifySecondFactor(&user, params.Code); err != nil {
+		logger(r).Info("invalid code", "error", err)
+		failLogin(r, user.Username)
+		auditUser(r, &user, "", db.AuditTwoFactorFailed, nil)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	challenges.Lock()
+	delete(challenges.pending, params.Challenge)
+	challenges.Unlock()
+	usernameThrottle.reset(user.Username)
+
+	if tokens, err = database.CreateTokens(&user); err != nil {
+		logger(r).Error("create tokens failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	auditUser(r, &user, "", db.AuditSignIn, map[string]interface{}{"second_factor": true})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// twoFactorHandler shows, enrolls and disables the user's two-factor
+// authentication. API keys can't manage it.
+func twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := apiKeyFromContext(r.Context()); ok {
+		http.Error(w, "API keys can't manage two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		showTwoFactorHandler(w, r)
+	case http.MethodPost:
+		enrollTwoFactorHandler(w, r)
+	case http.MethodDelete:
+		disableTwoFactorHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func showTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":  userFromContext(ctx).TOTPEnabled,
+		"required": membershipFromContext(ctx).Require2FA,
+	})
+}
+
+// enrollTwoFactorHandler returns a new secret and its otpauth URI. It takes
+// effect once confirmed with a code.
+func enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		secret string
+		user   = userFromContext(r.Context())
+	)
+
+	if secret, err = dbFromContext(r.Context()).EnrollTOTP(&user); err != nil {
+		if err == db.ErrTOTPEnabled {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+
+		logger(r).Error("enroll TOTP failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"secret": secret,
+		"uri":    totp.URI(totpIssuer, user.Username, secret),
+	})
+}
+
+// disableTwoFactorHandler turns off two-factor authentication given a
+// current code, unless an account of the user requires it
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		params      twoFactorParameters
+		err         error
+		memberships []db.Membership
+		database    = dbFromContext(r.Context())
+		user        = userFromContext(r.Context())
+	)
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if memberships, err = database.FindUserMemberships(user.ID); err != nil {
+		logger(r).Error("find user memberships failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, membership := range memberships {
+		if membership.Require2FA {
+			http.Error(w, "An account you belong to requires two-factor authentication", http.StatusConflict)
+			return
+		}
+	}
+
+	if !verifyCode(w, r, &user, params.Code) {
+		return
+	}
+
+	if err = database.DisableTOTP(&user); err != nil {
+		logger(r).Error("disable totp failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, db.AuditTwoFactorDisabled, "", nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// confirmTwoFactorHandler enables two-factor authentication with a code from
+// the newly enrolled authenticator and returns recovery codes
+func confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		params twoFactorParameters
+		err    error
+		codes  []string
+		user   = userFromContext(r.Context())
+	)
+
+	if _, ok := apiKeyFromContext(r.Context()); ok {
+		http.Error(w, "API keys can't manage two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if codes, err = dbFromContext(r.Context()).ConfirmTOTP(&user, params.Code); err != nil {
+		switch err {
+		case db.ErrTOTPEnabled:
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		case db.ErrInvalidCode:
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+		default:
+			logger(r).Info("two-factor authentication is not enrolled", "error", err)
+			http.Error(w, "Two-factor authentication is not enrolled", http.StatusBadRequest)
+		}
+		return
+	}
+
+	audit(r, db.AuditTwoFactorEnabled, "", nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// recoveryCodesHandler replaces the user's recovery codes given a current
+// code
+func recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		params twoFactorParameters
+		err    error
+		codes  []string
+		user   = userFromContext(r.Context())
+	)
+
+	if _, ok := apiKeyFromContext(r.Context()); ok {
+		http.Error(w, "API keys can't manage two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		logger(r).Info("invalid request body", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !verifyCode(w, r, &user, params.Code) {
+		return
+	}
+
+	if codes, err = dbFromContext(r.Context()).CreateRecoveryCodes(&user); err != nil {
+		logger(r).Error("create recovery codes failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, db.AuditRecoveryCodesCreated, "", nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// verifyCode checks a second factor code of a signed in user, responding
+// and returning false if it's wrong
+func verifyCode(w http.ResponseWriter, r *http.Request, user *db.User, code string) bool {
+	if !checkLogin(w, r, user.Username) {
+		return false
+	}
+
+	if err := dbFromContext(r.Context()).VerifySecondFactor(user, code); err != nil {
+		logger(r).Info("invalid code", "error", err)
+		failLogin(r, user.Username)
+		audit(r, db.AuditTwoFactorFailed, "", nil)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// twoFactorPrefix is where users can set up two-factor authentication, which
+// stays reachable when an account requires it
+const twoFactorPrefix = "/v1/2fa"
+
+// checkSecondFactor responds with 403 and returns false if the account the
+// request acts on requires two-factor authentication the user hasn't set
+// up. API keys aren't affected since they are issued by admins. Users can
+// still list their accounts, but not change the requirement.
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, user db.User, membership db.Membership, apiKey bool) bool {
+	if !missingSecondFactor(user, membership, apiKey) {
+		return true
+	}
+
+	if strings.HasPrefix(r.URL.Path, twoFactorPrefix) || r.URL.Path == "/v1/signout" ||
+		(r.URL.Path == "/v1/accounts" && r.Method == http.MethodGet) {
+		return true
+	}
+
+	http.Error(w, "Account requires two-factor authentication", http.StatusForbidden)
+	return false
+}
+
+// missingSecondFactor reports whether the account requires two-factor
+// authentication the user hasn't set up, wherever they are going
+func missingSecondFactor(user db.User, membership db.Membership, apiKey bool) bool {
+	return !apiKey && membership.Require2FA && !user.TOTPEnabled
+}
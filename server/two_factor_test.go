@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequired2FAIsNotLiftedWithout2FA(t *testing.T) {
+	ts := newTestServer(t)
+
+	alice, err := ts.database.FindUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ts.database.SetRequire2FA(alice.AccountID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := ts.do(http.MethodGet, "/v1/accounts", "", ts.alice); w.Code != http.StatusOK {
+		t.Errorf("listing accounts got %d, want 200: %s", w.Code, w.Body)
+	}
+
+	if w := ts.do(http.MethodGet, "/v1/containers", "", ts.alice); w.Code != http.StatusForbidden {
+		t.Errorf("listing containers got %d, want 403: %s", w.Code, w.Body)
+	}
+
+	if w := ts.do(http.MethodPut, "/v1/accounts", `{"require_2fa":false}`, ts.alice); w.Code != http.StatusForbidden {
+		t.Errorf("lifting the requirement got %d, want 403: %s", w.Code, w.Body)
+	}
+
+	if membership, _ := ts.database.FindMembership(alice.AccountID, alice.ID); !membership.Require2FA {
+		t.Error("requirement lifted by a user without two-factor authentication")
+	}
+}
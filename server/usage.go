@@ -0,0 +1,197 @@
+package server
+
+import (
+	"dre/db"
+	"dre/docker"
+	"dre/logging"
+	"dre/streams"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// meterInterval is how often the resources of running containers are
+// sampled
+const meterInterval = 15 * time.Second
+
+// meter records the CPU and memory a container uses until done is closed
+func meter(log *logging.Logger, ctr *db.Container, containerID string, done <-chan struct{}) {
+	var (
+		ticker = time.NewTicker(meterInterval)
+		last   = time.Now()
+		stats  docker.Stats
+		err    error
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(last).Seconds()
+			last = now
+
+			if stats, err = docker.ContainerStats(containerID); err != nil {
+				log.Warn("container stats failed", "error", err)
+				continue
+			}
+
+			cpuSeconds := stats.CPUPercent / 100 * elapsed
+			memoryGBSeconds := float64(stats.MemoryBytes) / 1e9 * elapsed
+
+			if err = ctr.RecordUsage(cpuSeconds, memoryGBSeconds); err != nil {
+				log.Error("usage not recorded", "error", err)
+			}
+		}
+	}
+}
+
+// MaxVolumeQuotaMB is the largest workspace quota a container can ask for,
+// set from the config
+var MaxVolumeQuotaMB = 10240
+
+// volumeInterval is how often the workspaces of running containers are
+// measured
+const volumeInterval = time.Minute
+
+// watchVolume ends a session once its container's workspace grows over its
+// quota, which stops the container, until done is closed
+func watchVolume(log *logging.Logger, ctr *db.Container, adapter *streams.Adapter, done <-chan struct{}) {
+	var (
+		ticker = time.NewTicker(volumeInterval)
+		quota  = int64(ctr.VolumeQuotaMB) * 1024 * 1024
+		size   int64
+		err    error
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if size, err = docker.VolumeSize(ctr.Volume); err != nil {
+				log.Warn("workspace not measured", "error", err)
+				continue
+			}
+
+			if size <= quota {
+				continue
+			}
+
+			log.Warn("workspace over quota, ending session", "size_mb", size>>20, "quota_mb", ctr.VolumeQuotaMB)
+			broadcastNotice(adapter, fmt.Sprintf("The workspace is over its quota of %d MB, this session is ending.", ctr.VolumeQuotaMB))
+			adapter.Close()
+			adapter.Expire()
+
+			return
+		}
+	}
+}
+
+// quotaMiddleware rejects requests that would start a container once the
+// account has used up its quota. It runs before the websocket upgrade so
+// that clients get an ordinary HTTP error.
+func quotaMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			err    error
+			ctx    = r.Context()
+			params = parseParams(r.URL.Query())
+		)
+
+		if params.SourceURL == "" && containerPool.get(params.ContainerID) != nil {
+			next(w, r)
+			return
+		}
+
+		if err = dbFromContext(ctx).CheckQuota(userFromContext(ctx).AccountID); err != nil {
+			if _, ok := err.(db.QuotaError); ok {
+				http.Error(w, "Quota exceeded: "+err.Error(), http.StatusForbidden)
+				return
+			}
+
+			logger(r).Error("check quota failed", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// usageHandler returns the account's usage by day or month between since
+// and until, along with its quota and what counts against it now
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var (
+		err       error
+		usage     []db.Usage
+		quota     db.Quota
+		minutes   float64
+		sessions  int
+		since     time.Time
+		until     = time.Now()
+		ctx       = r.Context()
+		query     = r.URL.Query()
+		period    = query.Get("period")
+		accountID = userFromContext(ctx).AccountID
+		database  = dbFromContext(ctx)
+	)
+
+	switch period {
+	case db.PeriodDay:
+		since = until.AddDate(0, 0, -30)
+	case "", db.PeriodMonth:
+		period = db.PeriodMonth
+		since = until.AddDate(-1, 0, 0)
+	default:
+		http.Error(w, "Invalid period, expected day or month", http.StatusBadRequest)
+		return
+	}
+
+	for name, value := range map[string]*time.Time{"since": &since, "until": &until} {
+		if query.Get(name) == "" {
+			continue
+		}
+
+		if *value, err = time.Parse(time.RFC3339, query.Get(name)); err != nil {
+			http.Error(w, "Invalid "+name+", expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if usage, err = database.FindUsage(accountID, period, since, until); err != nil {
+		logger(r).Error("find usage failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if quota, err = database.FindQuota(accountID); err == nil {
+		if minutes, err = database.MonthlyMinutes(accountID); err == nil {
+			sessions, err = database.ActiveSessions(accountID)
+		}
+	}
+
+	if err != nil {
+		logger(r).Error("find quota usage failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"usage": usage,
+		"quota": quota,
+		"current": map[string]interface{}{
+			"monthly_minutes":     minutes,
+			"concurrent_sessions": sessions,
+		},
+	})
+}
@@ -1,10 +1,11 @@
 package streams
 
 import (
+	"dre/logging"
+	"dre/metrics"
 	"dre/utils"
 	"errors"
-	"fmt"
-	"log"
+	"io"
 	"sync"
 )
 
@@ -14,8 +15,14 @@ type Stream interface {
 	Write(buf []byte) error
 }
 
+// Resizer is a stream backed by a terminal that can be resized
+type Resizer interface {
+	Resize(cols int, rows int) error
+}
+
 // Mux takes a writer stream and connects its outputs to multiple readers
 type Mux struct {
+	mutex   sync.Mutex
 	writer  Stream
 	readers []Stream
 }
@@ -25,12 +32,24 @@ type Adapter struct {
 	source       Stream
 	streams      []Stream
 	mux          *Mux
+	members      sync.WaitGroup
+	mutex        sync.Mutex
+	joined       chan struct{} // closed once a member joins or the wait expires
+	waiting      bool
+	ended        bool
 	OnDisconnect func() error
 }
 
-// NewAdapter takes streams and returns a Adapter
-func NewAdapter(source Stream, stms ...Stream) Adapter {
-	adapter := Adapter{source: source, streams: stms}
+// NewAdapter takes streams and returns a Adapter. Without streams, the
+// adapter waits for a member to join before it can disconnect.
+func NewAdapter(source Stream, stms ...Stream) *Adapter {
+	adapter := &Adapter{source: source, streams: stms, mux: &Mux{writer: source, readers: stms}}
+	adapter.joined = make(chan struct{})
+	adapter.waiting = len(stms) == 0
+	if !adapter.waiting {
+		close(adapter.joined)
+	}
+
 	return adapter
 }
 
@@ -49,6 +68,8 @@ func pipeStreams(writer Stream, reader Stream) error {
 		if err = reader.Write(buf); err != nil {
 			return err
 		}
+
+		metrics.StreamBytes.WithLabelValues("in").Add(float64(len(buf)))
 	}
 }
 
@@ -63,51 +84,62 @@ func (m *Mux) Connect() error {
 			return err
 		}
 
-		for _, reader := range m.readers {
-			if err = reader.Write(buf); err != nil {
-				return err
-			}
+		m.write(buf)
+	}
+}
+
+// write writes buf to every reader. Readers that fail, like websockets
+// whose clients left, are dropped.
+func (m *Mux) write(buf []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	readers := m.readers[:0:0]
+	for _, reader := range m.readers {
+		if err := reader.Write(buf); err != nil {
+			logging.Default().Debug("stream dropped", "error", err)
+			continue
 		}
+
+		readers = append(readers, reader)
+		metrics.StreamBytes.WithLabelValues("out").Add(float64(len(buf)))
 	}
+
+	m.readers = readers
+}
+
+func (m *Mux) add(str Stream) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.readers = append(m.readers, str)
 }
 
 // Connect takes the adapters streams and connects their reads and writes
-// It currently only supports two streams
+// until they and every member that joined since have disconnected
 func (a *Adapter) Connect() error {
 	// TODO: check for errors, return 500 on fail
 
 	// copy everything from the pty master to the websocket
 	// using base64 encoding for now due to limitations in term.js
 
-	size := len(a.streams)
-	if size < 1 {
-		message := fmt.Sprintf("Adapter requires exactly two streams, has %v.", size)
-		return errors.New(message)
-	}
-
 	if a.source == nil {
 		return errors.New("Adapter requires a source stream")
 	}
 
-	var wg sync.WaitGroup
-
-	a.mux = &Mux{}
-	a.mux.writer = a.source
-	a.mux.readers = a.streams
 	go a.mux.Connect()
 
 	for _, str := range a.streams {
-		wg.Add(1)
-		go func(s Stream) {
-			if err := pipeStreams(s, a.source); err != nil {
-				log.Println(err)
-			}
-
-			wg.Done()
-		}(str)
+		a.members.Add(1)
+		go a.pipe(str)
 	}
 
-	wg.Wait()
+	<-a.joined
+	a.members.Wait()
+
+	a.mutex.Lock()
+	a.ended = true
+	a.mutex.Unlock()
 
 	if a.OnDisconnect != nil {
 		if err := a.OnDisconnect(); err != nil {
@@ -118,9 +150,120 @@ func (a *Adapter) Connect() error {
 	return nil
 }
 
+// pipe connects a member's stream to the source until either fails
+func (a *Adapter) pipe(str Stream) {
+	defer a.members.Done()
+
+	if err := pipeStreams(str, a.source); err != nil {
+		logging.Default().Debug("member stream closed", "error", err)
+	}
+}
+
 // AddStream adds a stream to the adapter and connects it to the source
 func (a *Adapter) AddStream(str Stream) {
-	a.mux.readers = append(a.mux.readers, str)
+	a.mux.add(str)
+
 	err := pipeStreams(str, a.source)
-	log.Println(err)
+	logging.Default().Debug("stream closed", "error", err)
+}
+
+// Join adds a member's stream to the adapter and connects it to the source
+// until it disconnects. Unlike AddStream, the adapter stays connected while
+// any member is. It fails once the adapter has disconnected.
+func (a *Adapter) Join(str Stream) error {
+	a.mutex.Lock()
+	if a.ended {
+		a.mutex.Unlock()
+		return errors.New("streams: adapter has disconnected")
+	}
+
+	a.members.Add(1)
+	if a.waiting {
+		a.waiting = false
+		close(a.joined)
+	}
+	a.mutex.Unlock()
+
+	a.mux.add(str)
+	a.pipe(str)
+
+	return nil
+}
+
+// Expire stops an adapter that was created without streams from waiting
+// for a member, so that it disconnects. It does nothing once one has joined.
+func (a *Adapter) Expire() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.waiting {
+		a.waiting = false
+		close(a.joined)
+	}
+}
+
+// Viewers returns the number of streams connected to the adapter
+func (a *Adapter) Viewers() int {
+	a.mux.mutex.Lock()
+	defer a.mux.mutex.Unlock()
+
+	return len(a.mux.readers)
+}
+
+// Resize resizes the source if it is a terminal
+func (a *Adapter) Resize(cols int, rows int) error {
+	if r, ok := a.source.(Resizer); ok {
+		return r.Resize(cols, rows)
+	}
+
+	return nil
+}
+
+// Broadcast writes buf to every stream connected to the adapter, as if the
+// source had written it
+func (a *Adapter) Broadcast(buf []byte) {
+	a.mux.write(buf)
+}
+
+// Close closes every stream connected to the adapter that can be closed,
+// which disconnects them as if their clients had left
+func (a *Adapter) Close() {
+	a.mux.mutex.Lock()
+	defer a.mux.mutex.Unlock()
+
+	for _, str := range a.mux.readers {
+		if c, ok := str.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				logging.Default().Warn("stream not closed", "error", err)
+			}
+		}
+	}
+}
+
+// readOnly is a stream whose reads are discarded
+type readOnly struct {
+	Stream
+}
+
+// ReadOnly wraps a stream so that nothing read from it is passed on. Reads
+// block until the underlying stream fails.
+func ReadOnly(s Stream) Stream {
+	return &readOnly{s}
+}
+
+// Close closes the underlying stream if it can be closed
+func (r *readOnly) Close() error {
+	if c, ok := r.Stream.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func (r *readOnly) Read() ([]byte, error) {
+	for {
+		if _, err := r.Stream.Read(); err != nil {
+			return nil, err
+		}
+	}
 }
@@ -0,0 +1,139 @@
+// Package tracing records OpenTelemetry spans and exports them over OTLP.
+// Until Setup is called with an endpoint, spans are not recorded and cost
+// next to nothing.
+package tracing
+
+import (
+	"context"
+	"dre/logging"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceName names the server in exported spans
+const serviceName = "dre"
+
+var tracer = otel.Tracer("dre")
+
+// Setup exports spans to the OTLP/HTTP collector at endpoint, a URL like
+// http://localhost:4318. Spans go to /v1/traces unless endpoint has a path.
+// It returns a function that flushes spans not yet exported and stops
+// exporting.
+func Setup(endpoint string) (func(context.Context) error, error) {
+	var (
+		u        *url.URL
+		err      error
+		exporter *otlptrace.Exporter
+		options  []otlptracehttp.Option
+	)
+
+	if u, err = url.Parse(endpoint); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("tracing: endpoint must be a URL like http://localhost:4318, got %q", endpoint)
+	}
+
+	options = append(options, otlptracehttp.WithEndpoint(u.Host))
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	// the exporter connects lazily, so a collector that is down doesn't
+	// stop the server from starting
+	if exporter, err = otlptracehttp.New(context.Background(), options...); err != nil {
+		return nil, fmt.Errorf("tracing: exporter not created: %s", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logging.Default().Warn("spans not exported", "error", err)
+	}))
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span named name as a child of the span in ctx, if any
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartChild is Start for spans that only matter as part of a larger
+// operation, like queries. Without a recorded span in ctx, none is started.
+func StartChild(ctx context.Context, name string, attrs ...attribute.KeyValue) trace.Span {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return parent
+	}
+
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// End ends span, marking it failed if err is set
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// StartRequest starts the server span of a request matched to route,
+// continuing the trace of the client if it sent a traceparent header
+func StartRequest(r *http.Request, route string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	return tracer.Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest(serviceName, route, r)...))
+}
+
+// EndRequest ends the server span of a request that was answered with status
+func EndRequest(span trace.Span, status int) {
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+	span.End()
+}
+
+// Link returns a link to the span in ctx, for work that ctx asked for but
+// that doesn't run as its child, like a queued build
+func Link(ctx context.Context) trace.Link {
+	return trace.Link{SpanContext: trace.SpanContextFromContext(ctx)}
+}
+
+// StartLinked starts a span named name in a trace of its own, linked to the
+// spans in links
+func StartLinked(name string, links []trace.Link, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(context.Background(), name, trace.WithNewRoot(), trace.WithLinks(links...), trace.WithAttributes(attrs...))
+}
+
+// TraceID returns the ID of the trace of the span in ctx, or "" if the span
+// isn't recorded
+func TraceID(ctx context.Context) string {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return ""
+	}
+
+	return span.SpanContext().TraceID().String()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"dre/db"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// usersCommand lists, creates, disables and enables users:
+//
+//	dre users list
+//	dre users create [-email e] [-password p] [-account id [-role r]] <username>
+//	dre users disable <username>
+//	dre users enable <username>
+//
+// create prompts for the password unless it is given, or reads it from
+// stdin when stdin isn't a terminal. Users get an account of their own and
+// can be added to another with -account.
+func usersCommand(database *db.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: dre users list|create|disable|enable")
+	}
+
+	switch args[0] {
+	case "list":
+		return listUsers(database)
+	case "create":
+		return createUser(database, args[1:])
+	case "disable", "enable":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: dre users %s <username>", args[0])
+		}
+
+		return setUserDisabled(database, args[1], args[0] == "disable")
+	}
+
+	return fmt.Errorf("users: unknown command %q", args[0])
+}
+
+func listUsers(database *db.DB) error {
+	var (
+		err   error
+		users []db.User
+	)
+
+	if users, err = database.FindUsers(); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tEMAIL\tACCOUNT\t2FA\tSTATUS\tCREATED")
+	for _, u := range users {
+		email, status := "", "active"
+		if u.Email != nil {
+			email = *u.Email
+		}
+
+		if u.Disabled() {
+			status = "disabled"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%t\t%s\t%s\n", u.ID, u.Username, email, u.AccountID, u.TOTPEnabled, status, u.CreatedAt)
+	}
+
+	return w.Flush()
+}
+
+func createUser(database *db.DB, args []string) error {
+	var (
+		err      error
+		user     db.User
+		flags    = flag.NewFlagSet("users create", flag.ContinueOnError)
+		email    = flags.String("email", "", "email address of the user")
+		password = flags.String("password", "", "password of the user, prompted for if not given")
+		account  = flags.Int("account", 0, "also add the user to this account")
+		role     = flags.String("role", db.RoleMember, "role of the user in -account")
+	)
+
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: dre users create [flags] <username>")
+	}
+
+	if *account != 0 && !db.ValidRole(*role) {
+		return fmt.Errorf("users: unknown role %q", *role)
+	}
+
+	if *password == "" {
+		if *password, err = readPassword(); err != nil {
+			return err
+		}
+	}
+
+	if err = db.CheckPassword(flags.Arg(0), *password); err != nil {
+		return err
+	}
+
+	if user, err = database.CreateUser(flags.Arg(0), *password, *email); err != nil {
+		return err
+	}
+
+	if *account != 0 {
+		if _, err = database.CreateMembership(*account, user.ID, *role); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Created user %s (%d) with account %d\n", user.Username, user.ID, user.AccountID)
+
+	return nil
+}
+
+// readPassword prompts for a password twice on a terminal, or reads a line
+// from stdin otherwise
+func readPassword() (string, error) {
+	var (
+		err      error
+		password []byte
+		again    []byte
+		fd       = int(os.Stdin.Fd())
+	)
+
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("users: no password on stdin")
+		}
+
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Print("Password: ")
+	password, err = terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Print("Password again: ")
+	again, err = terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(again) {
+		return "", errors.New("users: passwords don't match")
+	}
+
+	return string(password), nil
+}
+
+func setUserDisabled(database *db.DB, username string, disabled bool) error {
+	var (
+		err    error
+		user   db.User
+		action = db.AuditUserEnabled
+		done   = "Enabled"
+	)
+
+	if user, err = database.FindUser(username); err != nil {
+		return fmt.Errorf("users: no user %q", username)
+	}
+
+	if err = database.SetUserDisabled(&user, disabled); err != nil {
+		return err
+	}
+
+	if disabled {
+		action, done = db.AuditUserDisabled, "Disabled"
+	}
+	auditCommand(database, user.AccountID, action, user.Username, nil)
+
+	fmt.Printf("%s user %s\n", done, user.Username)
+
+	return nil
+}
+
+// auditCommand records an event done from the command line in an account's
+// audit log
+func auditCommand(database *db.DB, accountID int, action string, target string, details map[string]interface{}) {
+	event := db.AuditEvent{AccountID: &accountID, Actor: "cli", Action: action, Target: target, UserAgent: "dre cli"}
+
+	if err := database.CreateAuditEvent(&event, details); err != nil {
+		fmt.Println(err)
+	}
+}
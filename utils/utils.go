@@ -2,13 +2,14 @@ package utils
 
 import (
 	"bytes"
+	"dre/logging"
 	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"syscall"
 
 	"github.com/pkg/errors"
 )
@@ -21,7 +22,7 @@ func Decode64(encoded string) string {
 	data, err := base64.StdEncoding.DecodeString(encoded)
 
 	if err != nil {
-		log.Printf("base64 decoding of payload failed: %s\n", err)
+		logging.Default().Info("base64 decoding of payload failed", "error", err)
 	}
 
 	return string(data)
@@ -44,6 +45,18 @@ func ExecDir(dir string, command string, args ...string) (string, string, error)
 	return outb.String(), errb.String(), err
 }
 
+// FreeSpace returns the bytes available to unprivileged users on the
+// filesystem of path
+func FreeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
 func DownloadFile(filepath string, url string) error {
 	// Create the file
 	out, err := os.Create(filepath)
@@ -2,18 +2,27 @@ package ws
 
 import (
 	"context"
+	"dre/logging"
+	"dre/metrics"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Protocol is the subprotocol clients offer alongside any ticket subprotocol,
+// so that the server has a protocol to accept
+const Protocol = "dre"
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1,
 	WriteBufferSize: 1,
+	Subprotocols:    []string{Protocol},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -23,20 +32,56 @@ type key int
 
 const wsKey key = 0
 
+// Resize is the control message a client sends when its terminal changes
+// size. Control messages are JSON, which can't be mistaken for the base64 of
+// input.
+type Resize struct {
+	Type string `json:"type"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
 // WS holds a websocket connection
 type WS struct {
 	connection *websocket.Conn
+	// OnResize is called with the size of the client's terminal
+	OnResize func(cols int, rows int) error
+	log      *logging.Logger
 }
 
 func (ws *WS) Write(buf []byte) error {
-	return ws.connection.WriteMessage(websocket.TextMessage, buf)
+	err := ws.connection.WriteMessage(websocket.TextMessage, buf)
+	if err != nil {
+		metrics.WebSocketErrors.WithLabelValues("write").Inc()
+	}
+
+	return err
 }
 
-// ReadMessage returns the next bytes written to the connection
+// Close tells the client the server is going away and closes the connection
+func (ws *WS) Close() error {
+	deadline := time.Now().Add(time.Second)
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	ws.connection.WriteControl(websocket.CloseMessage, message, deadline)
+
+	return ws.connection.Close()
+}
+
+// ReadMessage returns the next bytes written to the connection. Control
+// messages are handled and skipped.
 func (ws *WS) Read() ([]byte, error) {
 	mt, payload, err := ws.connection.ReadMessage()
 
+	for err == nil && mt == websocket.TextMessage && len(payload) > 0 && payload[0] == '{' {
+		ws.control(payload)
+		mt, payload, err = ws.connection.ReadMessage()
+	}
+
 	if err != nil {
+		if unexpected(err) {
+			metrics.WebSocketErrors.WithLabelValues("read").Inc()
+		}
+
 		if err != io.EOF {
 			return nil, err
 		}
@@ -55,20 +100,48 @@ func (ws *WS) Read() ([]byte, error) {
 	return buf, nil
 }
 
+// unexpected reports whether a read error is more than the client or the
+// server closing the connection
+func unexpected(err error) bool {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return false
+	}
+
+	if _, ok := err.(*websocket.CloseError); ok {
+		return websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived)
+	}
+
+	return true
+}
+
+// control handles a control message. Unknown messages are ignored.
+func (ws *WS) control(payload []byte) {
+	var resize Resize
+
+	if err := json.Unmarshal(payload, &resize); err != nil || resize.Type != "resize" || ws.OnResize == nil {
+		return
+	}
+
+	if err := ws.OnResize(resize.Cols, resize.Rows); err != nil {
+		ws.log.Warn("terminal not resized", "error", err)
+	}
+}
+
 // Middleware creates a websocket connection and adds it to the request context
 // defer conn.Close()
 func Middleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("start wsMiddlewareOne")
+		// the upgrader has already responded when it fails
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Fatalf("Websocket upgrade failed: %s\n", err)
+			metrics.WebSocketErrors.WithLabelValues("upgrade").Inc()
+			logging.FromContext(r.Context()).Info("websocket upgrade failed", "error", err)
+			return
 		}
 
-		ws := WS{conn}
+		ws := WS{connection: conn, log: logging.FromContext(r.Context())}
 		ctx := context.WithValue(r.Context(), wsKey, ws)
 		next.ServeHTTP(w, r.WithContext(ctx))
-		log.Println("end wsMiddlewareOne")
 	}
 }
 